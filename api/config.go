@@ -1,5 +1,31 @@
 package api
 
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	KEY_NAME   = "Name"
+	KEY_LABELS = "Labels"
+)
+
+const (
+	// API_VERSION is the newest API version this server implements.
+	// server.makeHandlerFunc accepts any request whose version - taken
+	// from the URL's /v{version} prefix, or failing that the
+	// Rancher-Volume-Client/<version> User-Agent - falls anywhere in
+	// [MIN_API_VERSION, API_VERSION], so a server can keep serving older
+	// clients across a rolling upgrade instead of requiring every client
+	// to update in lockstep with it.
+	API_VERSION = "1.0"
+
+	// MIN_API_VERSION is the oldest client API version this server still
+	// serves. Bump it only once every client this server needs to support
+	// has moved past it.
+	MIN_API_VERSION = "1.0"
+)
+
 type VolumeMountConfig struct {
 	MountPoint string
 }
@@ -10,6 +36,19 @@ type VolumeCreateConfig struct {
 	BackupURL string
 }
 
+// VolumeCreateRequest is POST /volumes/create's body. Size takes a plain
+// byte count or a string with a k/M/G/T suffix (parsed by
+// util.ParseSize, the same parser "convoy server --default-volume-size"
+// and the Docker Volume Plugin's size= opt already use); empty means
+// s.DefaultVolumeSize.
+type VolumeCreateRequest struct {
+	Name       string
+	DriverName string
+	Size       string
+	BackupURL  string
+	Labels     map[string]string
+}
+
 type BackupListConfig struct {
 	URL          string
 	VolumeUUID   string
@@ -24,3 +63,175 @@ type BackupCreateConfig struct {
 type BackupDeleteConfig struct {
 	URL string
 }
+
+// BackupResponse reports one backup's location and the volume/snapshot
+// it was taken from.
+type BackupResponse struct {
+	URL          string
+	VolumeUUID   string
+	SnapshotUUID string
+}
+
+// BackupsResponse lists every backup a /backups/list call matched.
+type BackupsResponse struct {
+	Backups map[string]BackupResponse
+}
+
+// BackupReplicateConfig selects a backup and the destination to copy it
+// (manifest plus referenced chunks) to. IncrementalFromURL, if set, names
+// a backup already replicated to Dest whose chunks can be assumed present
+// there without a per-chunk existence check.
+type BackupReplicateConfig struct {
+	URL                string
+	Dest               string
+	IncrementalFromURL string
+}
+
+// BackupGCConfig selects the destination and grace period a
+// /backups/gc call should collect unreferenced chunks from.
+type BackupGCConfig struct {
+	URL                string
+	VolumeUUID         string
+	GracePeriodSeconds int64
+}
+
+// BackupGCResponse reports how many unreferenced chunk objects a
+// /backups/gc call removed.
+type BackupGCResponse struct {
+	ChunksRemoved int
+}
+
+// Progress reports how far a long-running operation (backup restore,
+// snapshot upload, EBS attach polling, ...) has gotten.
+type Progress struct {
+	Current int64
+	Total   int64
+}
+
+// Event is one frame of a streamed, newline-delimited JSON response: a
+// status line with an optional Progress and the id of the resource the
+// event is about.
+type Event struct {
+	ID       string
+	Status   string
+	Progress *Progress
+}
+
+// EventActor identifies the resource a VolumeEvent happened to, mirroring
+// the subset of Docker's events API actor fields this tree has an
+// equivalent for.
+type EventActor struct {
+	UUID   string
+	Name   string
+	Driver string
+}
+
+// VolumeEvent is one frame of the GET /v1/events?stream=1 feed: a volume
+// lifecycle notification, published as soon as the action it describes
+// completes, so a subscriber reacts to real state changes instead of
+// polling doVolumeList.
+type VolumeEvent struct {
+	Type     string
+	Action   string
+	Actor    EventActor
+	Time     int64
+	TimeNano int64
+}
+
+// Error is a structured error response for a caller that needs to act on
+// the failure, not just log it: so far only processVolumeCreate's quota
+// rejection, which reports the usage a request would have reached and
+// the limit it would have crossed.
+type Error struct {
+	Code  string
+	Usage int64
+	Limit int64
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: usage %d exceeds limit %d", e.Code, e.Usage, e.Limit)
+}
+
+// HTTPError is a structured error response a caller can parse to branch on
+// failure kind instead of matching against Error()'s free-form text, e.g.
+// the HTTP API mapping a missing volume to 404 instead of a blanket 400.
+// It's distinct from Error above (reserved for the quota subsystem's own
+// usage/limit reporting): Code here is a short machine-readable category
+// ("not_found", "conflict", "insufficient_space", "unavailable", ...)
+// rather than a quota rule name.
+//
+// Status is the HTTP status code makeHandlerFunc should write back; it's
+// tagged json:"-" because it's surfaced as the response's actual status
+// line, not repeated in the body. RetryAfterSeconds, when positive, is
+// written back as a Retry-After header for a throttled block-store
+// operation the caller should simply retry later rather than treat as a
+// hard failure.
+type HTTPError struct {
+	Code    string
+	Message string
+	Details string `json:",omitempty"`
+
+	Status            int `json:"-"`
+	RetryAfterSeconds int `json:"-"`
+}
+
+func (e *HTTPError) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("%s: %s (%s)", e.Code, e.Message, e.Details)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NewHTTPError builds an HTTPError carrying status, the HTTP status code
+// the caller should respond with.
+func NewHTTPError(status int, code, message string) *HTTPError {
+	return &HTTPError{Status: status, Code: code, Message: message}
+}
+
+// NewThrottledError builds an HTTPError for a block-store operation that
+// was rate-limited or throttled by its backend (e.g. S3's SlowDown/
+// RequestLimitExceeded responses), carrying retryAfterSeconds for
+// makeHandlerFunc to surface as a Retry-After header.
+func NewThrottledError(message string, retryAfterSeconds int) *HTTPError {
+	return &HTTPError{
+		Status:            http.StatusServiceUnavailable,
+		Code:              "throttled",
+		Message:           message,
+		RetryAfterSeconds: retryAfterSeconds,
+	}
+}
+
+// QuotaSelector identifies which volumes a QuotaRule governs. An empty
+// field leaves that axis unconstrained; Label uses the same key=value
+// (or bare key) syntax as the volume list's label= filter.
+type QuotaSelector struct {
+	Label  string
+	Driver string
+}
+
+// QuotaRule bounds how much one selector's matching volumes may
+// consume. A zero limit field means that particular limit isn't
+// enforced.
+type QuotaRule struct {
+	Selector       QuotaSelector
+	MaxTotalBytes  int64
+	MaxVolumes     int
+	MaxVolumeBytes int64
+}
+
+// QuotaSetConfig is convoy quota set's request body.
+type QuotaSetConfig struct {
+	QuotaRule
+}
+
+// QuotaListResponse is convoy quota list's response, keyed the same way
+// QuotaManager stores rules internally (see quotaKey).
+type QuotaListResponse struct {
+	Rules map[string]QuotaRule
+}
+
+// QuotaDeleteConfig selects the rule convoy quota rm removes, by the
+// same selector it was set with.
+type QuotaDeleteConfig struct {
+	Selector QuotaSelector
+}
@@ -1,22 +1,71 @@
 package blockstore
 
 import (
+	"bytes"
 	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"encoding/hex"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
+	"github.com/Sirupsen/logrus"
 	"github.com/rancherio/volmgr/api"
 	"github.com/rancherio/volmgr/drivers"
+	"github.com/rancherio/volmgr/logging"
 	"github.com/rancherio/volmgr/utils"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
 	DEFAULT_BLOCK_SIZE = 2097152
+
+	// BLOCK_SIZE_MIN/MAX bound the "blocksize" option Register accepts:
+	// a blockstore's fixed block size must be a power of two in this
+	// range, the same way a device's sector/block size is validated
+	// elsewhere in this tree.
+	BLOCK_SIZE_MIN = 512 * 1024
+	BLOCK_SIZE_MAX = 16 * 1024 * 1024
+
+	// defaultTransferWorkers is how many goroutines
+	// BackupSnapshotWithOptions/RestoreSnapshotWithOptions run concurrently
+	// when opts.Workers isn't set.
+	defaultTransferWorkers = 8
+
+	// progressSaveInterval is how many completed blocks pass between
+	// persisting a transfer's resume manifest.
+	progressSaveInterval = 32
 )
 
 type InitFunc func(root, cfgName string, config map[string]string) (BlockStoreDriver, error)
 
+// BlockStoreDriver must tolerate concurrent calls against distinct paths:
+// BackupSnapshotWithOptions/RestoreSnapshotWithOptions run a pool of
+// worker goroutines that Read/Write/FileSize/MkDirAll the same driver
+// instance in parallel, each against a different content-addressed block
+// path. A driver never needs to serialize two calls for different paths
+// against each other; it only needs each individual call to be safe to
+// issue from any goroutine.
+//
+// Read/Write stream rather than take a fixed-size buffer, so a driver
+// backed by an object store (see s3blockstore) can do a range GET or a
+// multipart PUT instead of having to buffer a whole block in memory
+// first. Write takes an io.ReadSeeker, not a plain io.Reader, because
+// some object store APIs (e.g. S3's PutObject) need to know the upload's
+// size up front; callers with an in-memory []byte can always wrap it in
+// bytes.NewReader.
+//
+// Read/ReadRange/Write take ctx so a driver backed by a real network
+// client (s3blockstore's AWSSDKService) can cancel an in-flight request
+// the moment the caller's own request context is done, instead of
+// streaming a whole block nobody is waiting for anymore. A driver with no
+// meaningful cancellation point of its own (e.g. a plain local/NFS mount,
+// or s3blockstore's MinioService, whose vendored client predates context
+// support) is free to ignore ctx.
 type BlockStoreDriver interface {
 	Kind() string
 	FinalizeInit(root, cfgName, id string) error
@@ -25,8 +74,12 @@ type BlockStoreDriver interface {
 	MkDirAll(dirName string) error
 	Remove(name string) error //Would return error if it's not empty
 	RemoveAll(name string) error
-	Read(src string, data []byte) error
-	Write(data []byte, dst string) error
+	Read(ctx context.Context, src string) (io.ReadCloser, error)
+	// ReadRange is Read narrowed to length bytes starting at offset, so
+	// a caller that only needs part of a block (e.g. a partial restore)
+	// isn't forced to stream the whole thing first.
+	ReadRange(ctx context.Context, src string, offset, length int64) (io.ReadCloser, error)
+	Write(ctx context.Context, dst string, src io.ReadSeeker) error
 	List(path string) ([]string, error)
 }
 
@@ -40,16 +93,100 @@ type BlockStore struct {
 	UUID      string
 	Kind      string
 	BlockSize int64
+
+	// ChunkingMode is CHUNKING_MODE_FIXED (the default) or
+	// CHUNKING_MODE_ROLLING. Fixed mode stores one BlockMapping per
+	// BlockSize-aligned offset; rolling mode instead cuts each changed
+	// region into content-defined, variable-length chunks via
+	// ChunkVariableBlocks, which dedups better against shifted data at
+	// the cost of a slightly larger SnapshotMap. ChunkMinSize/AvgSize/
+	// MaxSize are only meaningful in rolling mode.
+	ChunkingMode string
+	ChunkMinSize int64
+	ChunkAvgSize int64
+	ChunkMaxSize int64
+
+	// Encrypted marks every block in this blockstore as client-side
+	// AES-256-GCM encrypted before it's written to the driver.
+	// EncryptionSalt (hex-encoded) is the scrypt salt BackupSnapshot/
+	// RestoreSnapshot derive the data key from, combined with a
+	// passphrase supplied at call time via BackupOptions.Passphrase;
+	// the passphrase itself is never persisted.
+	//
+	// There is no --encryption-key-file/--encryption-kms option here:
+	// those would wrap a random per-block DEK with a KEK referenced (not
+	// stored) in BlockStore, independent of the plaintext, whereas this
+	// scheme derives each block's key from the plaintext's own checksum
+	// so identical blocks still dedup under encryption (see blockCipher
+	// in crypto.go). Adding KEK-wrapping alongside it would need a second,
+	// incompatible per-block header format and a decision about which
+	// scheme new blocks use, which this snapshot doesn't make; it's
+	// tracked as a real gap rather than implemented speculatively.
+	Encrypted      bool
+	EncryptionSalt string `json:",omitempty"`
+
+	// Compression is COMPRESSION_NONE (the default) or COMPRESSION_GZIP,
+	// applied to every block before it's encrypted (if Encrypted) and
+	// written to the driver. Like Encrypted, it's a blockstore-wide
+	// setting fixed at Register time rather than something each block can
+	// override, so a single BlockStoreDriver.Read never has to guess how
+	// to decode what it gets back.
+	Compression string `json:",omitempty"`
+
+	// Concurrency is how many of this blockstore's blocks
+	// BackupSnapshotWithOptions/RestoreSnapshotWithOptions transfer at
+	// once when opts.Workers isn't set, in place of the fixed
+	// defaultTransferWorkers. It's a blockstore-wide default rather than
+	// a per-call one because the right number of workers depends on the
+	// driver behind it: a local filesystem blockstore gains little past
+	// a handful, while an S3 or NFS driver over a WAN link, where
+	// per-request latency (not local bandwidth) dominates, benefits from
+	// much higher concurrency.
+	Concurrency int `json:",omitempty"`
 }
 
 type BlockMapping struct {
 	Offset        int64
 	BlockChecksum string
+	// Length is the block's size in bytes. It's only set in
+	// CHUNKING_MODE_ROLLING, where chunks are variable-length; a zero
+	// Length means "this blockstore's fixed BlockSize", so fixed-mode
+	// SnapshotMaps written before this field existed still parse the
+	// same way.
+	Length int64 `json:",omitempty"`
+	// PlaintextChecksum is the checksum of the block's unencrypted,
+	// uncompressed content; BlockChecksum becomes the checksum of
+	// whatever's actually written to storage instead - ciphertext,
+	// compressed data, or both - since that's what the block is stored
+	// and ref-counted under (so convergent encryption still dedups
+	// identical plaintext). It's empty only when the blockstore is
+	// neither Encrypted nor Compressed, in which case BlockChecksum
+	// already is the plaintext checksum.
+	PlaintextChecksum string `json:",omitempty"`
 }
 
 type SnapshotMap struct {
 	ID     string
 	Blocks []BlockMapping
+	// Chunks holds the content-defined sub-chunks found while writing this
+	// snapshot's new blocks. It's only used for reporting dedup stats
+	// (see DedupStats); restoring a snapshot still goes through Blocks.
+	Chunks []Chunk
+
+	// CreatedAt is when BackupSnapshotWithOptions wrote this manifest. It's
+	// recorded here, rather than relied on from the blockstore driver's own
+	// file mtime, because not every BlockStoreDriver backend preserves
+	// mtimes (or even has a meaningful one, e.g. some object stores), and
+	// ListSnapshots/PruneSnapshots need a real, backend-independent
+	// timestamp to make retention decisions against.
+	CreatedAt time.Time `json:",omitempty"`
+
+	// ParentID is the snapshot this one was backed up as a delta against
+	// (volume.LastSnapshotID at backup time), or "" for a full backup.
+	// ListSnapshots surfaces it so callers can reconstruct the backup
+	// chain without re-deriving it from volume state that may have since
+	// moved on.
+	ParentID string `json:",omitempty"`
 }
 
 var (
@@ -75,18 +212,121 @@ func GetBlockStoreDriver(kind, root, cfgName string, config map[string]string) (
 	return initializers[kind](root, cfgName, config)
 }
 
+// parseBlockSize reads the optional "blocksize" option out of config,
+// falling back to DEFAULT_BLOCK_SIZE, and validates that whatever value is
+// in effect is a power of two within [BLOCK_SIZE_MIN, BLOCK_SIZE_MAX].
+func parseBlockSize(config map[string]string) (int64, error) {
+	raw, ok := config["blocksize"]
+	if !ok || raw == "" {
+		return DEFAULT_BLOCK_SIZE, nil
+	}
+	blockSize, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid blocksize %v: %v", raw, err)
+	}
+	if blockSize < BLOCK_SIZE_MIN || blockSize > BLOCK_SIZE_MAX {
+		return 0, fmt.Errorf("blocksize %v must be between %v and %v", blockSize, BLOCK_SIZE_MIN, BLOCK_SIZE_MAX)
+	}
+	if blockSize&(blockSize-1) != 0 {
+		return 0, fmt.Errorf("blocksize %v must be a power of two", blockSize)
+	}
+	return blockSize, nil
+}
+
+// parseChunkingConfig reads the optional "chunking", "chunk-min-size",
+// "chunk-avg-size", and "chunk-max-size" options out of config, defaulting
+// to CHUNKING_MODE_FIXED (and DEFAULT_CHUNK_MIN_SIZE/AVG_SIZE/MAX_SIZE,
+// unused in fixed mode) when they're absent.
+func parseChunkingConfig(config map[string]string) (mode string, minSize, avgSize, maxSize int64, err error) {
+	mode = config["chunking"]
+	if mode == "" {
+		mode = CHUNKING_MODE_FIXED
+	}
+	if mode != CHUNKING_MODE_FIXED && mode != CHUNKING_MODE_ROLLING {
+		return "", 0, 0, 0, fmt.Errorf("chunking mode must be %v or %v, not %v", CHUNKING_MODE_FIXED, CHUNKING_MODE_ROLLING, mode)
+	}
+
+	minSize, err = parseChunkSizeOption(config, "chunk-min-size", DEFAULT_CHUNK_MIN_SIZE)
+	if err != nil {
+		return "", 0, 0, 0, err
+	}
+	avgSize, err = parseChunkSizeOption(config, "chunk-avg-size", DEFAULT_CHUNK_AVG_SIZE)
+	if err != nil {
+		return "", 0, 0, 0, err
+	}
+	maxSize, err = parseChunkSizeOption(config, "chunk-max-size", DEFAULT_CHUNK_MAX_SIZE)
+	if err != nil {
+		return "", 0, 0, 0, err
+	}
+	if !(minSize <= avgSize && avgSize <= maxSize) {
+		return "", 0, 0, 0, fmt.Errorf("chunk sizes must satisfy min(%v) <= avg(%v) <= max(%v)", minSize, avgSize, maxSize)
+	}
+	return mode, minSize, avgSize, maxSize, nil
+}
+
+func parseChunkSizeOption(config map[string]string, key string, fallback int64) (int64, error) {
+	raw, ok := config[key]
+	if !ok || raw == "" {
+		return fallback, nil
+	}
+	size, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid %v %v", key, raw)
+	}
+	return size, nil
+}
+
+// parseConcurrency reads the optional "concurrency" option out of config,
+// defaulting to defaultTransferWorkers when it's absent.
+func parseConcurrency(config map[string]string) (int, error) {
+	raw, ok := config["concurrency"]
+	if !ok || raw == "" {
+		return defaultTransferWorkers, nil
+	}
+	concurrency, err := strconv.Atoi(raw)
+	if err != nil || concurrency <= 0 {
+		return 0, fmt.Errorf("invalid concurrency %v", raw)
+	}
+	return concurrency, nil
+}
+
 func Register(root, kind string, config map[string]string) (string, int64, error) {
 	driver, err := GetBlockStoreDriver(kind, root, "", config)
 	if err != nil {
 		return "", 0, err
 	}
 
+	blockSize, err := parseBlockSize(config)
+	if err != nil {
+		return "", 0, err
+	}
+	chunkingMode, chunkMinSize, chunkAvgSize, chunkMaxSize, err := parseChunkingConfig(config)
+	if err != nil {
+		return "", 0, err
+	}
+	encrypted := config["encrypt"] == "true"
+	if encrypted && chunkingMode == CHUNKING_MODE_ROLLING {
+		return "", 0, fmt.Errorf("encryption is not yet supported with %v chunking", CHUNKING_MODE_ROLLING)
+	}
+	compression, err := parseCompression(config)
+	if err != nil {
+		return "", 0, err
+	}
+	concurrency, err := parseConcurrency(config)
+	if err != nil {
+		return "", 0, err
+	}
+
 	var id string
 	bs, err := loadRemoteBlockStoreConfig(driver)
 	if err == nil {
 		// BlockStore has already been created
 		if bs.Kind != kind {
-			return "", 0, fmt.Errorf("specific kind is different from config stored in blockstore")
+			log.WithFields(logrus.Fields{
+				logging.LOG_FIELD_KIND:   kind,
+				logging.LOG_FIELD_REASON: logging.LOG_REASON_FAILURE,
+			}).Error("specified kind is different from config stored in blockstore")
+			return "", 0, ErrBlockstoreMismatch
 		}
 		id = bs.UUID
 		log.Debug("Loaded blockstore cfg in blockstore: ", id)
@@ -105,9 +345,24 @@ func Register(root, kind string, config map[string]string) (string, int64, error
 		log.Debug("Created base directory of blockstore at ", basePath)
 
 		bs = &BlockStore{
-			UUID:      id,
-			Kind:      kind,
-			BlockSize: DEFAULT_BLOCK_SIZE,
+			UUID:         id,
+			Kind:         kind,
+			BlockSize:    blockSize,
+			ChunkingMode: chunkingMode,
+			ChunkMinSize: chunkMinSize,
+			ChunkAvgSize: chunkAvgSize,
+			ChunkMaxSize: chunkMaxSize,
+			Encrypted:    encrypted,
+			Compression:  compression,
+			Concurrency:  concurrency,
+		}
+		if encrypted {
+			salt, err := generateEncryptionSalt()
+			if err != nil {
+				removeDriverConfigFile(root, kind, id)
+				return "", 0, err
+			}
+			bs.EncryptionSalt = hex.EncodeToString(salt)
 		}
 
 		if err := saveRemoteBlockStoreConfig(driver, bs); err != nil {
@@ -167,7 +422,13 @@ func AddVolume(root, id, volumeID, base string, size int64) error {
 	volumeCfg := VOLUME_CONFIG_FILE
 	volumeFile := filepath.Join(volumePath, volumeCfg)
 	if driver.FileExists(volumeFile) {
-		return fmt.Errorf("volume %v already exists in blockstore %v", volumeID, id)
+		log.WithFields(logrus.Fields{
+			logging.LOG_FIELD_VOLUME:     volumeID,
+			logging.LOG_FIELD_BLOCKSTORE: id,
+			logging.LOG_FIELD_EVENT:      logging.LOG_EVENT_ADD,
+			logging.LOG_FIELD_REASON:     logging.LOG_REASON_FAILURE,
+		}).Error("volume already exists in blockstore")
+		return ErrVolumeExists
 	}
 
 	if err := driver.MkDirAll(volumePath); err != nil {
@@ -190,7 +451,12 @@ func AddVolume(root, id, volumeID, base string, size int64) error {
 		return err
 	}
 	log.Debug("Created volume configuration file in blockstore: ", volumeFile)
-	log.Debug("Added blockstore volume ", volumeID)
+	log.WithFields(logrus.Fields{
+		logging.LOG_FIELD_VOLUME:     volumeID,
+		logging.LOG_FIELD_BLOCKSTORE: id,
+		logging.LOG_FIELD_EVENT:      logging.LOG_EVENT_ADD,
+		logging.LOG_FIELD_REASON:     logging.LOG_REASON_COMPLETE,
+	}).Debug("Added blockstore volume")
 
 	return nil
 }
@@ -205,7 +471,10 @@ func RemoveVolume(root, id, volumeID string) error {
 	volumeCfg := VOLUME_CONFIG_FILE
 	volumeFile := filepath.Join(volumePath, volumeCfg)
 	if !driver.FileExists(volumeFile) {
-		return fmt.Errorf("volume %v doesn't exist in blockstore %v", volumeID, id)
+		return generateError(logrus.Fields{
+			logging.LOG_FIELD_VOLUME:     volumeID,
+			logging.LOG_FIELD_BLOCKSTORE: id,
+		}, "volume doesn't exist in blockstore")
 	}
 
 	volumeDir := getVolumePath(volumeID)
@@ -213,16 +482,66 @@ func RemoveVolume(root, id, volumeID string) error {
 		return err
 	}
 	log.Debug("Removed volume directory in blockstore: ", volumeDir)
-	log.Debug("Removed blockstore volume ", volumeID)
+	log.WithFields(logrus.Fields{
+		logging.LOG_FIELD_VOLUME:     volumeID,
+		logging.LOG_FIELD_BLOCKSTORE: id,
+		logging.LOG_FIELD_EVENT:      logging.LOG_EVENT_REMOVE,
+		logging.LOG_FIELD_REASON:     logging.LOG_REASON_COMPLETE,
+	}).Debug("Removed blockstore volume")
 
 	return nil
 }
 
-func BackupSnapshot(root, snapshotID, volumeID, blockstoreID string, sDriver drivers.Driver) error {
+// BackupOptions configures BackupSnapshotWithOptions/RestoreSnapshotWithOptions's
+// worker pool, progress reporting, and bandwidth limit. The zero value runs
+// with the blockstore's own Concurrency (or defaultTransferWorkers if that's
+// also unset), no progress callback, and no rate limit.
+type BackupOptions struct {
+	// Workers overrides the blockstore's Concurrency for this call alone;
+	// leave it unset to use the blockstore-wide default.
+	Workers     int
+	Progress    Progress
+	BytesPerSec int64
+
+	// Passphrase derives this call's AES-256 data key when the
+	// blockstore is Encrypted; ignored otherwise. It's never persisted.
+	Passphrase string
+
+	// Verify, for RestoreSnapshotWithOptions, recomputes each block's
+	// checksum after reading (and decrypting, if encrypted) it,
+	// failing loudly on a mismatch instead of writing corrupt data to
+	// the target volume.
+	Verify bool
+}
+
+func BackupSnapshot(ctx context.Context, root, snapshotID, volumeID, blockstoreID string, sDriver drivers.Driver) error {
+	return BackupSnapshotWithOptions(ctx, root, snapshotID, volumeID, blockstoreID, sDriver, BackupOptions{})
+}
+
+// BackupSnapshotWithOptions is BackupSnapshot with control over worker
+// concurrency, progress reporting, and bandwidth limiting. Blocks are read,
+// hashed, deduped, and uploaded by a pool of opts.Workers goroutines (the
+// blockstore's Concurrency if unset, then defaultTransferWorkers if that is
+// unset too). Progress already recorded in a prior,
+// interrupted call's ".inprogress" manifest is picked up automatically, so
+// calling this again with the same snapshotID resumes instead of
+// re-uploading blocks it already has.
+//
+// ctx is checked between blocks and passed to the blockstore driver's
+// Write (the storage driver's ReadSnapshot does not take it): cancelling it
+// stops the backup from picking up new blocks
+// and returns ctx.Err(), but whatever's already been written stays in the
+// ".inprogress" manifest, so a later call with the same snapshotID resumes
+// from there instead of starting over.
+func BackupSnapshotWithOptions(ctx context.Context, root, snapshotID, volumeID, blockstoreID string, sDriver drivers.Driver, opts BackupOptions) error {
 	b, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
 	if err != nil {
 		return err
 	}
+	enc, err := newBlockCipherForStore(b, opts.Passphrase)
+	if err != nil {
+		return err
+	}
 
 	volume, err := loadVolumeConfig(volumeID, bsDriver)
 	if err != nil {
@@ -261,62 +580,275 @@ func BackupSnapshot(root, snapshotID, volumeID, blockstoreID string, sDriver dri
 	if err != nil {
 		return err
 	}
-	if delta.BlockSize != b.BlockSize {
+	if b.ChunkingMode != CHUNKING_MODE_ROLLING && delta.BlockSize != b.BlockSize {
 		return fmt.Errorf("Currently doesn't support different block sizes between blockstore and driver")
 	}
 	log.Debug("Generated snapshot metadata of ", snapshotID)
 
 	log.Debug("Creating snapshot changed blocks of ", snapshotID)
-	snapshotDeltaMap := &SnapshotMap{
-		Blocks: []BlockMapping{},
-	}
 	if err := sDriver.OpenSnapshot(snapshotID, volumeID); err != nil {
 		return err
 	}
 	defer sDriver.CloseSnapshot(snapshotID, volumeID)
-	for _, d := range delta.Mappings {
-		block := make([]byte, b.BlockSize)
-		for i := int64(0); i < d.Size/delta.BlockSize; i++ {
-			offset := d.Offset + i*delta.BlockSize
-			err := sDriver.ReadSnapshot(snapshotID, volumeID, offset, block)
-			if err != nil {
+
+	// CHUNKING_MODE_ROLLING stores variable-length, content-defined
+	// chunks instead of BlockSize-aligned fixed blocks, so it needs its
+	// own loop over delta.Mappings rather than the fixed-offset one
+	// below. It isn't split across a worker pool or resumable yet:
+	// CompareSnapshot already limits the work to just the changed
+	// regions, which keeps a single run small enough for that not to
+	// matter in practice.
+	if b.ChunkingMode == CHUNKING_MODE_ROLLING {
+		ref := BlockRef{VolumeUUID: volumeID, SnapshotUUID: snapshotID}
+		limiter := NewRateLimiter(opts.BytesPerSec)
+		deltaMap := &SnapshotMap{ID: snapshotID, CreatedAt: time.Now(), ParentID: lastSnapshotID}
+
+		for _, d := range delta.Mappings {
+			if err := ctx.Err(); err != nil {
 				return err
 			}
-			checksum := utils.GetChecksum(block)
-			blkFile := getBlockFilePath(volumeID, checksum)
-			if bsDriver.FileSize(blkFile) >= 0 {
-				blockMapping := BlockMapping{
-					Offset:        offset,
+			region := make([]byte, d.Size)
+			if err := sDriver.ReadSnapshot(snapshotID, volumeID, d.Offset, region); err != nil {
+				return err
+			}
+			limiter.WaitForBytes(d.Size)
+
+			for _, chunk := range ChunkVariableBlocks(d.Offset, region, b.ChunkMinSize, b.ChunkAvgSize, b.ChunkMaxSize) {
+				chunkData := region[chunk.Offset-d.Offset : chunk.Offset-d.Offset+chunk.Length]
+				storageData, checksum, plaintextChecksum, err := encodeBlockForStorage(enc, b.Compression, chunkData)
+				if err != nil {
+					return err
+				}
+				blkFile := getGlobalBlockFilePath(checksum)
+				if bsDriver.FileSize(blkFile) < 0 {
+					if err := bsDriver.MkDirAll(filepath.Dir(blkFile)); err != nil {
+						return err
+					}
+					if err := bsDriver.Write(ctx, blkFile, bytes.NewReader(storageData)); err != nil {
+						return err
+					}
+				}
+				if err := addBlockRef(bsDriver, checksum, ref); err != nil {
+					return err
+				}
+				mapping := BlockMapping{
+					Offset:        chunk.Offset,
+					Length:        chunk.Length,
 					BlockChecksum: checksum,
 				}
-				snapshotDeltaMap.Blocks = append(snapshotDeltaMap.Blocks, blockMapping)
-				log.Debugf("Found existed block match at %v", blkFile)
-				continue
+				if enc != nil || b.Compression != COMPRESSION_NONE {
+					mapping.PlaintextChecksum = plaintextChecksum
+				}
+				deltaMap.Blocks = append(deltaMap.Blocks, mapping)
+				if opts.Progress != nil {
+					opts.Progress.UpdateProgress(len(deltaMap.Blocks), len(deltaMap.Blocks), 0, 0)
+				}
 			}
-			log.Debugf("Creating new block file at %v", blkFile)
-			if err := bsDriver.MkDirAll(filepath.Dir(blkFile)); err != nil {
-				return err
+		}
+
+		snapshotMap := mergeSnapshotMap(snapshotID, deltaMap, lastSnapshotMap)
+		if err := saveSnapshotMap(snapshotID, volumeID, bsDriver, snapshotMap); err != nil {
+			return err
+		}
+		volume.LastSnapshotID = snapshotID
+		if err := saveVolumeConfig(volumeID, bsDriver, volume); err != nil {
+			return err
+		}
+		log.Debug("Backed up snapshot (rolling chunking) ", snapshotID)
+		return nil
+	}
+
+	var offsets []int64
+	for _, d := range delta.Mappings {
+		for i := int64(0); i < d.Size/delta.BlockSize; i++ {
+			offsets = append(offsets, d.Offset+i*delta.BlockSize)
+		}
+	}
+
+	resumeMap, err := loadInProgressSnapshotMap(volumeID, snapshotID, bsDriver)
+	if err != nil {
+		return err
+	}
+	doneBlocks := make(map[int64]BlockMapping)
+	for _, m := range resumeMap.Blocks {
+		doneBlocks[m.Offset] = m
+	}
+	var pendingOffsets []int64
+	for _, offset := range offsets {
+		if _, ok := doneBlocks[offset]; !ok {
+			pendingOffsets = append(pendingOffsets, offset)
+		}
+	}
+	log.Debugf("Resuming backup %v with %v of %v blocks already done", snapshotID, len(doneBlocks), len(offsets))
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = b.Concurrency
+	}
+	if workers <= 0 {
+		workers = defaultTransferWorkers
+	}
+	limiter := NewRateLimiter(opts.BytesPerSec)
+
+	type blockResult struct {
+		offset  int64
+		mapping BlockMapping
+		chunks  []Chunk
+		err     error
+	}
+
+	jobs := make(chan int64, len(pendingOffsets))
+	for _, offset := range pendingOffsets {
+		jobs <- offset
+	}
+	close(jobs)
+
+	results := make(chan blockResult, len(pendingOffsets))
+	var workerWg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerWg.Add(1)
+		go func() {
+			defer workerWg.Done()
+			block := make([]byte, b.BlockSize)
+			for offset := range jobs {
+				if err := ctx.Err(); err != nil {
+					results <- blockResult{offset: offset, err: err}
+					continue
+				}
+				if err := sDriver.ReadSnapshot(snapshotID, volumeID, offset, block); err != nil {
+					results <- blockResult{offset: offset, err: err}
+					continue
+				}
+				limiter.WaitForBytes(b.BlockSize)
+
+				// storageData/checksum are what's actually written to and
+				// ref-counted in the global pool: without compression or
+				// encryption they're just block/its plaintext checksum,
+				// but with either enabled storageData is the compressed
+				// and/or encrypted form and checksum is its checksum,
+				// while plaintextChecksum (kept in BlockMapping.
+				// PlaintextChecksum) is recorded separately so restore can
+				// still validate the decoded content's integrity.
+				storageData, checksum, plaintextChecksum, err := encodeBlockForStorage(enc, b.Compression, block)
+				if err != nil {
+					results <- blockResult{offset: offset, err: err}
+					continue
+				}
+				// blkFile is in the blockstore-global, content-addressed
+				// pool (shared by every volume) rather than scoped to
+				// volumeID, so a block shared by two different volumes
+				// (e.g. a cloned base image) is only ever stored once.
+				blkFile := getGlobalBlockFilePath(checksum)
+				ref := BlockRef{VolumeUUID: volumeID, SnapshotUUID: snapshotID}
+
+				var chunks []Chunk
+				if bsDriver.FileSize(blkFile) >= 0 {
+					log.Debugf("Found existed block match at %v", blkFile)
+				} else {
+					if err := bsDriver.MkDirAll(filepath.Dir(blkFile)); err != nil {
+						results <- blockResult{offset: offset, err: err}
+						continue
+					}
+					if err := bsDriver.Write(ctx, blkFile, bytes.NewReader(storageData)); err != nil {
+						results <- blockResult{offset: offset, err: err}
+						continue
+					}
+					log.Debugf("Created new block file at %v", blkFile)
+
+					// Dedup-stats sub-chunks are always computed against
+					// the plaintext, encryption or not: they're only used
+					// for reporting (see DedupStats), never for restore.
+					for _, chunk := range ChunkData(offset, block) {
+						chunkFile := getChunkFilePath(volumeID, chunk.Checksum)
+						if bsDriver.FileSize(chunkFile) < 0 {
+							if err := bsDriver.MkDirAll(filepath.Dir(chunkFile)); err != nil {
+								results <- blockResult{offset: offset, err: err}
+								continue
+							}
+							chunkData := block[chunk.Offset-offset : chunk.Offset-offset+chunk.Length]
+							if err := bsDriver.Write(ctx, chunkFile, bytes.NewReader(chunkData)); err != nil {
+								results <- blockResult{offset: offset, err: err}
+								continue
+							}
+						}
+						chunks = append(chunks, chunk)
+					}
+				}
+
+				// The ref is only added once the block data backing it exists,
+				// so a worker killed between the two never leaves a refcount
+				// pointing at a nonexistent block: at worst the block is
+				// written but unreferenced, which GCByRefCount already treats
+				// as a normal collectible orphan.
+				if err := addBlockRef(bsDriver, checksum, ref); err != nil {
+					results <- blockResult{offset: offset, err: err}
+					continue
+				}
+
+				mapping := BlockMapping{Offset: offset, BlockChecksum: checksum}
+				if enc != nil || b.Compression != COMPRESSION_NONE {
+					mapping.PlaintextChecksum = plaintextChecksum
+				}
+				results <- blockResult{
+					offset:  offset,
+					mapping: mapping,
+					chunks:  chunks,
+				}
 			}
-			if err := bsDriver.Write(block, blkFile); err != nil {
-				return err
+		}()
+	}
+	go func() {
+		workerWg.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	var allChunks []Chunk
+	bytesTotal := int64(len(offsets)) * b.BlockSize
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
 			}
-			log.Debugf("Created new block file at %v", blkFile)
+			continue
+		}
+		doneBlocks[res.offset] = res.mapping
+		allChunks = append(allChunks, res.chunks...)
 
-			blockMapping := BlockMapping{
-				Offset:        offset,
-				BlockChecksum: checksum,
+		if opts.Progress != nil {
+			opts.Progress.UpdateProgress(len(doneBlocks), len(offsets), int64(len(doneBlocks))*b.BlockSize, bytesTotal)
+		}
+		if len(doneBlocks)%progressSaveInterval == 0 {
+			if err := saveInProgressSnapshotMap(volumeID, snapshotID, bsDriver, blocksToSnapshotMap(snapshotID, offsets, doneBlocks)); err != nil {
+				log.Debugf("Failed to persist in-progress backup %v: %v", snapshotID, err)
 			}
-			snapshotDeltaMap.Blocks = append(snapshotDeltaMap.Blocks, blockMapping)
 		}
 	}
+
+	if firstErr != nil {
+		// Leave whatever progress was made in the .inprogress manifest so a
+		// later call with the same snapshotID resumes instead of restarting.
+		if err := saveInProgressSnapshotMap(volumeID, snapshotID, bsDriver, blocksToSnapshotMap(snapshotID, offsets, doneBlocks)); err != nil {
+			log.Debugf("Failed to persist in-progress backup %v: %v", snapshotID, err)
+		}
+		return firstErr
+	}
 	log.Debug("Created snapshot changed blocks of", snapshotID)
 
+	snapshotDeltaMap := blocksToSnapshotMap(snapshotID, offsets, doneBlocks)
+	snapshotDeltaMap.Chunks = allChunks
+	snapshotDeltaMap.CreatedAt = time.Now()
+	snapshotDeltaMap.ParentID = lastSnapshotID
+
 	snapshotMap := mergeSnapshotMap(snapshotID, snapshotDeltaMap, lastSnapshotMap)
 
 	if err := saveSnapshotMap(snapshotID, volumeID, bsDriver, snapshotMap); err != nil {
 		return err
 	}
 	log.Debug("Created snapshot config of", snapshotID)
+	if err := removeInProgressSnapshotMap(volumeID, snapshotID, bsDriver); err != nil {
+		log.Debugf("Failed to remove in-progress backup manifest for %v: %v", snapshotID, err)
+	}
 	volume.LastSnapshotID = snapshotID
 	if err := saveVolumeConfig(volumeID, bsDriver, volume); err != nil {
 		return err
@@ -326,14 +858,29 @@ func BackupSnapshot(root, snapshotID, volumeID, blockstoreID string, sDriver dri
 	return nil
 }
 
+// blocksToSnapshotMap builds a SnapshotMap's Blocks in offsets' order from
+// whatever subset of them doneBlocks currently has, so it can be used both
+// for the final manifest and for a partial, resumable one.
+func blocksToSnapshotMap(snapshotID string, offsets []int64, doneBlocks map[int64]BlockMapping) *SnapshotMap {
+	m := &SnapshotMap{ID: snapshotID, Blocks: make([]BlockMapping, 0, len(doneBlocks))}
+	for _, offset := range offsets {
+		if mapping, ok := doneBlocks[offset]; ok {
+			m.Blocks = append(m.Blocks, mapping)
+		}
+	}
+	return m
+}
+
 func mergeSnapshotMap(snapshotID string, deltaMap, lastMap *SnapshotMap) *SnapshotMap {
 	if lastMap == nil {
 		deltaMap.ID = snapshotID
 		return deltaMap
 	}
 	sMap := &SnapshotMap{
-		ID:     snapshotID,
-		Blocks: []BlockMapping{},
+		ID:        snapshotID,
+		Blocks:    []BlockMapping{},
+		CreatedAt: deltaMap.CreatedAt,
+		ParentID:  deltaMap.ParentID,
 	}
 	var d, l int
 	for d, l = 0, 0; d < len(deltaMap.Blocks) && l < len(lastMap.Blocks); {
@@ -362,14 +909,44 @@ func mergeSnapshotMap(snapshotID string, deltaMap, lastMap *SnapshotMap) *Snapsh
 	return sMap
 }
 
-func RestoreSnapshot(root, srcSnapshotID, srcVolumeID, dstVolumeID, blockstoreID string, sDriver drivers.Driver) error {
+func RestoreSnapshot(ctx context.Context, root, srcSnapshotID, srcVolumeID, dstVolumeID, blockstoreID string, sDriver drivers.Driver) error {
+	return RestoreSnapshotWithOptions(ctx, root, srcSnapshotID, srcVolumeID, dstVolumeID, blockstoreID, sDriver, BackupOptions{})
+}
+
+// RestoreSnapshotWithOptions is RestoreSnapshot with the same worker-pool
+// concurrency, progress reporting, and bandwidth-limiting controls as
+// BackupSnapshotWithOptions. Blocks already written to dstVolumeID by a
+// prior, interrupted call are tracked by offset in a resume manifest, so
+// calling this again with the same arguments resumes rather than rewriting
+// every block.
+//
+// Each worker reads its whole block from BlockStoreDriver.Read's
+// io.ReadCloser into memory, then writes it into volDev via WriteAt at the
+// block's own offset, rather than a single goroutine doing Seek+io.CopyN;
+// blocks are not streamed to the device piecewise. *os.File.WriteAt is
+// concurrency-safe on Linux regardless of the file's current seek
+// position, so this lets every worker write in parallel without a shared
+// writer goroutine serializing them.
+//
+// As with BackupSnapshotWithOptions, cancelling ctx stops workers from
+// picking up new blocks and the restore returns ctx.Err(), with whatever
+// was already written tracked in the resume manifest for a later call to
+// pick up.
+func RestoreSnapshotWithOptions(ctx context.Context, root, srcSnapshotID, srcVolumeID, dstVolumeID, blockstoreID string, sDriver drivers.Driver, opts BackupOptions) error {
 	b, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
 	if err != nil {
 		return err
 	}
+	enc, err := newBlockCipherForStore(b, opts.Passphrase)
+	if err != nil {
+		return err
+	}
 
 	if _, err := loadVolumeConfig(srcVolumeID, bsDriver); err != nil {
-		return fmt.Errorf("volume %v doesn't exist in blockstore %v", srcVolumeID, blockstoreID, err)
+		return generateError(logrus.Fields{
+			logging.LOG_FIELD_VOLUME:     srcVolumeID,
+			logging.LOG_FIELD_BLOCKSTORE: blockstoreID,
+		}, "volume doesn't exist in blockstore: %v", err)
 	}
 
 	volDevName, err := sDriver.GetVolumeDevice(dstVolumeID)
@@ -387,23 +964,167 @@ func RestoreSnapshot(root, srcSnapshotID, srcVolumeID, dstVolumeID, blockstoreID
 		return err
 	}
 
+	doneOffsets, err := loadRestoreProgress(dstVolumeID, srcSnapshotID, bsDriver)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Resuming restore %v with %v of %v blocks already done", srcSnapshotID, len(doneOffsets), len(snapshotMap.Blocks))
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = b.Concurrency
+	}
+	if workers <= 0 {
+		workers = defaultTransferWorkers
+	}
+	limiter := NewRateLimiter(opts.BytesPerSec)
+
+	jobs := make(chan BlockMapping, len(snapshotMap.Blocks))
+	pending := 0
 	for _, block := range snapshotMap.Blocks {
-		data := make([]byte, b.BlockSize)
-		blkFile := getBlockFilePath(srcVolumeID, block.BlockChecksum)
-		err := bsDriver.Read(blkFile, data)
-		if err != nil {
-			return err
+		if doneOffsets[block.Offset] {
+			continue
 		}
-		if _, err := volDev.WriteAt(data, block.Offset); err != nil {
-			return err
+		jobs <- block
+		pending++
+	}
+	close(jobs)
+
+	type restoreResult struct {
+		offset int64
+		err    error
+	}
+	results := make(chan restoreResult, pending)
+	var workerWg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerWg.Add(1)
+		go func() {
+			defer workerWg.Done()
+			for block := range jobs {
+				if err := ctx.Err(); err != nil {
+					results <- restoreResult{offset: block.Offset, err: err}
+					continue
+				}
+				// block.Length is only set in CHUNKING_MODE_ROLLING,
+				// where blocks are variable-length; a fixed-mode
+				// SnapshotMap always has Length == 0, meaning "this
+				// blockstore's fixed BlockSize".
+				length := block.Length
+				if length == 0 {
+					length = b.BlockSize
+				}
+
+				blkFile := getGlobalBlockFilePath(block.BlockChecksum)
+				rc, err := bsDriver.Read(ctx, blkFile)
+				if err != nil {
+					results <- restoreResult{offset: block.Offset, err: err}
+					continue
+				}
+
+				var data []byte
+				if enc != nil || b.Compression != COMPRESSION_NONE {
+					// Encrypted and/or compressed data isn't the same
+					// length as the plaintext (the GCM tag, or gzip's own
+					// framing), so it can't be read into a fixed
+					// BlockSize buffer the way the unencoded path below
+					// does.
+					raw, err := ioutil.ReadAll(rc)
+					rc.Close()
+					if err != nil {
+						results <- restoreResult{offset: block.Offset, err: err}
+						continue
+					}
+					data, err = decodeBlockFromStorage(enc, b.Compression, raw, block.PlaintextChecksum)
+					if err != nil {
+						results <- restoreResult{offset: block.Offset, err: err}
+						continue
+					}
+				} else {
+					data = make([]byte, length)
+					_, err = io.ReadFull(rc, data)
+					rc.Close()
+					if err != nil {
+						results <- restoreResult{offset: block.Offset, err: err}
+						continue
+					}
+				}
+
+				if opts.Verify {
+					plaintextChecksum := block.PlaintextChecksum
+					if plaintextChecksum == "" {
+						plaintextChecksum = block.BlockChecksum
+					}
+					if utils.GetChecksum(data) != plaintextChecksum {
+						results <- restoreResult{offset: block.Offset, err: fmt.Errorf(
+							"checksum mismatch restoring block at offset %v of snapshot %v: expected %v",
+							block.Offset, srcSnapshotID, plaintextChecksum)}
+						continue
+					}
+				}
+
+				limiter.WaitForBytes(length)
+				if _, err := volDev.WriteAt(data, block.Offset); err != nil {
+					results <- restoreResult{offset: block.Offset, err: err}
+					continue
+				}
+				results <- restoreResult{offset: block.Offset}
+			}
+		}()
+	}
+	go func() {
+		workerWg.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	total := len(snapshotMap.Blocks)
+	var bytesTotal int64
+	for _, block := range snapshotMap.Blocks {
+		if block.Length != 0 {
+			bytesTotal += block.Length
+		} else {
+			bytesTotal += b.BlockSize
 		}
 	}
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		doneOffsets[res.offset] = true
+
+		if opts.Progress != nil {
+			opts.Progress.UpdateProgress(len(doneOffsets), total, int64(len(doneOffsets))*b.BlockSize, bytesTotal)
+		}
+		if len(doneOffsets)%progressSaveInterval == 0 {
+			if err := saveRestoreProgress(dstVolumeID, srcSnapshotID, bsDriver, doneOffsets); err != nil {
+				log.Debugf("Failed to persist in-progress restore of %v: %v", srcSnapshotID, err)
+			}
+		}
+	}
+
+	if firstErr != nil {
+		if err := saveRestoreProgress(dstVolumeID, srcSnapshotID, bsDriver, doneOffsets); err != nil {
+			log.Debugf("Failed to persist in-progress restore of %v: %v", srcSnapshotID, err)
+		}
+		return firstErr
+	}
+
+	if err := removeRestoreProgress(dstVolumeID, srcSnapshotID, bsDriver); err != nil {
+		log.Debugf("Failed to remove in-progress restore manifest for %v: %v", srcSnapshotID, err)
+	}
 	log.Debugf("Restored snapshot %v of volume %v to volume %v", srcSnapshotID, srcVolumeID, dstVolumeID)
 
 	return nil
 }
 
-func RemoveSnapshot(root, snapshotID, volumeID, blockstoreID string) error {
+func RemoveSnapshot(ctx context.Context, root, snapshotID, volumeID, blockstoreID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
 	if err != nil {
 		return err
@@ -411,18 +1132,22 @@ func RemoveSnapshot(root, snapshotID, volumeID, blockstoreID string) error {
 
 	v, err := loadVolumeConfig(volumeID, bsDriver)
 	if err != nil {
-		return fmt.Errorf("cannot find volume %v in blockstore %v", volumeID, blockstoreID, err)
+		return generateError(logrus.Fields{
+			logging.LOG_FIELD_VOLUME:     volumeID,
+			logging.LOG_FIELD_BLOCKSTORE: blockstoreID,
+		}, "cannot find volume in blockstore: %v", err)
 	}
 
 	snapshotMap, err := loadSnapshotMap(snapshotID, volumeID, bsDriver)
 	if err != nil {
-		return err
+		log.WithFields(logrus.Fields{
+			logging.LOG_FIELD_VOLUME:     volumeID,
+			logging.LOG_FIELD_SNAPSHOT:   snapshotID,
+			logging.LOG_FIELD_BLOCKSTORE: blockstoreID,
+			logging.LOG_FIELD_REASON:     logging.LOG_REASON_FAILURE,
+		}).Error("snapshot not found in blockstore")
+		return ErrSnapshotNotFound
 	}
-	discardBlockSet := make(map[string]bool)
-	for _, blk := range snapshotMap.Blocks {
-		discardBlockSet[blk.BlockChecksum] = true
-	}
-	discardBlockCounts := len(discardBlockSet)
 
 	snapshotPath := getSnapshotsPath(volumeID)
 	snapshotFile := getSnapshotConfigName(snapshotID)
@@ -439,39 +1164,19 @@ func RemoveSnapshot(root, snapshotID, volumeID, blockstoreID string) error {
 		}
 	}
 
-	log.Debug("GC started")
-	snapshots, err := getSnapshots(volumeID, bsDriver)
-	if err != nil {
-		return err
-	}
-	for snapshotID := range snapshots {
-		snapshotMap, err := loadSnapshotMap(snapshotID, volumeID, bsDriver)
-		if err != nil {
-			return err
-		}
-		for _, blk := range snapshotMap.Blocks {
-			if _, exists := discardBlockSet[blk.BlockChecksum]; exists {
-				delete(discardBlockSet, blk.BlockChecksum)
-				discardBlockCounts--
-				if discardBlockCounts == 0 {
-					break
-				}
-			}
-		}
-		if discardBlockCounts == 0 {
-			break
-		}
-	}
-
-	for blk := range discardBlockSet {
-		blkFile := getBlockFilePath(volumeID, blk)
-		if err := removeAndCleanup(blkFile, bsDriver); err != nil {
+	// Once the config file above is gone, a retry can no longer load
+	// snapshotMap to find these refs again, so unlike Backup/Restore
+	// (which track partial progress in a resumable manifest) this loop
+	// doesn't check ctx between iterations: it's all-or-nothing once
+	// started, to avoid orphaning refcounts that nothing could ever
+	// reclaim.
+	ref := BlockRef{VolumeUUID: volumeID, SnapshotUUID: snapshotID}
+	for _, blk := range snapshotMap.Blocks {
+		if err := removeBlockRef(bsDriver, blk.BlockChecksum, ref); err != nil {
 			return err
 		}
-		log.Debugf("Removed unused block %v for volume %v", blk, volumeID)
 	}
-
-	log.Debug("GC completed")
+	log.Debugf("Dropped this snapshot's block references for volume %v", volumeID)
 	log.Debug("Removed blockstore snapshot ", snapshotID)
 
 	return nil
@@ -523,6 +1228,364 @@ func listVolume(volumeID, snapshotID string, driver BlockStoreDriver) error {
 	return nil
 }
 
+// DedupStats summarizes the chunk-level dedup recorded for a snapshot: how
+// many content-defined chunks its new blocks were split into, and how many
+// of those chunks were unique (i.e. actually written rather than reused).
+func DedupStats(snapshotMap *SnapshotMap) (totalChunks, uniqueChunks int) {
+	seen := make(map[string]bool)
+	for _, chunk := range snapshotMap.Chunks {
+		totalChunks++
+		if !seen[chunk.Checksum] {
+			seen[chunk.Checksum] = true
+			uniqueChunks++
+		}
+	}
+	return totalChunks, uniqueChunks
+}
+
+// SnapshotInfo is one snapshot's metadata and on-disk footprint, as
+// returned by ListSnapshots.
+type SnapshotInfo struct {
+	ID        string
+	CreatedAt time.Time
+	ParentID  string
+
+	// LogicalSize is how many bytes of the volume this snapshot's blocks
+	// cover, independent of how (or whether) they're deduped or
+	// compressed on disk.
+	LogicalSize int64
+
+	// PhysicalSize is how many bytes this snapshot's distinct blocks
+	// actually occupy in the blockstore (post-compression, if enabled),
+	// counting each BlockChecksum once no matter how many offsets in
+	// this snapshot point to it.
+	PhysicalSize int64
+
+	// UniqueSize is the subset of PhysicalSize referenced only by this
+	// snapshot: what RemoveSnapshot would actually free if this
+	// snapshot, and no sibling that shares a block with it, were
+	// removed.
+	UniqueSize int64
+}
+
+// ListSnapshots returns metadata and size stats for every live snapshot of
+// volumeID in blockstoreID, oldest first.
+func ListSnapshots(root, volumeID, blockstoreID string) ([]SnapshotInfo, error) {
+	b, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := getSnapshots(volumeID, bsDriver)
+	if err != nil {
+		return nil, err
+	}
+
+	// Consecutive incremental snapshots of the same volume typically share
+	// most of their blocks, so footprints are cached across the whole
+	// volume rather than looked up once per snapshot: a checksum referenced
+	// by every one of 50 snapshots costs one FileSize+loadBlockRefs round
+	// trip here instead of 50, which matters on a driver (NFS, S3) where
+	// each is a real network call.
+	cache := make(map[string]blockFootprintResult)
+	infos := make([]SnapshotInfo, 0, len(snapshots))
+	for snapshotID := range snapshots {
+		snapshotMap, err := loadSnapshotMap(snapshotID, volumeID, bsDriver)
+		if err != nil {
+			return nil, err
+		}
+		info, err := snapshotInfo(bsDriver, b, snapshotMap, cache)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	return infos, nil
+}
+
+// blockFootprintResult is one checksum's cached blockFootprint outcome.
+type blockFootprintResult struct {
+	size   int64
+	unique bool
+}
+
+// blockFootprint reports checksum's on-disk size and whether it's
+// referenced by only one (volume, snapshot) pair, the shared piece of
+// logic snapshotInfo and InspectSnapshot each fold into their own walk
+// over a snapshot's blocks. size is -1 if the block itself is missing
+// (e.g. GC'd out from under a stale manifest). cache may be nil, in which
+// case every call hits bsDriver directly; callers walking many snapshots
+// of the same volume should pass a shared map so a checksum referenced by
+// several of them is only looked up once.
+func blockFootprint(bsDriver BlockStoreDriver, checksum string, cache map[string]blockFootprintResult) (size int64, unique bool, err error) {
+	if cache != nil {
+		if r, ok := cache[checksum]; ok {
+			return r.size, r.unique, nil
+		}
+	}
+	size = bsDriver.FileSize(getGlobalBlockFilePath(checksum))
+	if size < 0 {
+		return size, false, nil
+	}
+	refs, err := loadBlockRefs(bsDriver, checksum)
+	if err != nil {
+		return 0, false, err
+	}
+	unique = len(refs) <= 1
+	if cache != nil {
+		cache[checksum] = blockFootprintResult{size: size, unique: unique}
+	}
+	return size, unique, nil
+}
+
+// snapshotInfo computes m's LogicalSize/PhysicalSize/UniqueSize by walking
+// its Blocks once, deduping repeated BlockChecksums within the snapshot
+// itself before charging their on-disk size via blockFootprint. cache is
+// forwarded to blockFootprint as-is (see its doc comment) and may be nil.
+func snapshotInfo(bsDriver BlockStoreDriver, b *BlockStore, m *SnapshotMap, cache map[string]blockFootprintResult) (SnapshotInfo, error) {
+	info := SnapshotInfo{ID: m.ID, CreatedAt: m.CreatedAt, ParentID: m.ParentID}
+	seen := make(map[string]bool)
+	for _, blk := range m.Blocks {
+		length := blk.Length
+		if length == 0 {
+			length = b.BlockSize
+		}
+		info.LogicalSize += length
+
+		if seen[blk.BlockChecksum] {
+			continue
+		}
+		seen[blk.BlockChecksum] = true
+
+		size, unique, err := blockFootprint(bsDriver, blk.BlockChecksum, cache)
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		if size < 0 {
+			continue
+		}
+		info.PhysicalSize += size
+		if unique {
+			info.UniqueSize += size
+		}
+	}
+	return info, nil
+}
+
+// SnapshotInspection is InspectSnapshot's per-block breakdown of one
+// snapshot's dedup against every other snapshot, of any volume, that
+// references the same blocks.
+type SnapshotInspection struct {
+	ID           string
+	TotalBlocks  int
+	UniqueBlocks int
+	SharedBlocks int
+}
+
+// InspectSnapshot walks snapshotID's blocks (deduping repeated
+// BlockChecksums the same way snapshotInfo does) and reports how many are
+// unique to it versus shared with some other snapshot, of volumeID or of
+// another volume in the blockstore, via blockFootprint.
+func InspectSnapshot(root, volumeID, blockstoreID, snapshotID string) (*SnapshotInspection, error) {
+	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotMap, err := loadSnapshotMap(snapshotID, volumeID, bsDriver)
+	if err != nil {
+		return nil, err
+	}
+
+	inspection := &SnapshotInspection{ID: snapshotID}
+	seen := make(map[string]bool)
+	for _, blk := range snapshotMap.Blocks {
+		if seen[blk.BlockChecksum] {
+			continue
+		}
+		seen[blk.BlockChecksum] = true
+
+		_, unique, err := blockFootprint(bsDriver, blk.BlockChecksum, nil)
+		if err != nil {
+			return nil, err
+		}
+		inspection.TotalBlocks++
+		if unique {
+			inspection.UniqueBlocks++
+		} else {
+			inspection.SharedBlocks++
+		}
+	}
+	return inspection, nil
+}
+
+// RetentionPolicy is a GFS (grandfather-father-son) retention policy
+// evaluated directly against a blockstore's own snapshot timestamps, the
+// same shape as schedule.Policy but without that package's scheduling and
+// SnapshotDriver plumbing: KeepLast always survives pruning regardless of
+// age, and Daily/Weekly/Monthly each promote one snapshot per calendar
+// day/ISO week/month into their own tier, for as many of the most recent
+// such buckets as they specify.
+type RetentionPolicy struct {
+	KeepLast int
+	Daily    int
+	Weekly   int
+	Monthly  int
+}
+
+// PruneSnapshots applies policy to every snapshot of volumeID in
+// blockstoreID and calls RemoveSnapshot on whichever falls outside every
+// retention tier. It returns the IDs it actually removed even when it
+// returns an error part way through, so a caller can tell what's really
+// gone on disk rather than assuming nothing happened.
+func PruneSnapshots(ctx context.Context, root, volumeID, blockstoreID string, policy RetentionPolicy) ([]string, error) {
+	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := getSnapshots(volumeID, bsDriver)
+	if err != nil {
+		return nil, err
+	}
+	timestamps := make(map[string]time.Time, len(snapshots))
+	for snapshotID := range snapshots {
+		snapshotMap, err := loadSnapshotMap(snapshotID, volumeID, bsDriver)
+		if err != nil {
+			return nil, err
+		}
+		timestamps[snapshotID] = snapshotMap.CreatedAt
+	}
+
+	var removed []string
+	for _, snapshotID := range snapshotsToDiscard(timestamps, policy) {
+		if err := RemoveSnapshot(ctx, root, snapshotID, volumeID, blockstoreID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, snapshotID)
+		log.WithFields(logrus.Fields{
+			logging.LOG_FIELD_VOLUME:     volumeID,
+			logging.LOG_FIELD_SNAPSHOT:   snapshotID,
+			logging.LOG_FIELD_BLOCKSTORE: blockstoreID,
+			logging.LOG_FIELD_EVENT:      logging.LOG_EVENT_REMOVE,
+			logging.LOG_FIELD_REASON:     "retention-policy",
+		}).Debug("Pruned snapshot by retention policy")
+	}
+	return removed, nil
+}
+
+// snapshotsToDiscard mirrors schedule.snapshotsToPrune's GFS bucket-
+// promotion logic, reading straight from a volume's SnapshotMap.CreatedAt
+// values rather than the scheduler's own in-memory view. A snapshot whose
+// CreatedAt is still its zero value (backed up by a version of this code
+// that predates the field) can't be safely bucketed by calendar day/week/
+// month, so it's always kept rather than risking every such snapshot
+// colliding into the same "0001-01-01" bucket and getting pruned down to
+// one.
+func snapshotsToDiscard(snapshots map[string]time.Time, policy RetentionPolicy) []string {
+	type entry struct {
+		id        string
+		createdAt time.Time
+	}
+	entries := make([]entry, 0, len(snapshots))
+	for id, t := range snapshots {
+		entries = append(entries, entry{id, t})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].createdAt.After(entries[j].createdAt) })
+
+	keep := make(map[string]bool)
+	for i, e := range entries {
+		if i < policy.KeepLast || e.createdAt.IsZero() {
+			keep[e.id] = true
+		}
+	}
+
+	promote := func(bucket func(time.Time) string, n int) {
+		seen := make(map[string]bool)
+		for _, e := range entries {
+			if e.createdAt.IsZero() {
+				continue
+			}
+			if len(seen) >= n {
+				break
+			}
+			key := bucket(e.createdAt)
+			if !seen[key] {
+				seen[key] = true
+				keep[e.id] = true
+			}
+		}
+	}
+	promote(func(t time.Time) string { return t.Format("2006-01-02") }, policy.Daily)
+	promote(func(t time.Time) string { y, w := t.ISOWeek(); return fmt.Sprintf("%d-W%d", y, w) }, policy.Weekly)
+	promote(func(t time.Time) string { return t.Format("2006-01") }, policy.Monthly)
+
+	var discard []string
+	for _, e := range entries {
+		if !keep[e.id] {
+			discard = append(discard, e.id)
+		}
+	}
+	return discard
+}
+
+// GC walks every live snapshot of a volume and removes any block or chunk
+// file in the blockstore that's no longer referenced by one of them. Unlike
+// the GC performed as a side effect of RemoveSnapshot, which only has to
+// consider blocks that the removed snapshot itself touched, this scans the
+// full blocks/chunks namespace so it can also clean up after interrupted or
+// partially-failed backups. It costs O(snapshots x blocks_per_snapshot),
+// though, so a volume with hundreds of snapshots should prefer
+// GCByRefCount (backed by VerifyBlockstore/RebuildRefCounts if the
+// refcounts are ever suspected to have drifted) once its blocks have been
+// migrated to the global pool.
+func GC(root, volumeID, blockstoreID string) (int, error) {
+	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return 0, err
+	}
+
+	snapshots, err := getSnapshots(volumeID, bsDriver)
+	if err != nil {
+		return 0, err
+	}
+
+	referenced := make(map[string]bool)
+	for snapshotID := range snapshots {
+		snapshotMap, err := loadSnapshotMap(snapshotID, volumeID, bsDriver)
+		if err != nil {
+			return 0, err
+		}
+		for _, blk := range snapshotMap.Blocks {
+			referenced[blk.BlockChecksum] = true
+		}
+		for _, chunk := range snapshotMap.Chunks {
+			referenced[chunk.Checksum] = true
+		}
+	}
+
+	files, err := bsDriver.List(getBlocksPath(volumeID))
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, f := range files {
+		checksum := filepath.Base(f)
+		if referenced[checksum] {
+			continue
+		}
+		if err := removeAndCleanup(f, bsDriver); err != nil {
+			return removed, err
+		}
+		log.Debugf("GC removed unreferenced block/chunk %v for volume %v", checksum, volumeID)
+		removed++
+	}
+
+	log.Debugf("GC completed for volume %v, removed %v unreferenced files", volumeID, removed)
+	return removed, nil
+}
+
 func ListVolume(root, blockstoreID, volumeID, snapshotID string) error {
 	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
 	if err != nil {
@@ -0,0 +1,126 @@
+package blockstore
+
+import (
+	"path/filepath"
+
+	"github.com/rancherio/volmgr/utils"
+)
+
+// Rolling-hash content-defined chunking, in the style of restic/knoxite: cut
+// points are determined by the content itself rather than by fixed offsets,
+// so identical data that has shifted within a volume still dedups, instead
+// of only data that lines up on a DEFAULT_BLOCK_SIZE boundary.
+
+const (
+	CHUNK_MIN_SIZE     = 16 * 1024
+	CHUNK_AVG_SIZE     = 64 * 1024
+	CHUNK_MAX_SIZE     = 256 * 1024
+	rollingWindowSize  = 64
+	polynomialConstant = 1099511628211 // FNV-like odd multiplier, any large prime works here
+)
+
+// rollingWindowPow is the weight the byte leaving rollingHash's window
+// carries in its value.
+var rollingWindowPow = polynomialPow(rollingWindowSize)
+
+// polynomialPow returns polynomialConstant^n (mod 2^64).
+func polynomialPow(n int) uint64 {
+	p := uint64(1)
+	for i := 0; i < n; i++ {
+		p *= polynomialConstant
+	}
+	return p
+}
+
+// Chunk describes one content-defined slice of a changed extent, ready to be
+// stored under blocks/<checksum> and referenced from a snapshot manifest,
+// the same way a fixed-size BlockMapping is.
+type Chunk struct {
+	Offset   int64
+	Length   int64
+	Checksum string
+}
+
+type rollingHash struct {
+	window []byte
+	pos    int
+	full   bool
+	value  uint64
+}
+
+func newRollingHash() *rollingHash {
+	return &rollingHash{window: make([]byte, rollingWindowSize)}
+}
+
+func (r *rollingHash) roll(b byte) uint64 {
+	old := r.window[r.pos]
+	r.window[r.pos] = b
+	r.pos = (r.pos + 1) % rollingWindowSize
+	if r.pos == 0 {
+		r.full = true
+	}
+	r.value = r.value*polynomialConstant + uint64(b) - uint64(old)*rollingWindowPow
+	return r.value
+}
+
+// cutPoints returns the offsets (relative to data[0]) at which data should be
+// split into chunks averaging CHUNK_AVG_SIZE bytes, never smaller than
+// CHUNK_MIN_SIZE nor larger than CHUNK_MAX_SIZE, except the final chunk,
+// which takes whatever is left and may be smaller than CHUNK_MIN_SIZE.
+func cutPoints(data []byte) []int64 {
+	mask := uint64(avgSizeMask(CHUNK_AVG_SIZE))
+	var cuts []int64
+	h := newRollingHash()
+	start := 0
+	for i, b := range data {
+		v := h.roll(b)
+		size := i - start + 1
+		if size < CHUNK_MIN_SIZE {
+			continue
+		}
+		if (h.full && v&mask == 0 && size >= CHUNK_MIN_SIZE) || size >= CHUNK_MAX_SIZE {
+			cuts = append(cuts, int64(i+1))
+			start = i + 1
+			h = newRollingHash()
+		}
+	}
+	if start < len(data) {
+		cuts = append(cuts, int64(len(data)))
+	}
+	return cuts
+}
+
+// avgSizeMask returns a bitmask whose population of trailing zero bits makes
+// a hash match roughly once every avgSize bytes.
+func avgSizeMask(avgSize int) uint64 {
+	bits := uint(0)
+	for (1 << bits) < avgSize {
+		bits++
+	}
+	return (uint64(1) << bits) - 1
+}
+
+// ChunkData splits data into content-defined chunks and checksums each one,
+// annotated with its offset relative to baseOffset.
+func ChunkData(baseOffset int64, data []byte) []Chunk {
+	cuts := cutPoints(data)
+	chunks := make([]Chunk, 0, len(cuts))
+	start := int64(0)
+	for _, end := range cuts {
+		chunks = append(chunks, Chunk{
+			Offset:   baseOffset + start,
+			Length:   end - start,
+			Checksum: utils.GetChecksum(data[start:end]),
+		})
+		start = end
+	}
+	return chunks
+}
+
+// getChunkFilePath mirrors the (undefined-in-this-snapshot) getBlockFilePath
+// helper: chunks live alongside whole blocks under the volume's blocks
+// directory, keyed by their own checksum so identical chunks from different
+// blocks are only ever stored once.
+func getChunkFilePath(volumeID, checksum string) string {
+	return filepath.Join(getBlocksPath(volumeID), "chunks", checksum[:2], checksum)
+}
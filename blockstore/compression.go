@@ -0,0 +1,57 @@
+package blockstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	COMPRESSION_NONE = ""
+	COMPRESSION_GZIP = "gzip"
+)
+
+func parseCompression(config map[string]string) (string, error) {
+	mode, ok := config["compression"]
+	if !ok {
+		return COMPRESSION_NONE, nil
+	}
+	switch mode {
+	case COMPRESSION_NONE, COMPRESSION_GZIP:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("compression must be %q or %q, not %v", COMPRESSION_NONE, COMPRESSION_GZIP, mode)
+	}
+}
+
+// compressBlock and decompressBlock are the compression half of the
+// storage pipeline; encodeBlockForStorage/decodeBlockFromStorage in
+// crypto.go compose them with blockCipher so a block is compressed before
+// it's encrypted, and decrypted before it's decompressed.
+func compressBlock(mode string, data []byte) ([]byte, error) {
+	if mode == COMPRESSION_NONE {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressBlock(mode string, data []byte) ([]byte, error) {
+	if mode == COMPRESSION_NONE {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,168 @@
+package blockstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/rancherio/volmgr/logging"
+	"github.com/rancherio/volmgr/utils"
+)
+
+const (
+	encryptionSaltSize = 16
+	encryptionKeySize  = 32 // AES-256
+
+	// scryptN/R/P are scrypt's standard "interactive" cost parameters
+	// (as recommended by the scrypt paper for passphrase-derived keys
+	// checked on every backup/restore call, rather than the heavier
+	// "sensitive" parameters meant for long-term key storage).
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// generateEncryptionSalt is called once, at Register time, for a
+// blockstore with encryption enabled; the salt itself isn't secret and is
+// persisted alongside the rest of BlockStore.
+func generateEncryptionSalt() ([]byte, error) {
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// deriveBlockStoreKey turns a user-supplied passphrase plus this
+// blockstore's persisted salt into the AES-256 key used to encrypt/decrypt
+// every block, via scrypt so a weak passphrase is expensive to brute-force.
+func deriveBlockStoreKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, encryptionKeySize)
+}
+
+// blockCipher encrypts/decrypts blocks with AES-256-GCM using a nonce
+// derived from the plaintext's own checksum rather than a random one: this
+// is convergent encryption, so two identical plaintext blocks always
+// produce identical ciphertext (and so the same storage checksum), which
+// is what lets the global block pool's dedup keep working with encryption
+// turned on. The tradeoff, as with any convergent scheme, is that an
+// attacker who already knows (or can guess) a block's plaintext can
+// confirm its presence; that's an accepted cost for this feature.
+type blockCipher struct {
+	gcm cipher.AEAD
+}
+
+func newBlockCipher(key []byte) (*blockCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &blockCipher{gcm: gcm}, nil
+}
+
+func (c *blockCipher) nonce(plaintextChecksum string) []byte {
+	sum := sha256.Sum256([]byte(plaintextChecksum))
+	return sum[:c.gcm.NonceSize()]
+}
+
+func (c *blockCipher) encrypt(plaintextChecksum string, plaintext []byte) []byte {
+	return c.gcm.Seal(nil, c.nonce(plaintextChecksum), plaintext, nil)
+}
+
+func (c *blockCipher) decrypt(plaintextChecksum string, ciphertext []byte) ([]byte, error) {
+	plain, err := c.gcm.Open(nil, c.nonce(plaintextChecksum), ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt block %v: %v", plaintextChecksum, err)
+	}
+	return plain, nil
+}
+
+// encryptForStorage computes plaintext's checksum and, if enc is non-nil,
+// encrypts it, returning the bytes to actually write to the driver and the
+// checksum to store and ref-count them under. Without encryption both
+// checksums are the plaintext's and storageData is plaintext unchanged.
+func encryptForStorage(enc *blockCipher, plaintext []byte) (storageData []byte, storageChecksum, plaintextChecksum string) {
+	plaintextChecksum = utils.GetChecksum(plaintext)
+	if enc == nil {
+		return plaintext, plaintextChecksum, plaintextChecksum
+	}
+	ciphertext := enc.encrypt(plaintextChecksum, plaintext)
+	return ciphertext, utils.GetChecksum(ciphertext), plaintextChecksum
+}
+
+// decryptFromStorage reverses encryptForStorage: given the bytes read from
+// the driver and the block's plaintext checksum (BlockMapping.
+// PlaintextChecksum, or BlockChecksum itself when the blockstore isn't
+// encrypted), it returns the plaintext.
+func decryptFromStorage(enc *blockCipher, data []byte, plaintextChecksum string) ([]byte, error) {
+	if enc == nil {
+		return data, nil
+	}
+	return enc.decrypt(plaintextChecksum, data)
+}
+
+// encodeBlockForStorage composes compression with encryptForStorage:
+// plaintext is compressed first (compression is a no-op when mode is
+// COMPRESSION_NONE), then the compressed bytes are what gets encrypted (or,
+// without encryption, what's stored directly). plaintextChecksum is always
+// computed over the original, uncompressed plaintext, not the compressed
+// bytes, so the same block content dedups identically regardless of the
+// blockstore's compression setting.
+func encodeBlockForStorage(enc *blockCipher, compression string, plaintext []byte) (storageData []byte, storageChecksum, plaintextChecksum string, err error) {
+	plaintextChecksum = utils.GetChecksum(plaintext)
+	compressed, err := compressBlock(compression, plaintext)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if enc == nil {
+		return compressed, utils.GetChecksum(compressed), plaintextChecksum, nil
+	}
+	ciphertext := enc.encrypt(plaintextChecksum, compressed)
+	return ciphertext, utils.GetChecksum(ciphertext), plaintextChecksum, nil
+}
+
+// decodeBlockFromStorage reverses encodeBlockForStorage: it decrypts (if
+// enc is non-nil) and then decompresses the bytes read from the driver,
+// returning the original plaintext.
+func decodeBlockFromStorage(enc *blockCipher, compression string, data []byte, plaintextChecksum string) ([]byte, error) {
+	compressed, err := decryptFromStorage(enc, data, plaintextChecksum)
+	if err != nil {
+		return nil, err
+	}
+	return decompressBlock(compression, compressed)
+}
+
+// newBlockCipherForStore derives a blockCipher from b's persisted salt and
+// the given passphrase if b.Encrypted, or returns nil if it isn't.
+func newBlockCipherForStore(b *BlockStore, passphrase string) (*blockCipher, error) {
+	if !b.Encrypted {
+		return nil, nil
+	}
+	if passphrase == "" {
+		return nil, generateError(logrus.Fields{
+			logging.LOG_FIELD_BLOCKSTORE: b.UUID,
+		}, "blockstore is encrypted and requires a passphrase")
+	}
+	salt, err := hex.DecodeString(b.EncryptionSalt)
+	if err != nil {
+		return nil, generateError(logrus.Fields{
+			logging.LOG_FIELD_BLOCKSTORE: b.UUID,
+		}, "invalid encryption salt for blockstore: %v", err)
+	}
+	key, err := deriveBlockStoreKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockCipher(key)
+}
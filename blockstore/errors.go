@@ -0,0 +1,29 @@
+package blockstore
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/rancherio/volmgr/logging"
+)
+
+// log carries "pkg": "blockstore" on every entry, the same convention
+// devmapper.go and schedule.go already use, instead of logging through
+// the bare logrus package functions.
+var log = logrus.WithFields(logrus.Fields{"pkg": "blockstore"})
+
+func generateError(fields logrus.Fields, format string, v ...interface{}) error {
+	return logging.ErrorWithFields("blockstore", fields, format, v)
+}
+
+// Sentinel errors for conditions callers may want to branch on directly
+// (e.g. treat "already exists" as success for an idempotent retry). They're
+// returned unwrapped, not run through generateError, precisely so callers
+// can compare against them with ==; anything a caller doesn't need to
+// distinguish this way should keep using generateError instead.
+var (
+	ErrVolumeExists       = fmt.Errorf("volume already exists in blockstore")
+	ErrSnapshotNotFound   = fmt.Errorf("snapshot not found in blockstore")
+	ErrBlockstoreMismatch = fmt.Errorf("blockstore kind doesn't match config stored in blockstore")
+)
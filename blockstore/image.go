@@ -0,0 +1,238 @@
+package blockstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	IMAGES_DIRECTORY = "images"
+
+	imageConfigSuffix = ".json"
+	// legacyImageBlobSuffix is the whole-blob layout AddImage used before
+	// it switched to uploading content-defined chunks: a single gzipped
+	// copy of the raw image file. loadImageManifest falls back to it when
+	// an image has no ImageManifest, so images uploaded before this
+	// change still activate.
+	legacyImageBlobSuffix = ".img.gz"
+
+	// imageRestoreParallelism bounds how many chunk fetches ActivateImage
+	// has in flight at once, the same way doVolumeList-style bulk
+	// operations elsewhere in this tree cap their own concurrency.
+	imageRestoreParallelism = 8
+)
+
+// ImageManifest is AddImage's record of one image: a SnapshotMap-shaped
+// list of content-defined chunks rather than a single blob, so
+// re-uploading a changed image only transfers the chunks that actually
+// changed, and ActivateImage can reconstruct the local file by fetching
+// chunks in parallel.
+type ImageManifest struct {
+	UUID   string
+	Name   string
+	Size   int64
+	Chunks []Chunk
+}
+
+func getImageConfigPath(imageUUID string) string {
+	return filepath.Join(IMAGES_DIRECTORY, imageUUID+imageConfigSuffix)
+}
+
+func getLegacyImageBlobPath(imageUUID string) string {
+	return filepath.Join(IMAGES_DIRECTORY, imageUUID+legacyImageBlobSuffix)
+}
+
+// getImageChunkPath scopes an image's chunks under its own UUID, the same
+// way getBlockFilePath scopes a volume's blocks under its own volumeID:
+// re-adding the same imageUUID with a changed file dedups against that
+// image's own previous chunks.
+func getImageChunkPath(imageUUID, checksum string) string {
+	return filepath.Join(IMAGES_DIRECTORY, imageUUID, "chunks", checksum[:2], checksum)
+}
+
+// GetImageLocalStorePath is where ActivateImage reconstructs imageUUID's
+// raw image file, and where the caller's driver.ActivateImage loop-mounts
+// it from afterward.
+func GetImageLocalStorePath(imagesDir, imageUUID string) string {
+	return filepath.Join(imagesDir, imageUUID+".img")
+}
+
+// AddImage content-defined-chunks imageFile and uploads every chunk
+// blockstoreID doesn't already have under this image's own checksum
+// namespace, then writes the manifest last. Calling it again with the
+// same imageUUID replaces the manifest but only uploads the chunks that
+// changed since the last call.
+func AddImage(root, imagesDir, imageUUID, imageName, imageFile, blockstoreID string) error {
+	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(imageFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	if err := bsDriver.MkDirAll(IMAGES_DIRECTORY); err != nil {
+		return err
+	}
+
+	manifest := &ImageManifest{UUID: imageUUID, Name: imageName, Size: st.Size()}
+	for _, chunk := range ChunkData(0, data) {
+		chunkFile := getImageChunkPath(imageUUID, chunk.Checksum)
+		if bsDriver.FileSize(chunkFile) < 0 {
+			if err := bsDriver.MkDirAll(filepath.Dir(chunkFile)); err != nil {
+				return err
+			}
+			chunkData := data[chunk.Offset : chunk.Offset+chunk.Length]
+			// AddImage doesn't yet take a ctx of its own (it's only ever
+			// called from CLI-driven, non-HTTP paths), so there's no
+			// request context to cancel this against.
+			if err := bsDriver.Write(context.Background(), chunkFile, bytes.NewReader(chunkData)); err != nil {
+				return err
+			}
+		}
+		manifest.Chunks = append(manifest.Chunks, chunk)
+	}
+
+	return saveConfigInBlockStore(getImageConfigPath(imageUUID), bsDriver, manifest)
+}
+
+// loadImageManifest loads imageUUID's ImageManifest, or, if it only has
+// the pre-chunking single-blob layout, reports that so ActivateImage can
+// fall back to the old whole-blob restore path.
+func loadImageManifest(imageUUID string, bsDriver BlockStoreDriver) (manifest *ImageManifest, legacy bool, err error) {
+	cfgPath := getImageConfigPath(imageUUID)
+	if bsDriver.FileSize(cfgPath) >= 0 {
+		manifest = &ImageManifest{}
+		if err := loadConfigInBlockStore(cfgPath, bsDriver, manifest); err != nil {
+			return nil, false, err
+		}
+		return manifest, false, nil
+	}
+	if bsDriver.FileSize(getLegacyImageBlobPath(imageUUID)) >= 0 {
+		return nil, true, nil
+	}
+	return nil, false, fmt.Errorf("image %v not found in blockstore", imageUUID)
+}
+
+// ActivateImage reconstructs imageUUID's raw image file at
+// GetImageLocalStorePath(imagesDir, imageUUID), fetching its chunks in
+// parallel (bounded by imageRestoreParallelism) when the image has a
+// chunked ImageManifest, or falling back to downloading and gunzipping
+// the old single-blob layout otherwise.
+func ActivateImage(root, imagesDir, imageUUID, blockstoreID string) error {
+	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return err
+	}
+
+	localPath := GetImageLocalStorePath(imagesDir, imageUUID)
+	if _, err := os.Stat(localPath); err == nil {
+		return fmt.Errorf("image %v is already activated at %v", imageUUID, localPath)
+	}
+
+	manifest, legacy, err := loadImageManifest(imageUUID, bsDriver)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0700); err != nil {
+		return err
+	}
+	tmp := localPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if legacy {
+		err = restoreLegacyImageBlob(bsDriver, imageUUID, f)
+	} else {
+		err = restoreImageChunksParallel(bsDriver, imageUUID, manifest, f)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, localPath)
+}
+
+func restoreLegacyImageBlob(bsDriver BlockStoreDriver, imageUUID string, dst *os.File) error {
+	blobPath := getLegacyImageBlobPath(imageUUID)
+	if bsDriver.FileSize(blobPath) < 0 {
+		return fmt.Errorf("legacy image blob %v not found", blobPath)
+	}
+	rc, err := bsDriver.Read(context.Background(), blobPath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	_, err = io.Copy(dst, gz)
+	return err
+}
+
+func restoreImageChunksParallel(bsDriver BlockStoreDriver, imageUUID string, manifest *ImageManifest, dst *os.File) error {
+	sem := make(chan struct{}, imageRestoreParallelism)
+	errs := make(chan error, len(manifest.Chunks))
+	var wg sync.WaitGroup
+
+	for _, c := range manifest.Chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c Chunk) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			rc, err := bsDriver.Read(context.Background(), getImageChunkPath(imageUUID, c.Checksum))
+			if err != nil {
+				errs <- err
+				return
+			}
+			data := make([]byte, c.Length)
+			_, err = io.ReadFull(rc, data)
+			rc.Close()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := dst.WriteAt(data, c.Offset); err != nil {
+				errs <- err
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+package blockstore
+
+// Progress lets a caller of BackupSnapshotWithOptions/RestoreSnapshotWithOptions
+// observe how much of a transfer has completed, independent of however many
+// workers are actually moving blocks concurrently: the transfer coordinator
+// calls UpdateProgress from a single goroutine as each worker's result comes
+// in, so implementations don't need their own locking.
+type Progress interface {
+	UpdateProgress(blocksDone, blocksTotal int, bytesDone, bytesTotal int64)
+}
@@ -0,0 +1,62 @@
+package blockstore
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token-bucket bandwidth cap shared by every worker in a
+// backup/restore's pool: WaitForBytes blocks until n bytes' worth of tokens
+// are available before letting its caller proceed with the next block's I/O.
+type RateLimiter struct {
+	mu          sync.Mutex
+	bytesPerSec int64
+	tokens      int64
+	last        time.Time
+}
+
+// NewRateLimiter returns a limiter capping throughput at bytesPerSec, or nil
+// if bytesPerSec isn't positive. A nil *RateLimiter is safe to call
+// WaitForBytes on: it's a no-op, so callers never need to check for nil
+// themselves before using one.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		bytesPerSec: bytesPerSec,
+		tokens:      bytesPerSec,
+		last:        time.Now(),
+	}
+}
+
+// WaitForBytes blocks until n bytes worth of tokens have accumulated, then
+// consumes them. The bucket holds up to bytesPerSec tokens, or n if a
+// single request is larger than that.
+func (r *RateLimiter) WaitForBytes(n int64) {
+	if r == nil {
+		return
+	}
+	for {
+		r.mu.Lock()
+		now := time.Now()
+		r.tokens += int64(now.Sub(r.last).Seconds() * float64(r.bytesPerSec))
+		r.last = now
+		burst := r.bytesPerSec
+		if n > burst {
+			burst = n
+		}
+		if r.tokens > burst {
+			r.tokens = burst
+		}
+		if r.tokens >= n {
+			r.tokens -= n
+			r.mu.Unlock()
+			return
+		}
+		deficit := n - r.tokens
+		wait := time.Duration(float64(deficit) / float64(r.bytesPerSec) * float64(time.Second))
+		r.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,429 @@
+package blockstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// GLOBAL_BLOCKS_DIRECTORY holds every volume's blocks in one
+	// content-addressed pool, keyed purely by checksum: a block shared by
+	// two different volumes (e.g. a cloned base image) is only ever
+	// stored once, with addBlockRef/removeBlockRef tracking who still
+	// references it.
+	GLOBAL_BLOCKS_DIRECTORY = "blocks"
+
+	refSuffix  = ".refs"
+	lockSuffix = ".lock"
+
+	// lockRetries/lockRetryDelay bound how long addBlockRef/removeBlockRef
+	// wait for a concurrent backup's lock on the same block before giving
+	// up and proceeding anyway: BlockStoreDriver has no atomic
+	// create-if-absent primitive, so this is advisory rather than a true
+	// mutex, but it's enough to keep two concurrent backups of different
+	// snapshots that happen to share a block from clobbering each other's
+	// refcount write.
+	lockRetries    = 20
+	lockRetryDelay = 100 * time.Millisecond
+)
+
+// BlockRef identifies one (volume, snapshot) pair referencing a block, so
+// the same block shared by two snapshots of the same volume, or even two
+// different volumes backed up to the same blockstore, is only removed
+// once every referencing snapshot has been removed.
+type BlockRef struct {
+	VolumeUUID   string
+	SnapshotUUID string
+}
+
+// getGlobalBlockFilePath is where every volume's blocks now live, keyed
+// purely by checksum rather than scoped under a volumeID: this is what
+// lets two different volumes that happen to share a block (e.g. a cloned
+// base image) store it exactly once.
+func getGlobalBlockFilePath(checksum string) string {
+	return filepath.Join(BLOCKSTORE_BASE, GLOBAL_BLOCKS_DIRECTORY, checksum[:2], checksum[2:4], checksum)
+}
+
+func blockRefPath(checksum string) string {
+	return getGlobalBlockFilePath(checksum) + refSuffix
+}
+
+func blockLockPath(checksum string) string {
+	return getGlobalBlockFilePath(checksum) + lockSuffix
+}
+
+func withBlockLock(bsDriver BlockStoreDriver, checksum string, fn func() error) error {
+	lockPath := blockLockPath(checksum)
+	for i := 0; i < lockRetries && bsDriver.FileSize(lockPath) >= 0; i++ {
+		time.Sleep(lockRetryDelay)
+	}
+	// Refcount bookkeeping (the lock/refs files below) isn't part of the
+	// request-cancellable transfer path BackupSnapshotWithOptions/
+	// RestoreSnapshotWithOptions thread ctx through, so it uses
+	// context.Background() rather than plumbing a ctx parameter through
+	// every refcount helper for what's a handful of small metadata
+	// reads/writes per block.
+	if err := bsDriver.Write(context.Background(), lockPath, bytes.NewReader([]byte(checksum))); err != nil {
+		return err
+	}
+	defer bsDriver.Remove(lockPath)
+	return fn()
+}
+
+func loadBlockRefs(bsDriver BlockStoreDriver, checksum string) ([]BlockRef, error) {
+	path := blockRefPath(checksum)
+	if bsDriver.FileSize(path) < 0 {
+		return nil, nil
+	}
+	rc, err := bsDriver.Read(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	var refs []BlockRef
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func saveBlockRefs(bsDriver BlockStoreDriver, checksum string, refs []BlockRef) error {
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	return bsDriver.Write(context.Background(), blockRefPath(checksum), bytes.NewReader(data))
+}
+
+// addBlockRef records that ref now references the block at checksum,
+// taking a best-effort lock on the block's refcount file so a concurrent
+// backup referencing the same block doesn't lose this write. It's a
+// no-op if ref is already recorded.
+func addBlockRef(bsDriver BlockStoreDriver, checksum string, ref BlockRef) error {
+	return withBlockLock(bsDriver, checksum, func() error {
+		refs, err := loadBlockRefs(bsDriver, checksum)
+		if err != nil {
+			return err
+		}
+		for _, r := range refs {
+			if r == ref {
+				return nil
+			}
+		}
+		return saveBlockRefs(bsDriver, checksum, append(refs, ref))
+	})
+}
+
+// removeBlockRef drops ref from the block's refcount file, and removes
+// the block itself once no reference is left. A block with no refcount
+// file at all (e.g. one written by a version of this code before
+// refcounts existed) is treated as having zero references to remove, not
+// as an error.
+func removeBlockRef(bsDriver BlockStoreDriver, checksum string, ref BlockRef) error {
+	return withBlockLock(bsDriver, checksum, func() error {
+		refs, err := loadBlockRefs(bsDriver, checksum)
+		if err != nil {
+			return err
+		}
+		kept := refs[:0]
+		for _, r := range refs {
+			if r != ref {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) > 0 {
+			return saveBlockRefs(bsDriver, checksum, kept)
+		}
+		bsDriver.Remove(blockRefPath(checksum))
+		return removeAndCleanup(getGlobalBlockFilePath(checksum), bsDriver)
+	})
+}
+
+// listVolumeIDs returns every volume UUID that has ever been added to this
+// blockstore, by walking the volume directory tree for VOLUME_CONFIG_FILE
+// markers the same way getSnapshots walks a single volume's snapshots/.
+func listVolumeIDs(bsDriver BlockStoreDriver) ([]string, error) {
+	base := filepath.Join(BLOCKSTORE_BASE, VOLUME_DIRECTORY)
+	files, err := bsDriver.List(base)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, f := range files {
+		if filepath.Base(f) == VOLUME_CONFIG_FILE {
+			ids = append(ids, filepath.Base(filepath.Dir(f)))
+		}
+	}
+	return ids, nil
+}
+
+// RebuildRefCounts recomputes the global block pool's refcount files from
+// scratch by reading every volume's every live snapshot manifest,
+// discarding whatever refcount files already exist first. Use this to
+// repair a blockstore whose refcounts have drifted (e.g. after upgrading
+// from a version that predates this file, or recovering from a crash
+// mid-mutation).
+func RebuildRefCounts(root, blockstoreID string) (int, error) {
+	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return 0, err
+	}
+
+	blocksPath := filepath.Join(BLOCKSTORE_BASE, GLOBAL_BLOCKS_DIRECTORY)
+	blockFiles, err := bsDriver.List(blocksPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range blockFiles {
+		if filepath.Ext(f) == refSuffix || filepath.Ext(f) == lockSuffix {
+			bsDriver.Remove(filepath.Join(blocksPath, f))
+		}
+	}
+
+	volumeIDs, err := listVolumeIDs(bsDriver)
+	if err != nil {
+		return 0, err
+	}
+
+	rebuilt := 0
+	for _, volumeID := range volumeIDs {
+		snapshots, err := getSnapshots(volumeID, bsDriver)
+		if err != nil {
+			return rebuilt, err
+		}
+		for snapshotID := range snapshots {
+			snapshotMap, err := loadSnapshotMap(snapshotID, volumeID, bsDriver)
+			if err != nil {
+				return rebuilt, err
+			}
+			ref := BlockRef{VolumeUUID: volumeID, SnapshotUUID: snapshotID}
+			for _, blk := range snapshotMap.Blocks {
+				if err := addBlockRef(bsDriver, blk.BlockChecksum, ref); err != nil {
+					return rebuilt, err
+				}
+			}
+		}
+		rebuilt++
+	}
+	return rebuilt, nil
+}
+
+// VerifyBlockstore is a single-volume fsck for the global refcount index:
+// it recomputes which (volumeID, snapshotID) refs volumeID's live
+// snapshots justify, the same computation RebuildRefCounts does for every
+// volume at once, and reconciles each touched checksum's persisted
+// BlockRefs against that expected set, adding whatever's missing and
+// dropping whatever volumeID no longer justifies. Unlike RebuildRefCounts
+// it never touches another volume's refs on a shared block, so it's safe
+// to run against one volume while the rest of the blockstore stays live,
+// and it's the scoped recovery path for the index corruption
+// RebuildRefCounts otherwise requires a full-blockstore repair for. It
+// returns how many ref entries it added or removed.
+//
+// Like RebuildRefCounts, it assumes volumeID is quiescent: it isn't
+// locked against a concurrent BackupSnapshot of the same volume, so
+// running it while one is in flight can race the new snapshot's
+// addBlockRef calls and remove a ref out from under it.
+func VerifyBlockstore(root, volumeID, blockstoreID string) (int, error) {
+	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return 0, err
+	}
+
+	snapshots, err := getSnapshots(volumeID, bsDriver)
+	if err != nil {
+		return 0, err
+	}
+
+	expected := make(map[string]map[string]bool)
+	for snapshotID := range snapshots {
+		snapshotMap, err := loadSnapshotMap(snapshotID, volumeID, bsDriver)
+		if err != nil {
+			return 0, err
+		}
+		for _, blk := range snapshotMap.Blocks {
+			if expected[blk.BlockChecksum] == nil {
+				expected[blk.BlockChecksum] = make(map[string]bool)
+			}
+			expected[blk.BlockChecksum][snapshotID] = true
+		}
+	}
+
+	// A block volumeID no longer references at all (e.g. RemoveSnapshot
+	// crashed after deleting the manifest but before calling
+	// removeBlockRef) won't show up in expected above, so it's also
+	// checked against every ref file in the global pool: otherwise its
+	// stale BlockRef would never be visited and would keep the block
+	// pinned forever.
+	blocksPath := filepath.Join(BLOCKSTORE_BASE, GLOBAL_BLOCKS_DIRECTORY)
+	refFiles, err := bsDriver.List(blocksPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range refFiles {
+		if filepath.Ext(f) != refSuffix {
+			continue
+		}
+		checksum := strings.TrimSuffix(filepath.Base(f), refSuffix)
+		if _, ok := expected[checksum]; !ok {
+			expected[checksum] = make(map[string]bool)
+		}
+	}
+
+	repaired := 0
+	for checksum, wantSnapshots := range expected {
+		actual, err := loadBlockRefs(bsDriver, checksum)
+		if err != nil {
+			return repaired, err
+		}
+		have := make(map[string]bool)
+		for _, r := range actual {
+			if r.VolumeUUID == volumeID {
+				have[r.SnapshotUUID] = true
+			}
+		}
+		for snapshotID := range wantSnapshots {
+			if have[snapshotID] {
+				continue
+			}
+			ref := BlockRef{VolumeUUID: volumeID, SnapshotUUID: snapshotID}
+			if err := addBlockRef(bsDriver, checksum, ref); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+		for snapshotID := range have {
+			if wantSnapshots[snapshotID] {
+				continue
+			}
+			ref := BlockRef{VolumeUUID: volumeID, SnapshotUUID: snapshotID}
+			if err := removeBlockRef(bsDriver, checksum, ref); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+// GCByRefCount prunes every block with a zero refcount from the shared
+// global pool, rather than GC's single-volume, full-manifest-rescan
+// approach: it trusts the refcount files addBlockRef/removeBlockRef keep
+// up to date instead of re-reading every snapshot manifest, so it scales
+// with the number of blocks rather than the number of snapshots. Run
+// RebuildRefCounts first if the refcounts are suspected to have drifted.
+func GCByRefCount(root, blockstoreID string) (int, error) {
+	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return 0, err
+	}
+
+	blocksPath := filepath.Join(BLOCKSTORE_BASE, GLOBAL_BLOCKS_DIRECTORY)
+	files, err := bsDriver.List(blocksPath)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, f := range files {
+		if filepath.Ext(f) == refSuffix || filepath.Ext(f) == lockSuffix {
+			continue
+		}
+		checksum := filepath.Base(f)
+		refs, err := loadBlockRefs(bsDriver, checksum)
+		if err != nil {
+			return removed, err
+		}
+		if len(refs) > 0 {
+			continue
+		}
+		if err := removeAndCleanup(filepath.Join(blocksPath, f), bsDriver); err != nil {
+			return removed, err
+		}
+		bsDriver.Remove(blockRefPath(checksum))
+		log.Debugf("GCByRefCount removed unreferenced block %v", checksum)
+		removed++
+	}
+	return removed, nil
+}
+
+// MigrateToGlobalBlockPool moves every volume off the old per-volume
+// block layout (getBlockFilePath(volumeID, checksum)) and onto the
+// shared, content-addressed global pool: for each volume's every live
+// snapshot, it copies any still-missing block into the global pool, adds
+// the corresponding ref, then removes the volume's now-unused per-volume
+// blocks directory. A block already present in the global pool is left
+// alone, so re-running it after an interruption only copies what's left.
+func MigrateToGlobalBlockPool(root, blockstoreID string) (int, error) {
+	_, bsDriver, err := getBlockstoreCfgAndDriver(root, blockstoreID)
+	if err != nil {
+		return 0, err
+	}
+
+	volumeIDs, err := listVolumeIDs(bsDriver)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, volumeID := range volumeIDs {
+		snapshots, err := getSnapshots(volumeID, bsDriver)
+		if err != nil {
+			return migrated, err
+		}
+		for snapshotID := range snapshots {
+			snapshotMap, err := loadSnapshotMap(snapshotID, volumeID, bsDriver)
+			if err != nil {
+				return migrated, err
+			}
+			ref := BlockRef{VolumeUUID: volumeID, SnapshotUUID: snapshotID}
+			for _, blk := range snapshotMap.Blocks {
+				if err := migrateBlockToGlobalPool(bsDriver, volumeID, blk.BlockChecksum); err != nil {
+					return migrated, err
+				}
+				if err := addBlockRef(bsDriver, blk.BlockChecksum, ref); err != nil {
+					return migrated, err
+				}
+			}
+		}
+
+		if err := bsDriver.RemoveAll(getBlocksPath(volumeID)); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+func migrateBlockToGlobalPool(bsDriver BlockStoreDriver, volumeID, checksum string) error {
+	newPath := getGlobalBlockFilePath(checksum)
+	if bsDriver.FileSize(newPath) >= 0 {
+		return nil
+	}
+	oldPath := getBlockFilePath(volumeID, checksum)
+	if bsDriver.FileSize(oldPath) < 0 {
+		return nil
+	}
+	rc, err := bsDriver.Read(context.Background(), oldPath)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	if err := bsDriver.MkDirAll(filepath.Dir(newPath)); err != nil {
+		return err
+	}
+	return bsDriver.Write(context.Background(), newPath, bytes.NewReader(data))
+}
@@ -0,0 +1,84 @@
+package blockstore
+
+import "path/filepath"
+
+// inProgressSuffix marks a partial manifest written by an interrupted
+// BackupSnapshotWithOptions/RestoreSnapshotWithOptions call, so a later call
+// for the same snapshot can resume from it instead of redoing every block.
+const inProgressSuffix = ".inprogress"
+
+func getInProgressSnapshotConfigPath(volumeID, snapshotID string) string {
+	return filepath.Join(getSnapshotsPath(volumeID), getSnapshotConfigName(snapshotID)+inProgressSuffix)
+}
+
+// loadInProgressSnapshotMap loads the partial SnapshotMap a prior,
+// interrupted backup of snapshotID left behind, or an empty one if there
+// isn't one.
+func loadInProgressSnapshotMap(volumeID, snapshotID string, bsDriver BlockStoreDriver) (*SnapshotMap, error) {
+	path := getInProgressSnapshotConfigPath(volumeID, snapshotID)
+	if bsDriver.FileSize(path) < 0 {
+		return &SnapshotMap{ID: snapshotID}, nil
+	}
+	m := &SnapshotMap{}
+	if err := loadConfigInBlockStore(path, bsDriver, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func saveInProgressSnapshotMap(volumeID, snapshotID string, bsDriver BlockStoreDriver, m *SnapshotMap) error {
+	return saveConfigInBlockStore(getInProgressSnapshotConfigPath(volumeID, snapshotID), bsDriver, m)
+}
+
+func removeInProgressSnapshotMap(volumeID, snapshotID string, bsDriver BlockStoreDriver) error {
+	path := getInProgressSnapshotConfigPath(volumeID, snapshotID)
+	if bsDriver.FileSize(path) < 0 {
+		return nil
+	}
+	return bsDriver.RemoveAll(path)
+}
+
+// restoreProgress records which of a restore's blocks, by offset, have
+// already been written to the target volume device.
+type restoreProgress struct {
+	DoneOffsets []int64
+}
+
+func getRestoreProgressPath(dstVolumeID, srcSnapshotID string) string {
+	return filepath.Join(getVolumePath(dstVolumeID), srcSnapshotID+".restore"+inProgressSuffix)
+}
+
+// loadRestoreProgress loads the set of offsets a prior, interrupted restore
+// of srcSnapshotID into dstVolumeID already wrote, or an empty set if there
+// isn't one.
+func loadRestoreProgress(dstVolumeID, srcSnapshotID string, bsDriver BlockStoreDriver) (map[int64]bool, error) {
+	path := getRestoreProgressPath(dstVolumeID, srcSnapshotID)
+	done := map[int64]bool{}
+	if bsDriver.FileSize(path) < 0 {
+		return done, nil
+	}
+	p := &restoreProgress{}
+	if err := loadConfigInBlockStore(path, bsDriver, p); err != nil {
+		return nil, err
+	}
+	for _, offset := range p.DoneOffsets {
+		done[offset] = true
+	}
+	return done, nil
+}
+
+func saveRestoreProgress(dstVolumeID, srcSnapshotID string, bsDriver BlockStoreDriver, done map[int64]bool) error {
+	p := &restoreProgress{DoneOffsets: make([]int64, 0, len(done))}
+	for offset := range done {
+		p.DoneOffsets = append(p.DoneOffsets, offset)
+	}
+	return saveConfigInBlockStore(getRestoreProgressPath(dstVolumeID, srcSnapshotID), bsDriver, p)
+}
+
+func removeRestoreProgress(dstVolumeID, srcSnapshotID string, bsDriver BlockStoreDriver) error {
+	path := getRestoreProgressPath(dstVolumeID, srcSnapshotID)
+	if bsDriver.FileSize(path) < 0 {
+		return nil
+	}
+	return bsDriver.RemoveAll(path)
+}
@@ -0,0 +1,126 @@
+package blockstore
+
+import "github.com/rancherio/volmgr/utils"
+
+const (
+	CHUNKING_MODE_FIXED   = "fixed"
+	CHUNKING_MODE_ROLLING = "rolling"
+
+	// DEFAULT_CHUNK_MIN_SIZE/AVG_SIZE/MAX_SIZE are the variable-length
+	// chunking defaults a CHUNKING_MODE_ROLLING blockstore falls back to
+	// when Register isn't given explicit chunk-min-size/chunk-avg-size/
+	// chunk-max-size options: close enough to DEFAULT_BLOCK_SIZE to give
+	// a comparable number of chunks per snapshot, while still tolerating
+	// shifted data.
+	DEFAULT_CHUNK_MIN_SIZE = 512 * 1024
+	DEFAULT_CHUNK_AVG_SIZE = 2 * 1024 * 1024
+	DEFAULT_CHUNK_MAX_SIZE = 8 * 1024 * 1024
+
+	// variableChunkWindowSize is the rolling hash's look-behind window:
+	// 48 bytes is wide enough to smooth over short repeated runs without
+	// making the per-byte hash update expensive.
+	variableChunkWindowSize = 48
+)
+
+// variableWindowPow is the weight the byte leaving variableHash's window
+// carries in its value.
+var variableWindowPow = polynomialPow(variableChunkWindowSize)
+
+// variableHash is a polynomial (Rabin-Karp) rolling hash over the trailing
+// variableChunkWindowSize bytes, the same update as chunker.go's rollingHash
+// but with its own window size: the running value is multiplied by
+// polynomialConstant and the new byte added, and the byte leaving the window
+// is subtracted times polynomialConstant^variableChunkWindowSize, so the value
+// depends only on the bytes in the window. It is not a Gear (table lookup)
+// hash. A chunk boundary is cut wherever the hash's low bits come up zero, so
+// the cut points follow the data itself instead of a fixed stride.
+type variableHash struct {
+	window []byte
+	pos    int
+	full   bool
+	value  uint64
+}
+
+func newVariableHash() *variableHash {
+	return &variableHash{window: make([]byte, variableChunkWindowSize)}
+}
+
+func (h *variableHash) roll(b byte) uint64 {
+	old := h.window[h.pos]
+	h.window[h.pos] = b
+	h.pos = (h.pos + 1) % variableChunkWindowSize
+	if h.pos == 0 {
+		h.full = true
+	}
+	h.value = h.value*polynomialConstant + uint64(b) - uint64(old)*variableWindowPow
+	return h.value
+}
+
+// cutVariableChunks returns the offsets (relative to data[0]) at which data
+// should be split, given minSize/avgSize/maxSize bounds. Like FastCDC, it
+// uses two masks instead of one: maskS (more 1-bits, so harder to match) is
+// checked below avgSize to discourage cutting too early, and maskL (fewer
+// 1-bits, easier to match) is checked at or above avgSize to encourage
+// cutting before maxSize is reached by brute force. A single mask instead
+// produces a chunk-size distribution skewed by the geometric distribution's
+// long tail toward maxSize; splitting the mask in two around avgSize
+// normalizes it back toward avgSize, which is what the FastCDC paper calls
+// normalized chunking.
+func cutVariableChunks(data []byte, minSize, avgSize, maxSize int64) []int64 {
+	maskS, maskL := normalizedChunkMasks(avgSize)
+	var cuts []int64
+	h := newVariableHash()
+	start := int64(0)
+	for i := range data {
+		v := h.roll(data[i])
+		size := int64(i) + 1 - start
+		if size < minSize || !h.full {
+			continue
+		}
+		mask := maskL
+		if size < avgSize {
+			mask = maskS
+		}
+		if v&mask == 0 || size >= maxSize {
+			cuts = append(cuts, int64(i+1))
+			start = int64(i + 1)
+			h = newVariableHash()
+		}
+	}
+	if start < int64(len(data)) {
+		cuts = append(cuts, int64(len(data)))
+	}
+	return cuts
+}
+
+// normalizedChunkMasks returns FastCDC's maskS/maskL pair for a given
+// avgSize: maskS has one extra bit set (so roughly twice as hard to match)
+// and maskL has one fewer (roughly twice as easy), around avgSizeMask's
+// baseline of "matches about once every avgSize bytes".
+func normalizedChunkMasks(avgSize int64) (maskS, maskL uint64) {
+	base := avgSizeMask(int(avgSize))
+	return (base << 1) | 1, base >> 1
+}
+
+// ChunkVariableBlocks splits data, one CompareSnapshot delta mapping's full
+// changed region starting at baseOffset, into content-defined chunks keyed
+// by SHA-512 checksum. A CHUNKING_MODE_ROLLING blockstore stores one
+// BlockMapping per chunk this returns, instead of one BlockMapping per
+// BlockSize-aligned offset: because the cut points follow the data itself,
+// data that's merely shifted within the volume (e.g. a line inserted
+// earlier in a file) still produces a run of identical chunks, rather than
+// every fixed-size block downstream of the shift changing.
+func ChunkVariableBlocks(baseOffset int64, data []byte, minSize, avgSize, maxSize int64) []Chunk {
+	cuts := cutVariableChunks(data, minSize, avgSize, maxSize)
+	chunks := make([]Chunk, 0, len(cuts))
+	start := int64(0)
+	for _, end := range cuts {
+		chunks = append(chunks, Chunk{
+			Offset:   baseOffset + start,
+			Length:   end - start,
+			Checksum: utils.GetChecksum(data[start:end]),
+		})
+		start = end
+	}
+	return chunks
+}
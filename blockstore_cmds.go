@@ -2,7 +2,9 @@ package main
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"context"
 	"fmt"
+	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/rancherio/volmgr/api"
 	"github.com/rancherio/volmgr/blockstore"
@@ -26,6 +28,10 @@ var (
 				Name:  "blockstore-uuid",
 				Usage: "uuid of blockstore",
 			},
+			cli.StringFlag{
+				Name:  "passphrase",
+				Usage: "passphrase to encrypt blocks with, required if the blockstore was registered with encrypt=true",
+			},
 		},
 		Action: cmdSnapshotBackup,
 	}
@@ -50,6 +56,14 @@ var (
 				Name:  "blockstore-uuid",
 				Usage: "uuid of blockstore",
 			},
+			cli.StringFlag{
+				Name:  "passphrase",
+				Usage: "passphrase to decrypt blocks with, required if the blockstore was registered with encrypt=true",
+			},
+			cli.BoolFlag{
+				Name:  "verify",
+				Usage: "verify each block's checksum while restoring, failing loudly on a mismatch instead of writing it out",
+			},
 		},
 		Action: cmdSnapshotRestore,
 	}
@@ -86,7 +100,7 @@ var (
 			cli.StringSliceFlag{
 				Name:  "opts",
 				Value: &cli.StringSlice{},
-				Usage: "options used to register blockstore",
+				Usage: "options used to register blockstore, e.g. blocksize=..., chunking=rolling, chunk-avg-size=..., encrypt=true, compression=gzip, concurrency=8",
 			},
 		},
 		Action: cmdBlockStoreRegister,
@@ -228,6 +242,62 @@ var (
 		Action: cmdBlockStoreDeactivateImage,
 	}
 
+	snapshotGCCmd = cli.Command{
+		Name:  "gc",
+		Usage: "remove unreferenced blocks/chunks from blockstore, for one volume or, if volume-uuid is omitted, the whole blockstore by refcount",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume-uuid",
+				Usage: "uuid of volume for snapshot; if omitted, GC the whole blockstore by refcount instead",
+			},
+			cli.StringFlag{
+				Name:  "blockstore-uuid",
+				Usage: "uuid of blockstore",
+			},
+		},
+		Action: cmdSnapshotGC,
+	}
+
+	blockstoreFsckCmd = cli.Command{
+		Name:  "fsck",
+		Usage: "rebuild the blockstore's block refcount index from every volume's snapshots, discarding whatever refcounts already exist",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "blockstore-uuid",
+				Usage: "uuid of blockstore",
+			},
+		},
+		Action: cmdBlockStoreFsck,
+	}
+
+	blockstoreMigrateCmd = cli.Command{
+		Name:  "migrate-blocks",
+		Usage: "migrate every volume's blocks from the old per-volume layout into the shared, content-addressed global block pool",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "blockstore-uuid",
+				Usage: "uuid of blockstore",
+			},
+		},
+		Action: cmdBlockStoreMigrateBlocks,
+	}
+
+	blockstoreScrubCmd = cli.Command{
+		Name:  "scrub",
+		Usage: "read back and verify every block referenced anywhere in the blockstore, reporting any that are missing or corrupt",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "blockstore-uuid",
+				Usage: "uuid of blockstore",
+			},
+			cli.StringFlag{
+				Name:  "passphrase",
+				Usage: "passphrase to decrypt blocks with, required if the blockstore was registered with encrypt=true",
+			},
+		},
+		Action: cmdBlockStoreScrub,
+	}
+
 	blockstoreCmd = cli.Command{
 		Name:  "blockstore",
 		Usage: "blockstore related operations",
@@ -241,6 +311,10 @@ var (
 			blockstoreActivateImageCmd,
 			blockstoreDeactivateImageCmd,
 			blockstoreListCmd,
+			snapshotGCCmd,
+			blockstoreFsckCmd,
+			blockstoreMigrateCmd,
+			blockstoreScrubCmd,
 		},
 	}
 )
@@ -377,7 +451,10 @@ func doSnapshotBackup(c *cli.Context) error {
 		return fmt.Errorf("snapshot %v of volume %v doesn't exist", snapshotUUID, volumeUUID)
 	}
 
-	return blockstore.BackupSnapshot(config.Root, snapshotUUID, volumeUUID, blockstoreUUID, driver)
+	opts := blockstore.BackupOptions{
+		Passphrase: c.String("passphrase"),
+	}
+	return blockstore.BackupSnapshotWithOptions(context.Background(), config.Root, snapshotUUID, volumeUUID, blockstoreUUID, driver, opts)
 }
 
 func cmdSnapshotRestore(c *cli.Context) {
@@ -412,8 +489,12 @@ func doSnapshotRestore(c *cli.Context) error {
 			targetVolumeUUID, originVolumeUUID)
 	}
 
-	return blockstore.RestoreSnapshot(config.Root, snapshotUUID, originVolumeUUID,
-		targetVolumeUUID, blockstoreUUID, driver)
+	opts := blockstore.BackupOptions{
+		Passphrase: c.String("passphrase"),
+		Verify:     c.Bool("verify"),
+	}
+	return blockstore.RestoreSnapshotWithOptions(context.Background(), config.Root, snapshotUUID, originVolumeUUID,
+		targetVolumeUUID, blockstoreUUID, driver, opts)
 }
 
 func cmdSnapshotRemove(c *cli.Context) {
@@ -435,7 +516,107 @@ func doSnapshotRemove(c *cli.Context) error {
 		return fmt.Errorf("snapshot %v of volume %v doesn't exist", snapshotUUID, volumeUUID)
 	}
 
-	return blockstore.RemoveSnapshot(config.Root, snapshotUUID, volumeUUID, blockstoreUUID)
+	return blockstore.RemoveSnapshot(context.Background(), config.Root, snapshotUUID, volumeUUID, blockstoreUUID)
+}
+
+func cmdSnapshotGC(c *cli.Context) {
+	if err := doSnapshotGC(c); err != nil {
+		panic(err)
+	}
+}
+
+func doSnapshotGC(c *cli.Context) error {
+	config, _, err := loadGlobalConfig(c)
+	blockstoreUUID, err := getLowerCaseFlag(c, "blockstore-uuid", true, err)
+	volumeUUID, err := getLowerCaseFlag(c, "volume-uuid", false, err)
+	if err != nil {
+		return err
+	}
+
+	// With no volume-uuid, scan the whole blockstore by refcount instead
+	// of rescanning one volume's snapshots.
+	if volumeUUID == "" {
+		removed, err := blockstore.GCByRefCount(config.Root, blockstoreUUID)
+		if err != nil {
+			return err
+		}
+		log.Infof("GC removed %v unreferenced block file(s) across blockstore %v", removed, blockstoreUUID)
+		return nil
+	}
+
+	removed, err := blockstore.GC(config.Root, volumeUUID, blockstoreUUID)
+	if err != nil {
+		return err
+	}
+	log.Infof("GC removed %v unreferenced block/chunk file(s) for volume %v", removed, volumeUUID)
+	return nil
+}
+
+func cmdBlockStoreFsck(c *cli.Context) {
+	if err := doBlockStoreFsck(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBlockStoreFsck(c *cli.Context) error {
+	config, _, err := loadGlobalConfig(c)
+	blockstoreUUID, err := getLowerCaseFlag(c, "blockstore-uuid", true, err)
+	if err != nil {
+		return err
+	}
+
+	rebuilt, err := blockstore.RebuildRefCounts(config.Root, blockstoreUUID)
+	if err != nil {
+		return err
+	}
+	log.Infof("Rebuilt block refcounts for %v volume(s) in blockstore %v", rebuilt, blockstoreUUID)
+	return nil
+}
+
+func cmdBlockStoreMigrateBlocks(c *cli.Context) {
+	if err := doBlockStoreMigrateBlocks(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBlockStoreMigrateBlocks(c *cli.Context) error {
+	config, _, err := loadGlobalConfig(c)
+	blockstoreUUID, err := getLowerCaseFlag(c, "blockstore-uuid", true, err)
+	if err != nil {
+		return err
+	}
+
+	migrated, err := blockstore.MigrateToGlobalBlockPool(config.Root, blockstoreUUID)
+	if err != nil {
+		return err
+	}
+	log.Infof("Migrated %v volume(s) in blockstore %v to the global block pool", migrated, blockstoreUUID)
+	return nil
+}
+
+func cmdBlockStoreScrub(c *cli.Context) {
+	if err := doBlockStoreScrub(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBlockStoreScrub(c *cli.Context) error {
+	config, _, err := loadGlobalConfig(c)
+	blockstoreUUID, err := getLowerCaseFlag(c, "blockstore-uuid", true, err)
+	if err != nil {
+		return err
+	}
+
+	result, err := blockstore.Scrub(config.Root, blockstoreUUID, c.String("passphrase"))
+	if err != nil {
+		return err
+	}
+	if len(result.BadChecksums) != 0 {
+		return fmt.Errorf("scrub of blockstore %v verified %v block(s), found %v corrupt: %v",
+			blockstoreUUID, result.Verified, len(result.BadChecksums), result.BadChecksums)
+	}
+	log.Infof("Scrub of blockstore %v verified %v block(s), no corruption found", blockstoreUUID, result.Verified)
+	return nil
 }
 
 func cmdBlockStoreAddImage(c *cli.Context) {
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/rancher/rancher-volume/api"
+)
+
+var backupCmd = cli.Command{
+	Name:  "backup",
+	Usage: "back up a volume to, or restore/inspect/garbage-collect it from, a destination URL",
+	Subcommands: []cli.Command{
+		backupCreateCmd,
+		backupListCmd,
+		backupInspectCmd,
+		backupDeleteCmd,
+		backupGCCmd,
+		backupReplicateCmd,
+	},
+}
+
+var backupCreateCmd = cli.Command{
+	Name:  "create",
+	Usage: "create a backup of a volume",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "volume-uuid",
+			Usage: "uuid of the volume to back up",
+		},
+		cli.StringFlag{
+			Name:  "dest",
+			Usage: "backup destination URL, e.g. vfs:///mnt/backups",
+		},
+	},
+	Action: cmdBackupCreate,
+}
+
+func cmdBackupCreate(c *cli.Context) {
+	if err := doBackupCreate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupCreate(c *cli.Context) error {
+	volumeUUID := c.String("volume-uuid")
+	if volumeUUID == "" {
+		return fmt.Errorf("volume-uuid is required")
+	}
+	dest := c.String("dest")
+	if dest == "" {
+		return fmt.Errorf("dest is required")
+	}
+	data := &api.BackupCreateConfig{
+		URL:          dest,
+		SnapshotUUID: volumeUUID,
+	}
+	return sendRequestAndPrint("POST", "/backups/create", data)
+}
+
+var backupListCmd = cli.Command{
+	Name:  "ls",
+	Usage: "list backups of a volume at a destination",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "volume-uuid",
+			Usage: "uuid of the volume",
+		},
+		cli.StringFlag{
+			Name:  "dest",
+			Usage: "backup destination URL",
+		},
+	},
+	Action: cmdBackupList,
+}
+
+func cmdBackupList(c *cli.Context) {
+	if err := doBackupList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupList(c *cli.Context) error {
+	query := url.Values{}
+	query.Set("VolumeUUID", c.String("volume-uuid"))
+	query.Set("URL", c.String("dest"))
+	return sendRequestAndPrint("GET", "/backups/list?"+query.Encode(), nil)
+}
+
+var backupInspectCmd = cli.Command{
+	Name:  "inspect",
+	Usage: "show a single backup's manifest",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "url",
+			Usage: "backup URL, as returned by 'convoy backup create'",
+		},
+	},
+	Action: cmdBackupInspect,
+}
+
+func cmdBackupInspect(c *cli.Context) {
+	if err := doBackupInspect(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupInspect(c *cli.Context) error {
+	query := url.Values{}
+	query.Set("URL", c.String("url"))
+	return sendRequestAndPrint("GET", "/backups/inspect?"+query.Encode(), nil)
+}
+
+var backupDeleteCmd = cli.Command{
+	Name:  "rm",
+	Usage: "delete a backup's manifest (its chunks are reclaimed separately by 'convoy backup gc')",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "url",
+			Usage: "backup URL to delete",
+		},
+	},
+	Action: cmdBackupDelete,
+}
+
+func cmdBackupDelete(c *cli.Context) {
+	if err := doBackupDelete(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupDelete(c *cli.Context) error {
+	data := &api.BackupDeleteConfig{URL: c.String("url")}
+	return sendRequestAndPrint("DELETE", "/backups", data)
+}
+
+var backupGCCmd = cli.Command{
+	Name:  "gc",
+	Usage: "remove chunk objects no live backup of a volume references anymore",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "volume-uuid",
+			Usage: "uuid of the volume whose backups to collect",
+		},
+		cli.StringFlag{
+			Name:  "dest",
+			Usage: "backup destination URL",
+		},
+		cli.IntFlag{
+			Name:  "grace-period",
+			Usage: "skip chunks written more recently than this many seconds, to avoid racing an in-flight backup (default 3600)",
+		},
+	},
+	Action: cmdBackupGC,
+}
+
+func cmdBackupGC(c *cli.Context) {
+	if err := doBackupGC(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupGC(c *cli.Context) error {
+	volumeUUID := c.String("volume-uuid")
+	if volumeUUID == "" {
+		return fmt.Errorf("volume-uuid is required")
+	}
+	dest := c.String("dest")
+	if dest == "" {
+		return fmt.Errorf("dest is required")
+	}
+	data := &api.BackupGCConfig{
+		URL:                dest,
+		VolumeUUID:         volumeUUID,
+		GracePeriodSeconds: int64(c.Int("grace-period")),
+	}
+	return sendRequestAndPrint("POST", "/backups/gc", data)
+}
+
+var backupReplicateCmd = cli.Command{
+	Name:  "replicate",
+	Usage: "copy a backup's manifest and chunks to another destination",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "url",
+			Usage: "backup URL to replicate",
+		},
+		cli.StringFlag{
+			Name:  "dest",
+			Usage: "destination URL to replicate it to",
+		},
+		cli.StringFlag{
+			Name:  "incremental-from",
+			Usage: "a backup URL already replicated to dest, whose chunks can be assumed present there",
+		},
+	},
+	Action: cmdBackupReplicate,
+}
+
+func cmdBackupReplicate(c *cli.Context) {
+	if err := doBackupReplicate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupReplicate(c *cli.Context) error {
+	url := c.String("url")
+	if url == "" {
+		return fmt.Errorf("url is required")
+	}
+	dest := c.String("dest")
+	if dest == "" {
+		return fmt.Errorf("dest is required")
+	}
+	data := &api.BackupReplicateConfig{
+		URL:                url,
+		Dest:               dest,
+		IncrementalFromURL: c.String("incremental-from"),
+	}
+	return sendRequestAndPrint("POST", "/backups/replicate", data)
+}
@@ -1,6 +1,10 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -17,6 +21,8 @@ type Client struct {
 	addr      string
 	scheme    string
 	transport *http.Transport
+	tlsConfig *tls.Config
+	token     string
 }
 
 var (
@@ -26,7 +32,7 @@ var (
 	client Client
 )
 
-func (c *Client) call(method, path string, data interface{}, headers map[string][]string) (io.ReadCloser, int, error) {
+func (c *Client) call(ctx context.Context, method, path string, data interface{}, headers map[string][]string) (io.ReadCloser, int, error) {
 	params, err := util.EncodeData(data)
 	if err != nil {
 		return nil, -1, err
@@ -39,7 +45,7 @@ func (c *Client) call(method, path string, data interface{}, headers map[string]
 		headers["Context-Type"] = []string{"application/json"}
 	}
 
-	body, _, statusCode, err := c.clientRequest(method, path, params, headers)
+	body, _, statusCode, err := c.clientRequest(ctx, method, path, params, headers)
 
 	return body, statusCode, err
 }
@@ -52,12 +58,16 @@ func getRequestPath(path string) string {
 	return fmt.Sprintf("/v1%s", path)
 }
 
-func (c *Client) clientRequest(method, path string, in io.Reader, headers map[string][]string) (io.ReadCloser, string, int, error) {
+func (c *Client) clientRequest(ctx context.Context, method, path string, in io.Reader, headers map[string][]string) (io.ReadCloser, string, int, error) {
 	req, err := http.NewRequest(method, getRequestPath(path), in)
 	if err != nil {
 		return nil, "", -1, err
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("User-Agent", "Rancher-Volume-Client/"+api.API_VERSION)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
 	req.URL.Host = c.addr
 	req.URL.Scheme = c.scheme
 
@@ -79,15 +89,15 @@ func (c *Client) clientRequest(method, path string, in io.Reader, headers map[st
 		}
 		return nil, "", statusCode, fmt.Errorf("Error response from server, %v", string(body))
 	}
-	return resp.Body, resp.Header.Get("Context-Type"), statusCode, nil
+	return resp.Body, resp.Header.Get("Content-Type"), statusCode, nil
 }
 
-func sendRequest(method, request string, data interface{}) (io.ReadCloser, error) {
+func sendRequest(ctx context.Context, method, request string, data interface{}) (io.ReadCloser, error) {
 	log.Debugf("Sending request %v %v", method, request)
 	if data != nil {
 		log.Debugf("With data %+v", data)
 	}
-	rc, _, err := client.call(method, request, data, nil)
+	rc, _, err := client.call(ctx, method, request, data, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +105,7 @@ func sendRequest(method, request string, data interface{}) (io.ReadCloser, error
 }
 
 func sendRequestAndPrint(method, request string, data interface{}) error {
-	rc, err := sendRequest(method, request, data)
+	rc, err := sendRequest(context.Background(), method, request, data)
 	if err != nil {
 		return err
 	}
@@ -109,6 +119,50 @@ func sendRequestAndPrint(method, request string, data interface{}) error {
 	return nil
 }
 
+// sendRequestAndStream issues method/path/data like sendRequest, but
+// treats the response as a stream of newline-delimited api.Event frames
+// (Content-Type: application/x-ndjson) instead of one buffered body,
+// calling handler as each frame arrives. Long operations like snapshot
+// creation, backup upload, and EBS attach polling report progress this
+// way instead of leaving the user staring at a silent hang.
+func sendRequestAndStream(method, path string, data interface{}, handler func(api.Event)) error {
+	rc, contentType, statusCode, err := client.clientRequest(context.Background(), method, path, mustEncode(data), map[string][]string{
+		"Accept": {"application/x-ndjson"},
+	})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if contentType != "application/x-ndjson" {
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("server returned status %v without an event stream: %v", statusCode, string(b))
+	}
+
+	decoder := json.NewDecoder(rc)
+	for {
+		var event api.Event
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		handler(event)
+	}
+}
+
+func mustEncode(data interface{}) io.Reader {
+	params, err := util.EncodeData(data)
+	if err != nil {
+		panic(err)
+	}
+	return params
+}
+
 func cmdNotFound(c *cli.Context, command string) {
 	panic(fmt.Errorf("Unrecognized command", command))
 }
@@ -120,6 +174,30 @@ func NewCli(version string) *cli.App {
 	app.Author = "Sheng Yang <sheng.yang@rancher.com>"
 	app.Usage = "A volume manager capable of snapshot and delta backup"
 	app.CommandNotFound = cmdNotFound
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "host",
+			Usage:  "address of the rancher-volume daemon, e.g. tcp://1.2.3.4:2345; unix socket is used if unset",
+			EnvVar: "RANCHER_VOLUME_HOST",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "path to TLS client certificate file",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "path to TLS client private key file",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "path to CA certificate used to verify the server",
+		},
+		cli.StringFlag{
+			Name:  "auth-token",
+			Usage: "bearer token sent with every request",
+		},
+	}
+	app.Before = cmdInitClient
 
 	serverCmd := cli.Command{
 		Name:  "server",
@@ -141,7 +219,7 @@ func NewCli(version string) *cli.App {
 			cli.StringFlag{
 				Name:  "driver",
 				Value: "devicemapper",
-				Usage: "Driver for volume manager, only support \"devicemapper\" currently",
+				Usage: "Driver for volume manager: \"devicemapper\" or \"ebs\" (EBS-backed volumes, configured via --driver-opts ebs.*)",
 			},
 			cli.StringSliceFlag{
 				Name:  "driver-opts",
@@ -158,6 +236,50 @@ func NewCli(version string) *cli.App {
 				Value: "10G",
 				Usage: "default size for volume creation",
 			},
+			cli.StringFlag{
+				Name:  "host",
+				Usage: "TCP address to listen on (e.g. 0.0.0.0:2345); unix socket is used if unset",
+			},
+			cli.StringFlag{
+				Name:  "tls-cert",
+				Usage: "path to TLS certificate file for the --host listener",
+			},
+			cli.StringFlag{
+				Name:  "tls-key",
+				Usage: "path to TLS private key file for the --host listener",
+			},
+			cli.StringFlag{
+				Name:  "tls-ca",
+				Usage: "path to CA certificate used to require and verify client certificates",
+			},
+			cli.StringFlag{
+				Name:  "auth-token",
+				Usage: "bearer token required in the Authorization header of every request",
+			},
+			cli.StringFlag{
+				Name:  "plugin-host",
+				Usage: "additional TCP address to serve the Docker Volume Plugin API on (e.g. 0.0.0.0:8989), alongside the unix socket; lets convoy act as a remote plugin for a Swarm / multi-host cluster",
+			},
+			cli.StringFlag{
+				Name:  "plugin-tls-cert",
+				Usage: "path to TLS certificate file for the --plugin-host listener",
+			},
+			cli.StringFlag{
+				Name:  "plugin-tls-key",
+				Usage: "path to TLS private key file for the --plugin-host listener",
+			},
+			cli.StringFlag{
+				Name:  "plugin-tls-ca",
+				Usage: "path to CA certificate used to require and verify client certificates on the --plugin-host listener",
+			},
+			cli.StringFlag{
+				Name:  "shutdown-timeout",
+				Usage: "how long to wait for in-flight requests to finish on SIGTERM/SIGINT before shutting down anyway, e.g. \"30s\" (default 30s)",
+			},
+			cli.BoolFlag{
+				Name:  "allow-unversioned",
+				Usage: "serve requests that don't use the /v{version} URL prefix, with a deprecation warning, instead of rejecting them",
+			},
 		},
 		Action: cmdStartServer,
 	}
@@ -171,19 +293,66 @@ func NewCli(version string) *cli.App {
 		volumeUmountCmd,
 		volumeListCmd,
 		volumeInspectCmd,
+		volumePruneCmd,
 		snapshotCmd,
+		snapshotPruneCmd,
 		backupCmd,
+		quotaCmd,
 	}
 	return app
 }
 
-func InitClient() {
-	client.addr = sockFile
+// cmdInitClient wires up the package-level client from global CLI flags
+// (and the RANCHER_VOLUME_HOST env var via the --host flag's EnvVar). With
+// no --host it keeps the original unix-socket-only behavior; with --host
+// it dials TCP, optionally over mutual TLS, and attaches the bearer token
+// to every outgoing request.
+func cmdInitClient(c *cli.Context) error {
+	host := c.GlobalString("host")
+	client.token = c.GlobalString("auth-token")
+
+	if host == "" {
+		client.addr = sockFile
+		client.scheme = "http"
+		client.transport = &http.Transport{
+			DisableCompression: true,
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.DialTimeout("unix", sockFile, 10*time.Second)
+			},
+		}
+		return nil
+	}
+
+	client.addr = host
 	client.scheme = "http"
-	client.transport = &http.Transport{
-		DisableCompression: true,
-		Dial: func(_, _ string) (net.Conn, error) {
-			return net.DialTimeout("unix", sockFile, 10*time.Second)
-		},
+	client.transport = &http.Transport{DisableCompression: true}
+
+	tlsCert := c.GlobalString("tls-cert")
+	tlsKey := c.GlobalString("tls-key")
+	if tlsCert == "" || tlsKey == "" {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if tlsCA := c.GlobalString("tls-ca"); tlsCA != "" {
+		ca, err := ioutil.ReadFile(tlsCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("Unable to parse CA certificate %v", tlsCA)
+		}
+		tlsConfig.RootCAs = pool
 	}
+
+	client.tlsConfig = tlsConfig
+	client.scheme = "https"
+	client.transport.TLSClientConfig = tlsConfig
+	return nil
 }
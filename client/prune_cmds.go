@@ -0,0 +1,80 @@
+package client
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"net/url"
+)
+
+var volumePruneCmd = cli.Command{
+	Name:  "volume-prune",
+	Usage: "remove unused volumes and report reclaimed space",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "keep-storage",
+			Usage: "keep pruning until total reclaimed space reaches this many bytes",
+		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "send all=1, which sets the dangling filter; mounted volumes are never pruned, with or without this flag",
+		},
+		cli.StringFlag{
+			Name:  "filters",
+			Usage: "filter expression as JSON, e.g. '{\"until\":[\"24h\"],\"label\":[\"env=test\"]}'",
+		},
+	},
+	Action: cmdVolumePrune,
+}
+
+func cmdVolumePrune(c *cli.Context) {
+	if err := doPrune(c, "/volumes/prune"); err != nil {
+		panic(err)
+	}
+}
+
+var snapshotPruneCmd = cli.Command{
+	Name:  "snapshot-prune",
+	Usage: "remove snapshots matching the filters and report which were deleted",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "keep-storage",
+			Usage: "has no effect: snapshot prune does not measure reclaimed space",
+		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "send all=1; it does not change which snapshots are pruned, as the name and until filters still apply",
+		},
+		cli.StringFlag{
+			Name:  "filters",
+			Usage: "filter expression as JSON, e.g. '{\"until\":[\"24h\"],\"name\":[\"nightly\"]}'",
+		},
+	},
+	Action: cmdSnapshotPrune,
+}
+
+func cmdSnapshotPrune(c *cli.Context) {
+	if err := doPrune(c, "/snapshots/prune"); err != nil {
+		panic(err)
+	}
+}
+
+// doPrune forwards the keep-storage/all/filters flags to path as query
+// params and prints the server's PruneReport.
+func doPrune(c *cli.Context, path string) error {
+	query := url.Values{}
+	if keepStorage := c.String("keep-storage"); keepStorage != "" {
+		query.Set("keep-storage", keepStorage)
+	}
+	if c.Bool("all") {
+		query.Set("all", "1")
+	}
+	if filters := c.String("filters"); filters != "" {
+		query.Set("filters", filters)
+	}
+
+	request := path
+	if encoded := query.Encode(); encoded != "" {
+		request = fmt.Sprintf("%s?%s", path, encoded)
+	}
+	return sendRequestAndPrint("POST", request, nil)
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/rancher/rancher-volume/api"
+	"github.com/rancher/rancher-volume/util"
+)
+
+var quotaCmd = cli.Command{
+	Name:  "quota",
+	Usage: "set, list or delete volume quota rules",
+	Subcommands: []cli.Command{
+		quotaSetCmd,
+		quotaListCmd,
+		quotaDeleteCmd,
+	},
+}
+
+var quotaSetCmd = cli.Command{
+	Name:  "set",
+	Usage: "add a quota rule, or replace the rule for the same --label/--driver selector",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "label",
+			Usage: "limit volumes matching this label= filter value (key=value or bare key)",
+		},
+		cli.StringFlag{
+			Name:  "driver",
+			Usage: "limit volumes using this driver",
+		},
+		cli.StringFlag{
+			Name:  "max-total-size",
+			Usage: "cap on the combined size of every matching volume, e.g. 500G (0 means unlimited)",
+		},
+		cli.IntFlag{
+			Name:  "max-volumes",
+			Usage: "cap on the number of matching volumes (0 means unlimited)",
+		},
+		cli.StringFlag{
+			Name:  "max-volume-size",
+			Usage: "cap on any single matching volume's size, e.g. 50G (0 means unlimited)",
+		},
+	},
+	Action: cmdQuotaSet,
+}
+
+func cmdQuotaSet(c *cli.Context) {
+	if err := doQuotaSet(c); err != nil {
+		panic(err)
+	}
+}
+
+func doQuotaSet(c *cli.Context) error {
+	var maxTotalBytes, maxVolumeBytes int64
+	if raw := c.String("max-total-size"); raw != "" {
+		size, err := util.ParseSize(raw)
+		if err != nil {
+			return err
+		}
+		maxTotalBytes = size
+	}
+	if raw := c.String("max-volume-size"); raw != "" {
+		size, err := util.ParseSize(raw)
+		if err != nil {
+			return err
+		}
+		maxVolumeBytes = size
+	}
+
+	data := &api.QuotaSetConfig{
+		QuotaRule: api.QuotaRule{
+			Selector: api.QuotaSelector{
+				Label:  c.String("label"),
+				Driver: c.String("driver"),
+			},
+			MaxTotalBytes:  maxTotalBytes,
+			MaxVolumes:     c.Int("max-volumes"),
+			MaxVolumeBytes: maxVolumeBytes,
+		},
+	}
+	return sendRequestAndPrint("POST", "/quotas/set", data)
+}
+
+var quotaListCmd = cli.Command{
+	Name:   "ls",
+	Usage:  "list quota rules",
+	Action: cmdQuotaList,
+}
+
+func cmdQuotaList(c *cli.Context) {
+	if err := doQuotaList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doQuotaList(c *cli.Context) error {
+	return sendRequestAndPrint("GET", "/quotas/list", nil)
+}
+
+var quotaDeleteCmd = cli.Command{
+	Name:  "rm",
+	Usage: "delete the quota rule for a --label/--driver selector",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "label",
+			Usage: "the rule's label= selector",
+		},
+		cli.StringFlag{
+			Name:  "driver",
+			Usage: "the rule's driver selector",
+		},
+	},
+	Action: cmdQuotaDelete,
+}
+
+func cmdQuotaDelete(c *cli.Context) {
+	if err := doQuotaDelete(c); err != nil {
+		panic(err)
+	}
+}
+
+func doQuotaDelete(c *cli.Context) error {
+	label := c.String("label")
+	driver := c.String("driver")
+	if label == "" && driver == "" {
+		return fmt.Errorf("at least one of --label or --driver is required")
+	}
+	data := &api.QuotaDeleteConfig{
+		Selector: api.QuotaSelector{Label: label, Driver: driver},
+	}
+	return sendRequestAndPrint("DELETE", "/quotas", data)
+}
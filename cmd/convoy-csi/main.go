@@ -0,0 +1,91 @@
+// Command convoy-csi runs the CSI Identity/Controller/Node services on
+// their own gRPC listener, on top of the same Server and StorageDriver
+// the convoy HTTP API runs, so convoy volumes (devicemapper/EBS/VFS)
+// become usable as Kubernetes PersistentVolumes without a separate volume
+// manager process.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+
+	"github.com/rancher/rancher-volume/csi"
+	"github.com/rancher/rancher-volume/server"
+)
+
+var version = "0.0.0-dev"
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "convoy-csi"
+	app.Version = version
+	app.Usage = "Kubernetes CSI driver frontend for convoy"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "endpoint",
+			Value: "unix:///csi/csi.sock",
+			Usage: "CSI endpoint to serve the Identity/Controller/Node gRPC services on",
+		},
+		cli.StringFlag{
+			Name:  "node-id",
+			Usage: "this node's ID, reported by NodeGetInfo and used as the CSI NodeId in publish calls",
+		},
+		cli.StringFlag{
+			Name:  "backup-url",
+			Usage: "destination URL CreateSnapshot/ListSnapshots back up to and list from (e.g. s3://bucket@region/path)",
+		},
+		cli.StringFlag{
+			Name:  "log",
+			Usage: "specific output log file, otherwise output to stderr by default",
+		},
+		cli.StringFlag{
+			Name:  "root",
+			Value: "/var/lib/rancher-volume",
+			Usage: "root directory of the convoy volume manager this driver drives",
+		},
+		cli.StringFlag{
+			Name:  "driver",
+			Value: "devicemapper",
+			Usage: "default driver for volume creation when not overridden per-StorageClass",
+		},
+		cli.StringSliceFlag{
+			Name:  "driver-opts",
+			Value: &cli.StringSlice{},
+			Usage: "options for driver",
+		},
+		cli.StringFlag{
+			Name:  "mounts-dir",
+			Value: "/var/lib/rancher-volume/mounts",
+			Usage: "default directory for mounting volumes",
+		},
+		cli.StringFlag{
+			Name:  "default-volume-size",
+			Value: "10G",
+			Usage: "default size for volume creation when CreateVolume's CapacityRange is unset",
+		},
+	}
+	app.Action = cmdStartCSI
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func cmdStartCSI(c *cli.Context) error {
+	if c.String("node-id") == "" {
+		return fmt.Errorf("--node-id is required")
+	}
+
+	s, cleanup, err := server.LoadOrInitServer(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	logrus.Infof("convoy-csi %v serving %v on %v", version, c.String("node-id"), c.String("endpoint"))
+	return csi.Serve(c.String("endpoint"), version, c.String("node-id"), c.String("backup-url"), s)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/codegangsta/cli"
 	"io/ioutil"
@@ -64,7 +65,7 @@ func doInfo(c *cli.Context) error {
 	return nil
 }
 
-func (s *Server) doInfo(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+func (s *Server) doInfo(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	driver := s.StorageDriver
 	data, err := driver.Info()
 	if err != nil {
@@ -0,0 +1,196 @@
+package csi
+
+import (
+	"context"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/rancher/rancher-volume/server"
+)
+
+// ControllerServer implements the CSI Controller service on top of an
+// already-running *server.Server, so CreateVolume/CreateSnapshot/etc. go
+// through the same volume/backup logic (and per-volume locking) as the
+// HTTP API instead of a second, divergent code path.
+type ControllerServer struct {
+	csi.UnimplementedControllerServer
+
+	server *server.Server
+
+	// backupURL is where CreateSnapshot/ListSnapshots read and write
+	// backups. CSI's ListSnapshotsRequest/CreateSnapshotRequest carry no
+	// destination-URL field of their own (unlike convoy's own backup
+	// API), so this driver is configured with a single backup
+	// destination for the whole cluster instead of taking one per call.
+	backupURL string
+}
+
+func NewControllerServer(s *server.Server, backupURL string) *ControllerServer {
+	return &ControllerServer{server: s, backupURL: backupURL}
+}
+
+func (cs *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	caps := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	}
+	resp := &csi.ControllerGetCapabilitiesResponse{}
+	for _, c := range caps {
+		resp.Capabilities = append(resp.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: c},
+			},
+		})
+	}
+	return resp, nil
+}
+
+// CreateVolume maps to Server.CreateVolume (doVolumeCreate's logic).
+// req.Parameters["driver"] selects the convoy storage driver
+// (devicemapper/ebs/vfs/...); a volume_content_source of type Snapshot
+// restores from a backup, since backups (not device-level snapshots) are
+// convoy's restorable point-in-time objects, so SnapshotId here is
+// actually a backup URL, the same string CreateSnapshot returns.
+func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+
+	size := req.GetCapacityRange().GetRequiredBytes()
+	if size == 0 {
+		size = cs.server.DefaultVolumeSize
+	}
+
+	opts := []server.CreateOption{}
+	if backupURL := req.GetVolumeContentSource().GetSnapshot().GetSnapshotId(); backupURL != "" {
+		opts = append(opts, server.WithBackupURL(backupURL))
+	}
+	if len(req.Parameters) != 0 {
+		opts = append(opts, server.WithLabels(req.Parameters))
+	}
+
+	volume, err := cs.server.CreateVolume(ctx, req.Name, req.Parameters["driver"], size, opts...)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volume.UUID,
+			CapacityBytes: volume.Size,
+		},
+	}, nil
+}
+
+// DeleteVolume maps to Server.DeleteVolume (doVolumeDelete's logic). Per
+// the CSI spec, deleting a volume that's already gone is success, not an
+// error.
+func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id is required")
+	}
+	if cs.server.GetVolume(req.VolumeId) == nil {
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if err := cs.server.DeleteVolume(ctx, req.VolumeId, server.WithForce(true)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume reuses Server.MountVolume (doVolumeMount's
+// logic) to mount the volume at its driver's default mount point, then
+// hands that path back as PublishContext so NodePublishVolume can bind it
+// into the target path the kubelet asks for.
+func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id is required")
+	}
+
+	mountPoint, err := cs.server.MountVolume(req.VolumeId, "")
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{publishContextMountPoint: mountPoint},
+	}, nil
+}
+
+func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id is required")
+	}
+	if err := cs.server.UnmountVolume(req.VolumeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// CreateSnapshot maps to the backup handlers: SourceVolumeId is backed up
+// to cs.backupURL, and the resulting backup URL becomes the SnapshotId.
+func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "source_volume_id is required")
+	}
+	if cs.backupURL == "" {
+		return nil, status.Error(codes.FailedPrecondition, "controller has no backup destination configured")
+	}
+
+	resp, err := cs.server.CreateBackup(ctx, cs.backupURL, req.SourceVolumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     resp.URL,
+			SourceVolumeId: resp.VolumeUUID,
+			CreationTime:   timestamppb.Now(),
+			ReadyToUse:     true,
+		},
+	}, nil
+}
+
+func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot_id is required")
+	}
+	if err := cs.server.DeleteBackup(req.SnapshotId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots uses the same objectstore listing Server.ListBackups
+// (doBackupList's logic) wraps, filtered to req.SourceVolumeId when set.
+func (cs *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if cs.backupURL == "" {
+		return nil, status.Error(codes.FailedPrecondition, "controller has no backup destination configured")
+	}
+
+	urls, err := cs.server.ListBackups(cs.backupURL, req.SourceVolumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &csi.ListSnapshotsResponse{}
+	for _, url := range urls {
+		if req.SnapshotId != "" && req.SnapshotId != url {
+			continue
+		}
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: &csi.Snapshot{
+				SnapshotId:     url,
+				SourceVolumeId: req.SourceVolumeId,
+				ReadyToUse:     true,
+			},
+		})
+	}
+	return resp, nil
+}
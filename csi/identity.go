@@ -0,0 +1,55 @@
+package csi
+
+import (
+	"context"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// pluginName is the value CSI's GetPluginInfo reports, used by the
+// container orchestrator (e.g. Kubernetes' external-provisioner) to look
+// up the StorageClass.Provisioner that routes to this driver.
+const pluginName = "io.rancher.convoy"
+
+// IdentityServer implements the CSI Identity service. It has no
+// dependency on *server.Server: plugin identity/capability information is
+// static, so it's reported without touching the volume manager at all.
+type IdentityServer struct {
+	csi.UnimplementedIdentityServer
+
+	version string
+}
+
+func NewIdentityServer(version string) *IdentityServer {
+	return &IdentityServer{version: version}
+}
+
+func (i *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{
+		Name:          pluginName,
+		VendorVersion: i.version,
+	}, nil
+}
+
+// GetPluginCapabilities reports CONTROLLER_SERVICE only: there's no
+// separate volume-expansion or topology support to advertise yet.
+func (i *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// Probe always reports ready: there's no separate connection to warm up
+// before ControllerServer/NodeServer calls can be served.
+func (i *IdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{Ready: &wrapperspb.BoolValue{Value: true}}, nil
+}
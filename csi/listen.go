@@ -0,0 +1,51 @@
+package csi
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	grpccsi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+
+	"github.com/rancher/rancher-volume/server"
+)
+
+// Serve registers the Identity/Controller/Node services on a gRPC server
+// and blocks serving them on endpoint, a unix:// or tcp:// URL (the CSI
+// spec's own convention, e.g. "unix:///csi/csi.sock"). It's the "second
+// listener" cmd/convoy-csi opens alongside (or instead of) the HTTP API,
+// both backed by the same *server.Server.
+func Serve(endpoint, version, nodeID, backupURL string, s *server.Server) error {
+	l, err := listen(endpoint)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	grpcServer := grpc.NewServer()
+	grpccsi.RegisterIdentityServer(grpcServer, NewIdentityServer(version))
+	grpccsi.RegisterControllerServer(grpcServer, NewControllerServer(s, backupURL))
+	grpccsi.RegisterNodeServer(grpcServer, NewNodeServer(s, nodeID))
+
+	return grpcServer.Serve(l)
+}
+
+// listen parses a unix:// or tcp:// endpoint URL, matching the convention
+// every CSI sidecar (external-provisioner, external-attacher, kubelet)
+// expects a driver's --endpoint flag to accept.
+func listen(endpoint string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(endpoint, "unix://"):
+		path := strings.TrimPrefix(endpoint, "unix://")
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	case strings.HasPrefix(endpoint, "tcp://"):
+		return net.Listen("tcp", strings.TrimPrefix(endpoint, "tcp://"))
+	default:
+		return nil, fmt.Errorf("unsupported CSI endpoint %q, expected a unix:// or tcp:// URL", endpoint)
+	}
+}
@@ -0,0 +1,97 @@
+package csi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rancher/rancher-volume/server"
+)
+
+// publishContextMountPoint is the PublishContext key ControllerPublishVolume
+// stores the driver's mount point under, for NodePublishVolume to bind-mount
+// from.
+const publishContextMountPoint = "mountPoint"
+
+// NodeServer implements the CSI Node service. It doesn't implement
+// NodeStageVolume/NodeUnstageVolume (NodeGetCapabilities reports no
+// STAGE_UNSTAGE_VOLUME capability), so the kubelet calls NodePublishVolume
+// directly with the PublishContext ControllerPublishVolume produced.
+type NodeServer struct {
+	csi.UnimplementedNodeServer
+
+	server *server.Server
+	nodeID string
+}
+
+func NewNodeServer(s *server.Server, nodeID string) *NodeServer {
+	return &NodeServer{server: s, nodeID: nodeID}
+}
+
+// NodePublishVolume reuses the mount Server.MountVolume (doVolumeMount's
+// logic, via ControllerPublishVolume) already made, bind-mounting it at
+// req.TargetPath - the path the kubelet expects the volume's content to
+// show up at.
+func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id is required")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target_path is required")
+	}
+
+	mountPoint := req.PublishContext[publishContextMountPoint]
+	if mountPoint == "" {
+		// No controller plugin ran first (e.g. this driver's Controller
+		// and Node services are reached through different endpoints) -
+		// mount the volume directly, same as ControllerPublishVolume does.
+		var err error
+		mountPoint, err = n.server.MountVolume(req.VolumeId, "")
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if err := os.MkdirAll(req.TargetPath, 0750); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	args := []string{"--bind", mountPoint, req.TargetPath}
+	if req.Readonly {
+		args = append([]string{"-o", "ro"}, args...)
+	}
+	if out, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("bind mount %v -> %v failed: %v: %s", mountPoint, req.TargetPath, err, out))
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (n *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id is required")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target_path is required")
+	}
+
+	if out, err := exec.Command("umount", req.TargetPath).CombinedOutput(); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("umount %v failed: %v: %s", req.TargetPath, err, out))
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetCapabilities reports no capabilities: this driver needs neither
+// staging (no NodeStageVolume) nor volume stats/expansion.
+func (n *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+func (n *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: n.nodeID}, nil
+}
@@ -0,0 +1,96 @@
+// +build linux
+
+package devmapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/pkg/devicemapper"
+	"github.com/rancherio/volmgr/util"
+)
+
+// removeDeviceAndWait removes a /dev/mapper/<name> device, retrying while
+// the kernel reports it busy (udev still holding the node, or a mount
+// race), then blocks until the node has actually disappeared before
+// returning. If UseDeferredRemoval is set, the removal is requested via
+// libdevmapper's deferred-removal API instead, so it completes once
+// whatever's holding the device releases it.
+func (d *Driver) removeDeviceAndWait(name string) error {
+	var err error
+	for i := 0; i < REMOVE_DEVICE_RETRIES; i++ {
+		if d.UseDeferredRemoval {
+			err = devicemapper.RemoveDeviceDeferred(name)
+		} else {
+			err = devicemapper.RemoveDevice(name)
+		}
+		if err != devicemapper.ErrBusy {
+			break
+		}
+		time.Sleep(REMOVE_DEVICE_WAIT_TIME)
+	}
+	if err != nil {
+		return err
+	}
+
+	devPath := filepath.Join(DM_DIR, name)
+	for i := 0; i < REMOVE_DEVICE_RETRIES; i++ {
+		if _, err := os.Stat(devPath); os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(REMOVE_DEVICE_WAIT_TIME)
+	}
+	return fmt.Errorf("timed out waiting for %v to be removed", devPath)
+}
+
+// deleteRegisteredDevice deletes a thin-pool device, or if that fails and
+// UseDeferredDeletion is enabled, records devID as pending so Shutdown can
+// finish the deletion later instead of failing the caller outright. The
+// returned bool reports whether the id was deferred rather than actually
+// freed, so the caller knows not to call markDevIDFree yet.
+func (d *Driver) deleteRegisteredDevice(devID int) (bool, error) {
+	err := devicemapper.DeleteDevice(d.ThinpoolDevice, devID)
+	if err == nil {
+		return false, nil
+	}
+	if !d.UseDeferredDeletion {
+		return false, err
+	}
+	log.Debugf("Deferring deletion of device %v: %v", devID, err)
+	d.PendingDeletion = append(d.PendingDeletion, devID)
+	return true, util.SaveConfig(d.root, d.configName, d.Device)
+}
+
+// cancelDeferredRemoval aborts a pending kernel-side deferred removal of
+// name, called before reactivating a device that might have one
+// outstanding from before a restart. It's a no-op, best-effort call: most
+// of the time there's nothing to cancel.
+func (d *Driver) cancelDeferredRemoval(name string) {
+	if !d.UseDeferredRemoval {
+		return
+	}
+	if err := devicemapper.CancelDeferredRemove(name); err != nil {
+		log.Debugf("Nothing to cancel for deferred removal of %v: %v", name, err)
+	}
+}
+
+// finishDeferredDeletions retries every device id left in PendingDeletion,
+// freeing and forgetting whichever ones finally succeed. Called on
+// Shutdown so a pool doesn't carry pending-deletion devices forever.
+func (d *Driver) finishDeferredDeletions() error {
+	if len(d.PendingDeletion) == 0 {
+		return nil
+	}
+	remaining := d.PendingDeletion[:0]
+	for _, devID := range d.PendingDeletion {
+		if err := devicemapper.DeleteDevice(d.ThinpoolDevice, devID); err != nil {
+			remaining = append(remaining, devID)
+			continue
+		}
+		d.markDevIDFree(devID)
+	}
+	d.PendingDeletion = remaining
+	return util.SaveConfig(d.root, d.configName, d.Device)
+}
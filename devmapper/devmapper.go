@@ -14,6 +14,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	. "github.com/rancherio/volmgr/logging"
 )
@@ -24,10 +25,28 @@ const (
 	DEFAULT_BLOCK_SIZE    = "4096"
 	DM_DIR                = "/dev/mapper/"
 
-	DM_DATA_DEV            = "dm.datadev"
-	DM_METADATA_DEV        = "dm.metadatadev"
-	DM_THINPOOL_NAME       = "dm.thinpoolname"
-	DM_THINPOOL_BLOCK_SIZE = "dm.thinpoolblocksize"
+	DM_DATA_DEV              = "dm.datadev"
+	DM_METADATA_DEV          = "dm.metadatadev"
+	DM_THINPOOL_NAME         = "dm.thinpoolname"
+	DM_THINPOOL_BLOCK_SIZE   = "dm.thinpoolblocksize"
+	DM_USE_DEFERRED_REMOVAL  = "dm.use_deferred_removal"
+	DM_USE_DEFERRED_DELETION = "dm.use_deferred_deletion"
+
+	// removeDeviceAndWait retries a busy RemoveDevice for up to ~10s, then
+	// waits up to ~10s more for the device node to disappear
+	REMOVE_DEVICE_RETRIES   = 1000
+	REMOVE_DEVICE_WAIT_TIME = 10 * time.Millisecond
+
+	// honored in place of dm.datadev/dm.metadatadev when those are
+	// unspecified, to back the thin pool with loopback files instead of
+	// real block devices
+	DM_LOOP_DATA_SIZE     = "dm.loopdatasize"
+	DM_LOOP_METADATA_SIZE = "dm.loopmetadatasize"
+	DM_BASE_FS_SIZE       = "dm.basefssize"
+
+	DEFAULT_LOOP_DATA_SIZE     = 100 * 1024 * 1024 * 1024
+	DEFAULT_LOOP_METADATA_SIZE = 2 * 1024 * 1024 * 1024
+	DEFAULT_BASE_FS_SIZE       = 10 * 1024 * 1024 * 1024
 
 	// as defined in device mapper thin provisioning
 	BLOCK_SIZE_MIN        = 128
@@ -36,6 +55,9 @@ const (
 
 	SECTOR_SIZE = 512
 
+	// thin-pool device ids are a 24 bit field
+	MAX_DEVICE_ID = 0xffffff
+
 	VOLUME_CFG_PREFIX    = "volume_"
 	IMAGE_CFG_PREFIX     = "image_"
 	DEVMAPPER_CFG_PREFIX = DRIVER_NAME + "_"
@@ -80,6 +102,23 @@ type Device struct {
 	ThinpoolSize      int64
 	ThinpoolBlockSize int64
 	LastDevID         int
+	UsedDevID         map[int]bool
+
+	UseDeferredRemoval  bool
+	UseDeferredDeletion bool
+	// PendingDeletion holds thin-pool device ids whose DeleteDevice call
+	// failed (or was deferred) and still needs to be finished on a later
+	// Shutdown, once whatever's holding them clears.
+	PendingDeletion []int
+
+	// DataDeviceFile/MetadataDeviceFile are set when DataDevice/MetadataDevice
+	// are loopback-backed sparse files rather than real block devices, so
+	// they can be reattached after a restart and detached on Shutdown.
+	DataDeviceFile     string
+	MetadataDeviceFile string
+	LoopDataSize       int64
+	LoopMetadataSize   int64
+	BaseFSSize         int64
 }
 
 var (
@@ -138,13 +177,120 @@ func (device *Device) listVolumeIDs() []string {
 	return util.ListConfigIDs(device.Root, DEVMAPPER_CFG_PREFIX+VOLUME_CFG_PREFIX, CFG_POSTFIX)
 }
 
+// rebuildUsedDevID reconstructs the used-device-id set from the volume and
+// snapshot configs on disk, so a crash between allocateDevID and saveVolume
+// doesn't leak the id forever.
+func (device *Device) rebuildUsedDevID() {
+	device.UsedDevID = make(map[int]bool)
+	for _, id := range device.listVolumeIDs() {
+		volume := device.loadVolume(id)
+		if volume == nil {
+			continue
+		}
+		device.UsedDevID[volume.DevID] = true
+		for _, snapshot := range volume.Snapshots {
+			device.UsedDevID[snapshot.DevID] = true
+		}
+	}
+}
+
+// allocateDevID picks the next unused thin-pool device id, wrapping around
+// at MAX_DEVICE_ID instead of growing without bound. It must be followed by
+// either persisting the id's use (via saveVolume/saveVolume's caller) or
+// markDevIDFree on any rollback.
+func (d *Driver) allocateDevID() (int, error) {
+	if d.UsedDevID == nil {
+		d.UsedDevID = make(map[int]bool)
+	}
+	for i := 0; i < MAX_DEVICE_ID; i++ {
+		id := (d.LastDevID+i)%MAX_DEVICE_ID + 1
+		if !d.UsedDevID[id] {
+			d.UsedDevID[id] = true
+			d.LastDevID = id
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no free device id available, thin pool exhausted all %v ids", MAX_DEVICE_ID)
+}
+
+// markDevIDFree releases a device id back to the free list, either because
+// it was never actually committed to a device (a create failed) or because
+// its device was just deleted.
+func (d *Driver) markDevIDFree(devID int) {
+	delete(d.UsedDevID, devID)
+}
+
+// createRegisterDevice allocates a device id and creates the corresponding
+// thin-pool device, retrying with the next free id if devicemapper reports
+// that the id is already in use underneath us. hash identifies the volume
+// the device is being created for, and is recorded in the open transaction
+// so a crash before saveVolume can be detected and rolled back on Init.
+func (d *Driver) createRegisterDevice(hash string) (int, error) {
+	devID, err := d.allocateDevID()
+	if err != nil {
+		return 0, err
+	}
+	if err := d.openTransaction(hash, devID); err != nil {
+		d.markDevIDFree(devID)
+		return 0, err
+	}
+	for {
+		err = devicemapper.CreateDevice(d.ThinpoolDevice, devID)
+		if err == nil {
+			return devID, nil
+		}
+		d.markDevIDFree(devID)
+		if err != devicemapper.ErrDeviceIdExists {
+			return 0, err
+		}
+		devID, err = d.allocateDevID()
+		if err != nil {
+			return 0, err
+		}
+		if err := d.refreshTransaction(devID); err != nil {
+			d.markDevIDFree(devID)
+			return 0, err
+		}
+	}
+}
+
+// parseConfigSize reads an integer-valued config option, falling back to
+// defaultValue if the key wasn't set.
+func parseConfigSize(config map[string]string, key string, defaultValue int64) (int64, error) {
+	value, exists := config[key]
+	if !exists {
+		return defaultValue, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("illegal value for %v: %v", key, value)
+	}
+	return size, nil
+}
+
 func verifyConfig(config map[string]string) (*Device, error) {
 	dv := Device{
 		DataDevice:     config[DM_DATA_DEV],
 		MetadataDevice: config[DM_METADATA_DEV],
 	}
 
-	if dv.DataDevice == "" || dv.MetadataDevice == "" {
+	if dv.DataDevice == "" && dv.MetadataDevice == "" {
+		loopDataSize, err := parseConfigSize(config, DM_LOOP_DATA_SIZE, DEFAULT_LOOP_DATA_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		loopMetadataSize, err := parseConfigSize(config, DM_LOOP_METADATA_SIZE, DEFAULT_LOOP_METADATA_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		baseFSSize, err := parseConfigSize(config, DM_BASE_FS_SIZE, DEFAULT_BASE_FS_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		dv.LoopDataSize = loopDataSize
+		dv.LoopMetadataSize = loopMetadataSize
+		dv.BaseFSSize = baseFSSize
+	} else if dv.DataDevice == "" || dv.MetadataDevice == "" {
 		return nil, fmt.Errorf("data device or metadata device unspecified")
 	}
 
@@ -169,16 +315,30 @@ func verifyConfig(config map[string]string) (*Device, error) {
 
 	dv.ThinpoolBlockSize = blockSize
 
+	if config[DM_USE_DEFERRED_REMOVAL] == "true" {
+		dv.UseDeferredRemoval = true
+	}
+	if config[DM_USE_DEFERRED_DELETION] == "true" {
+		dv.UseDeferredDeletion = true
+	}
+
 	return &dv, nil
 }
 
 func (d *Driver) activatePool() error {
 	dev := d.Device
+	dev.rebuildUsedDevID()
+	d.Device = dev
 	if _, err := os.Stat(dev.ThinpoolDevice); err == nil {
 		log.Debug("Found created pool, skip pool reinit")
 		return nil
 	}
 
+	if err := dev.reattachLoopbackDevices(); err != nil {
+		return err
+	}
+	d.Device = dev
+
 	dataDev, err := os.Open(dev.DataDevice)
 	if err != nil {
 		return err
@@ -229,6 +389,9 @@ func Init(root, cfgName string, config map[string]string) (drivers.Driver, error
 		if err := d.activatePool(); err != nil {
 			return d, err
 		}
+		if err := d.replayTransaction(); err != nil {
+			return d, err
+		}
 		return d, nil
 	}
 
@@ -239,6 +402,12 @@ func Init(root, cfgName string, config map[string]string) (drivers.Driver, error
 
 	dev.Root = root
 
+	if dev.DataDevice == "" {
+		if err := dev.createLoopbackDevices(); err != nil {
+			return nil, err
+		}
+	}
+
 	dataDev, err := os.Open(dev.DataDevice)
 	if err != nil {
 		return nil, err
@@ -256,7 +425,8 @@ func Init(root, cfgName string, config map[string]string) (drivers.Driver, error
 		return nil, err
 	}
 	dev.ThinpoolSize = int64(thinpSize)
-	dev.LastDevID = 1
+	dev.LastDevID = 0
+	dev.UsedDevID = make(map[int]bool)
 
 	err = createPool(filepath.Base(dev.ThinpoolDevice), dataDev, metadataDev, uint32(dev.ThinpoolBlockSize))
 	if err != nil {
@@ -323,16 +493,14 @@ func (d *Driver) CreateVolume(id, baseID string, size int64) error {
 		}
 	}
 
-	devID := d.LastDevID
 	log.WithFields(logrus.Fields{
-		LOG_FIELD_REASON:          LOG_REASON_START,
-		LOG_FIELD_EVENT:           LOG_EVENT_CREATE,
-		LOG_FIELD_OBJECT:          LOG_OBJECT_VOLUME,
-		LOG_FIELD_VOLUME:          id,
-		LOG_FIELD_IMAGE:           baseID,
-		DM_LOG_FIELD_VOLUME_DEVID: devID,
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: id,
+		LOG_FIELD_IMAGE:  baseID,
 	}).Debugf("Creating volume")
-	err := devicemapper.CreateDevice(d.ThinpoolDevice, devID)
+	devID, err := d.createRegisterDevice(id)
 	if err != nil {
 		return err
 	}
@@ -345,6 +513,7 @@ func (d *Driver) CreateVolume(id, baseID string, size int64) error {
 		LOG_FIELD_IMAGE:           baseID,
 		DM_LOG_FIELD_VOLUME_DEVID: devID,
 	}).Debugf("Activating device for volume")
+	d.cancelDeferredRemoval(id)
 	if image == nil {
 		err = devicemapper.ActivateDevice(d.ThinpoolDevice, id, devID, uint64(size))
 	} else {
@@ -369,6 +538,10 @@ func (d *Driver) CreateVolume(id, baseID string, size int64) error {
 				DM_LOG_FIELD_VOLUME_DEVID: devID,
 			}).Debugf("Failed to remove device")
 		}
+		d.markDevIDFree(devID)
+		if txnErr := d.closeTransaction(); txnErr != nil {
+			log.Errorf("Failed to close devmapper transaction: %v", txnErr)
+		}
 		return err
 	}
 
@@ -388,12 +561,11 @@ func (d *Driver) CreateVolume(id, baseID string, size int64) error {
 	if err := d.saveVolume(volume); err != nil {
 		return err
 	}
-	d.LastDevID++
 
 	if err := util.SaveConfig(d.root, d.configName, d.Device); err != nil {
 		return err
 	}
-	return nil
+	return d.closeTransaction()
 }
 
 func (d *Driver) DeleteVolume(id string) error {
@@ -415,7 +587,7 @@ func (d *Driver) DeleteVolume(id string) error {
 		}
 	}
 
-	if err = devicemapper.RemoveDevice(id); err != nil {
+	if err = d.removeDeviceAndWait(id); err != nil {
 		return err
 	}
 
@@ -426,10 +598,19 @@ func (d *Driver) DeleteVolume(id string) error {
 		LOG_FIELD_VOLUME:          id,
 		DM_LOG_FIELD_VOLUME_DEVID: volume.DevID,
 	}).Debugf("Deleting device")
-	err = devicemapper.DeleteDevice(d.ThinpoolDevice, volume.DevID)
+	if err := d.openTransaction(id, volume.DevID); err != nil {
+		return err
+	}
+	deferred, err := d.deleteRegisteredDevice(volume.DevID)
 	if err != nil {
 		return err
 	}
+	if !deferred {
+		d.markDevIDFree(volume.DevID)
+	}
+	if err := util.SaveConfig(d.root, d.configName, d.Device); err != nil {
+		return err
+	}
 
 	if volume.Base != "" {
 		image := d.loadImage(volume.Base)
@@ -450,7 +631,7 @@ func (d *Driver) DeleteVolume(id string) error {
 	if err := d.deleteVolume(id); err != nil {
 		return err
 	}
-	return nil
+	return d.closeTransaction()
 }
 
 func getVolumeSnapshotInfo(uuid string, volume *Volume, snapshotID string) *api.DeviceMapperVolume {
@@ -519,8 +700,6 @@ func (d *Driver) CreateSnapshot(id, volumeID string) error {
 			LOG_FIELD_VOLUME: volumeID,
 		}, "Cannot find volume")
 	}
-	devID := d.LastDevID
-
 	snapshot, exists := volume.Snapshots[id]
 	if exists {
 		return generateError(logrus.Fields{
@@ -529,6 +708,15 @@ func (d *Driver) CreateSnapshot(id, volumeID string) error {
 		}, "Already has snapshot with uuid")
 	}
 
+	devID, err := d.allocateDevID()
+	if err != nil {
+		return err
+	}
+	if err := d.openTransaction(volumeID, devID); err != nil {
+		d.markDevIDFree(devID)
+		return err
+	}
+
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:            LOG_REASON_START,
 		LOG_FIELD_EVENT:             LOG_EVENT_CREATE,
@@ -538,8 +726,12 @@ func (d *Driver) CreateSnapshot(id, volumeID string) error {
 		DM_LOG_FIELD_VOLUME_DEVID:   volume.DevID,
 		DM_LOG_FIELD_SNAPSHOT_DEVID: devID,
 	}).Debugf("Creating snapshot")
-	err := devicemapper.CreateSnapDevice(d.ThinpoolDevice, devID, volumeID, volume.DevID)
+	err = devicemapper.CreateSnapDevice(d.ThinpoolDevice, devID, volumeID, volume.DevID)
 	if err != nil {
+		d.markDevIDFree(devID)
+		if txnErr := d.closeTransaction(); txnErr != nil {
+			log.Errorf("Failed to close devmapper transaction: %v", txnErr)
+		}
 		return err
 	}
 	log.Debugf("Created snapshot device")
@@ -549,7 +741,6 @@ func (d *Driver) CreateSnapshot(id, volumeID string) error {
 		Activated: false,
 	}
 	volume.Snapshots[id] = snapshot
-	d.LastDevID++
 
 	if err := d.saveVolume(volume); err != nil {
 		return err
@@ -557,7 +748,7 @@ func (d *Driver) CreateSnapshot(id, volumeID string) error {
 	if err := util.SaveConfig(d.root, d.configName, d.Device); err != nil {
 		return err
 	}
-	return nil
+	return d.closeTransaction()
 }
 
 func (d *Driver) DeleteSnapshot(id, volumeID string) error {
@@ -573,17 +764,26 @@ func (d *Driver) DeleteSnapshot(id, volumeID string) error {
 		LOG_FIELD_SNAPSHOT: id,
 		LOG_FIELD_VOLUME:   volumeID,
 	}).Debugf("Deleting snapshot for volume")
-	err = devicemapper.DeleteDevice(d.ThinpoolDevice, snapshot.DevID)
+	if err := d.openTransaction(volumeID, snapshot.DevID); err != nil {
+		return err
+	}
+	deferred, err := d.deleteRegisteredDevice(snapshot.DevID)
 	if err != nil {
 		return err
 	}
 	log.Debug("Deleted snapshot device")
 	delete(volume.Snapshots, id)
+	if !deferred {
+		d.markDevIDFree(snapshot.DevID)
+	}
 
 	if err = d.saveVolume(volume); err != nil {
 		return err
 	}
-	return nil
+	if err = util.SaveConfig(d.root, d.configName, d.Device); err != nil {
+		return err
+	}
+	return d.closeTransaction()
 }
 
 func (d *Driver) CompareSnapshot(id, compareID, volumeID string) (*metadata.Mappings, error) {
@@ -668,6 +868,7 @@ func (d *Driver) OpenSnapshot(id, volumeID string) error {
 		LOG_FIELD_SIZE:              volume.Size,
 		DM_LOG_FIELD_SNAPSHOT_DEVID: snapshot.DevID,
 	}).Debug()
+	d.cancelDeferredRemoval(id)
 	if err = devicemapper.ActivateDevice(d.ThinpoolDevice, id, snapshot.DevID, uint64(volume.Size)); err != nil {
 		return err
 	}
@@ -688,7 +889,7 @@ func (d *Driver) CloseSnapshot(id, volumeID string) error {
 		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
 		LOG_FIELD_SNAPSHOT: id,
 	}).Debug()
-	if err := devicemapper.RemoveDevice(id); err != nil {
+	if err := d.removeDeviceAndWait(id); err != nil {
 		return err
 	}
 	snapshot.Activated = false
@@ -846,6 +1047,9 @@ func (d *Driver) DeactivateImage(imageUUID string) error {
 }
 
 func (d *Driver) Shutdown() error {
+	if err := d.finishDeferredDeletions(); err != nil {
+		return err
+	}
 	return d.deactivatePool()
 }
 
@@ -870,7 +1074,7 @@ func (d *Driver) deactivatePool() error {
 				LOG_FIELD_VOLUME: id,
 			}, "Cannot find volume")
 		}
-		if err := devicemapper.RemoveDevice(id); err != nil {
+		if err := d.removeDeviceAndWait(id); err != nil {
 			return err
 		}
 		log.WithFields(logrus.Fields{
@@ -883,5 +1087,9 @@ func (d *Driver) deactivatePool() error {
 		return err
 	}
 	log.Debug("Deactivate the pool ", dev.ThinpoolDevice)
+
+	if err := dev.detachLoopbackDevices(); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,97 @@
+// +build linux
+
+package devmapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/devicemapper"
+	"github.com/rancherio/volmgr/util"
+
+	. "github.com/rancherio/volmgr/logging"
+)
+
+// ResizeVolume grows a volume to newSize by reloading its DM table at the
+// larger length, without moving any existing data. Shrinking isn't
+// supported.
+func (d *Driver) ResizeVolume(id string, newSize int64) error {
+	if newSize%(d.ThinpoolBlockSize*SECTOR_SIZE) != 0 {
+		return fmt.Errorf("Size must be multiple of block size")
+	}
+	volume := d.loadVolume(id)
+	if volume == nil {
+		return generateError(logrus.Fields{
+			LOG_FIELD_VOLUME: id,
+		}, "cannot find volume")
+	}
+	if newSize <= volume.Size {
+		return generateError(logrus.Fields{
+			LOG_FIELD_VOLUME: id,
+			LOG_FIELD_SIZE:   newSize,
+		}, "new size must be larger than current size %v", volume.Size)
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:          LOG_REASON_START,
+		LOG_FIELD_EVENT:           LOG_EVENT_ACTIVATE,
+		LOG_FIELD_OBJECT:          LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME:          id,
+		LOG_FIELD_SIZE:            newSize,
+		DM_LOG_FIELD_VOLUME_DEVID: volume.DevID,
+	}).Debugf("Resizing volume")
+
+	if err := d.removeDeviceAndWait(id); err != nil {
+		return err
+	}
+	if err := devicemapper.ActivateDevice(d.ThinpoolDevice, id, volume.DevID, uint64(newSize)); err != nil {
+		return err
+	}
+
+	volume.Size = newSize
+	return d.saveVolume(volume)
+}
+
+// ResizePool picks up growth of the underlying data device (e.g. an LVM
+// volume or LUN that was extended out of band) by re-reading its size and
+// reloading the thin pool's DM table at the new length. Shrinking isn't
+// supported.
+func (d *Driver) ResizePool() error {
+	dataDev, err := os.Open(d.DataDevice)
+	if err != nil {
+		return err
+	}
+	defer dataDev.Close()
+
+	newSize, err := devicemapper.GetBlockDeviceSize(dataDev)
+	if err != nil {
+		return err
+	}
+	if int64(newSize) <= d.ThinpoolSize {
+		return generateError(logrus.Fields{
+			LOG_FIELD_SIZE: newSize,
+		}, "new pool size must be larger than current size %v", d.ThinpoolSize)
+	}
+
+	metadataDev, err := os.Open(d.MetadataDevice)
+	if err != nil {
+		return err
+	}
+	defer metadataDev.Close()
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_ACTIVATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_DRIVER,
+		LOG_FIELD_SIZE:   newSize,
+	}).Debugf("Resizing thin pool")
+
+	if err := devicemapper.ReloadPool(filepath.Base(d.ThinpoolDevice), dataDev, metadataDev, uint32(d.ThinpoolBlockSize)); err != nil {
+		return err
+	}
+
+	d.ThinpoolSize = int64(newSize)
+	return util.SaveConfig(d.root, d.configName, d.Device)
+}
@@ -0,0 +1,100 @@
+// +build linux
+
+package devmapper
+
+import (
+	"github.com/docker/docker/pkg/devicemapper"
+	"github.com/rancherio/volmgr/util"
+)
+
+const (
+	TRANSACTION_CFG_NAME = "devmapper_transaction.json"
+)
+
+// Transaction records a single in-flight thin-pool device mutation (create
+// or delete) so a crash between the libdevmapper call and the matching
+// saveVolume/SaveConfig can be detected and repaired the next time Init
+// runs. Hash is the UUID of the volume that owns DevID, whether DevID
+// belongs to the volume itself or to one of its snapshots.
+type Transaction struct {
+	DevID int
+	Hash  string
+}
+
+// openTransaction records that DevID is about to be created or deleted on
+// behalf of the volume identified by hash, before libdevmapper is invoked.
+func (d *Driver) openTransaction(hash string, devID int) error {
+	txn := Transaction{
+		DevID: devID,
+		Hash:  hash,
+	}
+	return util.SaveConfig(d.root, TRANSACTION_CFG_NAME, &txn)
+}
+
+// refreshTransaction updates the device id of the currently open
+// transaction, used when createRegisterDevice retries with a new id after
+// devicemapper reports DeviceIdExists.
+func (d *Driver) refreshTransaction(devID int) error {
+	if !util.ConfigExists(d.root, TRANSACTION_CFG_NAME) {
+		return nil
+	}
+	txn := Transaction{}
+	if err := util.LoadConfig(d.root, TRANSACTION_CFG_NAME, &txn); err != nil {
+		return err
+	}
+	txn.DevID = devID
+	return util.SaveConfig(d.root, TRANSACTION_CFG_NAME, &txn)
+}
+
+// closeTransaction clears the in-flight transaction once the matching
+// saveVolume/SaveConfig has landed. It's a no-op if none is open.
+func (d *Driver) closeTransaction() error {
+	if !util.ConfigExists(d.root, TRANSACTION_CFG_NAME) {
+		return nil
+	}
+	return util.RemoveConfig(d.root, TRANSACTION_CFG_NAME)
+}
+
+// replayTransaction repairs whatever a leftover transaction file says was
+// in flight when the process died. It compares DevID against the volume's
+// currently saved config: if the config (volume or one of its snapshots)
+// already references DevID, the mutation committed and any missing device
+// is recreated; otherwise the device, if it exists at all, is an orphan
+// and is deleted with its id freed.
+func (d *Driver) replayTransaction() error {
+	if !util.ConfigExists(d.root, TRANSACTION_CFG_NAME) {
+		return nil
+	}
+	txn := Transaction{}
+	if err := util.LoadConfig(d.root, TRANSACTION_CFG_NAME, &txn); err != nil {
+		return err
+	}
+
+	committed := false
+	if volume := d.loadVolume(txn.Hash); volume != nil {
+		if volume.DevID == txn.DevID {
+			committed = true
+		}
+		for _, snapshot := range volume.Snapshots {
+			if snapshot.DevID == txn.DevID {
+				committed = true
+			}
+		}
+	}
+
+	if committed {
+		if err := devicemapper.CreateDevice(d.ThinpoolDevice, txn.DevID); err != nil && err != devicemapper.ErrDeviceIdExists {
+			return err
+		}
+		d.UsedDevID[txn.DevID] = true
+		log.Debugf("Replayed transaction: recreated device %v for %v missing after crash", txn.DevID, txn.Hash)
+	} else {
+		if err := devicemapper.DeleteDevice(d.ThinpoolDevice, txn.DevID); err != nil {
+			log.Debugf("Replayed transaction: no orphan device %v to clean up for %v", txn.DevID, txn.Hash)
+		}
+		d.markDevIDFree(txn.DevID)
+		log.Debugf("Replayed transaction: freed orphan device id %v for %v", txn.DevID, txn.Hash)
+	}
+
+	return d.closeTransaction()
+}
@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"fmt"
+
+	"github.com/rancher/rancher-volume/storagedriver"
+)
+
+// Driver is the interface every Convoy storage backend implements so the
+// server package can treat built-in drivers (devicemapper, vfs, ebs, ...)
+// and out-of-process plugin-backed drivers identically.
+type Driver interface {
+	Name() string
+	VolumeOps() (storagedriver.VolumeOperations, error)
+}
+
+// InitFunc creates a Driver from its on-disk config plus any
+// driver-specific options (e.g. --driver-opts key=value), the same shape
+// each built-in driver's own Init function already takes.
+type InitFunc func(root string, config map[string]string) (Driver, error)
+
+var initializers = map[string]InitFunc{}
+
+// Register makes a driver available to GetDriver under name. Built-in
+// drivers call this from an init() in their own package.
+func Register(name string, initFunc InitFunc) {
+	initializers[name] = initFunc
+}
+
+// GetDriver initializes (or reloads from its saved config) the driver
+// registered under name.
+func GetDriver(name, root string, config map[string]string) (Driver, error) {
+	initFunc, ok := initializers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported driver %v", name)
+	}
+	return initFunc(root, config)
+}
+
+// CheckEnvironment lets a driver verify its runtime dependencies (kernel
+// modules, binaries on PATH, ...) are present before the server starts
+// serving requests. Drivers with nothing to check simply don't implement
+// the optional interface below.
+func CheckEnvironment(d Driver) error {
+	if checker, ok := d.(interface {
+		CheckEnvironment() error
+	}); ok {
+		return checker.CheckEnvironment()
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package ebs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/rancher-volume/driver"
+	"github.com/rancher/rancher-volume/storagedriver"
+	"github.com/rancher/rancher-volume/util"
+)
+
+const (
+	DRIVER_NAME = "ebs"
+
+	DRIVER_CFG_FILE   = "ebs.cfg"
+	VOLUME_CFG_PREFIX = "ebs_volume_"
+	CFG_POSTFIX       = ".json"
+
+	DEFAULT_FS = "ext4"
+
+	// driver-opts keys: "convoy server --driver ebs --driver-opts
+	// ebs.encrypted=true --driver-opts ebs.iops=4000 ..." configures every
+	// volume this Driver creates the same way, since VolumeOperations.
+	// CreateVolume takes no per-call options of its own.
+	optEncrypted  = "ebs.encrypted"
+	optKmsKeyId   = "ebs.kmskeyid"
+	optVolumeType = "ebs.volumetype"
+	optIops       = "ebs.iops"
+	optThroughput = "ebs.throughput"
+	optTagPrefix  = "ebs.tag."
+)
+
+// Config is the Driver's own on-disk state: where it mounts volumes, and
+// the EBSVolumeOptions applied to every volume and snapshot it creates.
+type Config struct {
+	Root      string
+	MountsDir string
+	Options   EBSVolumeOptions
+}
+
+// volumeInfo is the on-disk record of a volume this Driver created, so
+// MountVolume/UmountVolume/DeleteVolume can find its EBS volume id,
+// attached device and mount point again after a restart instead of
+// reconstructing them from EC2 state.
+type volumeInfo struct {
+	UUID        string
+	EBSVolumeID string
+	Device      string
+	MountPoint  string
+	Size        int64
+}
+
+// Driver adapts EBSService to driver.Driver/storagedriver.VolumeOperations,
+// the way devmapper.Driver adapts the devicemapper thin pool, so EBS
+// volumes can be created, mounted and unmounted through "convoy server
+// --driver ebs" instead of only through the ebs package's own tests.
+type Driver struct {
+	Config
+	service *EBSService
+}
+
+func init() {
+	driver.Register(DRIVER_NAME, Init)
+}
+
+func parseOptions(config map[string]string) EBSVolumeOptions {
+	opts := EBSVolumeOptions{
+		Encrypted:  config[optEncrypted] == "true",
+		KmsKeyId:   config[optKmsKeyId],
+		VolumeType: config[optVolumeType],
+	}
+	if v, err := strconv.ParseInt(config[optIops], 10, 64); err == nil {
+		opts.Iops = v
+	}
+	if v, err := strconv.ParseInt(config[optThroughput], 10, 64); err == nil {
+		opts.Throughput = v
+	}
+	tags := map[string]string{}
+	for k, v := range config {
+		if strings.HasPrefix(k, optTagPrefix) {
+			tags[strings.TrimPrefix(k, optTagPrefix)] = v
+		}
+	}
+	if len(tags) != 0 {
+		opts.Tags = tags
+	}
+	return opts
+}
+
+// Init loads this Driver's config from root if it's been initialized
+// there before, otherwise parses config (this driver's --driver-opts) into
+// a Config and persists it, the same init-or-reload shape devmapper.Init
+// and server.initServer/loadServerConfig already use.
+func Init(root string, config map[string]string) (driver.Driver, error) {
+	service, err := NewEBSService()
+	if err != nil {
+		return nil, err
+	}
+	d := &Driver{service: service}
+
+	if util.ConfigExists(root, DRIVER_CFG_FILE) {
+		if err := util.LoadConfig(root, DRIVER_CFG_FILE, &d.Config); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	mountsDir := config["mounts-dir"]
+	if mountsDir == "" {
+		mountsDir = filepath.Join(root, "mounts")
+	}
+	if err := util.MkdirIfNotExists(mountsDir); err != nil {
+		return nil, err
+	}
+
+	d.Config = Config{
+		Root:      root,
+		MountsDir: mountsDir,
+		Options:   parseOptions(config),
+	}
+	if err := util.SaveConfig(root, DRIVER_CFG_FILE, &d.Config); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Driver) Name() string {
+	return DRIVER_NAME
+}
+
+func (d *Driver) VolumeOps() (storagedriver.VolumeOperations, error) {
+	return d, nil
+}
+
+func (d *Driver) volumeCfgName(id string) string {
+	return VOLUME_CFG_PREFIX + id + CFG_POSTFIX
+}
+
+func (d *Driver) loadVolume(id string) (*volumeInfo, error) {
+	if !util.ConfigExists(d.Root, d.volumeCfgName(id)) {
+		return nil, fmt.Errorf("volume %v doesn't exist", id)
+	}
+	v := &volumeInfo{}
+	if err := util.LoadConfig(d.Root, d.volumeCfgName(id), v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (d *Driver) saveVolume(v *volumeInfo) error {
+	return util.SaveConfig(d.Root, d.volumeCfgName(v.UUID), v)
+}
+
+// CreateVolume creates a new EBS volume with this Driver's configured
+// EBSVolumeOptions and records it under id, Convoy's own volume UUID.
+func (d *Driver) CreateVolume(id string, size int64) error {
+	if util.ConfigExists(d.Root, d.volumeCfgName(id)) {
+		return fmt.Errorf("volume %v already exists", id)
+	}
+
+	volumeID, err := d.service.CreateVolume(size, "", d.Options)
+	if err != nil {
+		return err
+	}
+
+	return d.saveVolume(&volumeInfo{
+		UUID:        id,
+		EBSVolumeID: volumeID,
+		Size:        size,
+	})
+}
+
+// DeleteVolume deletes id's EBS volume. The volume must be unmounted
+// first, the same precondition devmapper.Driver.DeleteVolume enforces
+// through its own snapshot/device bookkeeping.
+func (d *Driver) DeleteVolume(id string) error {
+	v, err := d.loadVolume(id)
+	if err != nil {
+		return err
+	}
+	if v.MountPoint != "" {
+		return fmt.Errorf("volume %v is still mounted at %v", id, v.MountPoint)
+	}
+
+	if err := d.service.DeleteVolume(v.EBSVolumeID); err != nil {
+		return err
+	}
+	return util.RemoveConfig(d.Root, d.volumeCfgName(id))
+}
+
+// MountVolume attaches id's EBS volume to this instance, formats it on
+// first use, and mounts it at opts[storagedriver.OPTS_MOUNT_POINT] or a
+// path under MountsDir if that's unset.
+func (d *Driver) MountVolume(id string, opts map[string]string) (string, error) {
+	v, err := d.loadVolume(id)
+	if err != nil {
+		return "", err
+	}
+	if v.MountPoint != "" {
+		return v.MountPoint, nil
+	}
+
+	device := v.Device
+	if device == "" {
+		// Not attached yet. If this step already ran and a later one
+		// (format/mount) failed, v.Device is already set and a retry
+		// must not attach an already-attached volume again.
+		device, err = d.service.AttachVolume(v.EBSVolumeID, v.Size)
+		if err != nil {
+			return "", err
+		}
+		v.Device = device
+		if err := d.saveVolume(v); err != nil {
+			return "", err
+		}
+	}
+
+	if err := formatIfUnformatted(device); err != nil {
+		return "", err
+	}
+
+	mountPoint := opts[storagedriver.OPTS_MOUNT_POINT]
+	if mountPoint == "" {
+		mountPoint = filepath.Join(d.MountsDir, id)
+	}
+	if err := util.MkdirIfNotExists(mountPoint); err != nil {
+		return "", err
+	}
+	if out, err := exec.Command("mount", device, mountPoint).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("mount %v -> %v failed: %v: %s", device, mountPoint, err, out)
+	}
+
+	v.MountPoint = mountPoint
+	if err := d.saveVolume(v); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+// UmountVolume unmounts id's EBS volume if it's mounted and detaches it if
+// it's attached; it's a no-op if the volume is neither. Each step is persisted as soon as it
+// succeeds, so a retry after a failed detach doesn't re-run umount on a
+// path that's already been unmounted.
+func (d *Driver) UmountVolume(id string) error {
+	v, err := d.loadVolume(id)
+	if err != nil {
+		return err
+	}
+
+	if v.MountPoint != "" {
+		if out, err := exec.Command("umount", v.MountPoint).CombinedOutput(); err != nil {
+			return fmt.Errorf("umount %v failed: %v: %s", v.MountPoint, err, out)
+		}
+		v.MountPoint = ""
+		if err := d.saveVolume(v); err != nil {
+			return err
+		}
+	}
+
+	if v.Device != "" {
+		if err := d.service.DetachVolume(v.EBSVolumeID); err != nil {
+			return err
+		}
+		v.Device = ""
+		if err := d.saveVolume(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Driver) MountPoint(id string) (string, error) {
+	v, err := d.loadVolume(id)
+	if err != nil {
+		return "", err
+	}
+	return v.MountPoint, nil
+}
+
+// ListVolume returns opts's volume, or every volume this Driver knows
+// about if opts is empty, as a JSON-encoded id -> volumeInfo map.
+func (d *Driver) ListVolume(opts string) ([]byte, error) {
+	ids := []string{opts}
+	if opts == "" {
+		var err error
+		ids, err = util.ListConfigIDs(d.Root, VOLUME_CFG_PREFIX, CFG_POSTFIX)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	volumes := map[string]volumeInfo{}
+	for _, id := range ids {
+		v, err := d.loadVolume(id)
+		if err != nil {
+			return nil, err
+		}
+		volumes[id] = *v
+	}
+	return json.Marshal(volumes)
+}
+
+// formatIfUnformatted runs mkfs on device unless blkid already reports a
+// filesystem, so MountVolume is safe to call on both a brand new volume
+// and one already formatted on a previous attach. blkid exits 2
+// specifically to mean "no filesystem/partition signature found"; any
+// other failure (missing binary, device busy, ...) is a real error, not
+// a license to reformat a device that might already hold data.
+func formatIfUnformatted(device string) error {
+	out, err := exec.Command("blkid", device).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 {
+		return fmt.Errorf("blkid %v failed: %v: %s", device, err, out)
+	}
+
+	if out, err := exec.Command("mkfs", "-t", DEFAULT_FS, device).CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs %v failed: %v: %s", device, err, out)
+	}
+	return nil
+}
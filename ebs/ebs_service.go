@@ -0,0 +1,314 @@
+// Package ebs implements the EC2 API calls needed to manage EBS volumes
+// and snapshots as rancher-volume block devices, and (in driver.go) the
+// driver.Driver/storagedriver.VolumeOperations adapter that registers
+// them as "convoy server --driver ebs".
+package ebs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	GB = 1024 * 1024 * 1024
+
+	DEFAULT_VOLUME_TYPE = "gp2"
+
+	devicePrefix    = "/dev/sd"
+	firstDeviceName = 'f'
+	lastDeviceName  = 'p'
+
+	waitInterval = 2 * time.Second
+	waitTimeout  = 5 * time.Minute
+)
+
+var log = logrus.WithFields(logrus.Fields{"pkg": "ebs"})
+
+// EBSVolumeOptions carries the optional, provider-specific knobs for
+// creating an EBS volume or snapshot: encryption, provisioned
+// performance, and the tags applied right after creation so managed
+// resources are discoverable in the AWS console.
+type EBSVolumeOptions struct {
+	Encrypted  bool
+	KmsKeyId   string
+	VolumeType string
+	Iops       int64
+	Throughput int64
+	Tags       map[string]string
+}
+
+// EBSService wraps the EC2 API calls needed to manage EBS volumes and
+// snapshots as rancher-volume block devices on an EC2 instance.
+type EBSService struct {
+	Region           string
+	AvailabilityZone string
+	InstanceID       string
+
+	ec2 *ec2.EC2
+}
+
+// NewEBSService creates an EBSService for the EC2 instance it's running
+// on, using the instance metadata service to discover the region,
+// availability zone and instance id.
+func NewEBSService() (*EBSService, error) {
+	sess := session.New()
+	meta := ec2metadata.New(sess)
+
+	az, err := meta.GetMetadata("placement/availability-zone")
+	if err != nil {
+		return nil, err
+	}
+	instanceID, err := meta.GetMetadata("instance-id")
+	if err != nil {
+		return nil, err
+	}
+	region := az[:len(az)-1]
+
+	return &EBSService{
+		Region:           region,
+		AvailabilityZone: az,
+		InstanceID:       instanceID,
+		ec2:              ec2.New(sess, aws.NewConfig().WithRegion(region)),
+	}, nil
+}
+
+// getBlkDevList returns the set of block device names currently visible
+// under /sys/block.
+func getBlkDevList() (map[string]bool, error) {
+	entries, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+	devList := map[string]bool{}
+	for _, entry := range entries {
+		devList[entry.Name()] = true
+	}
+	return devList, nil
+}
+
+// getInstanceDevList returns the device-name -> volume-id mapping EC2
+// reports for every volume currently attached to this instance.
+func (s *EBSService) getInstanceDevList() (map[string]string, error) {
+	resp, err := s.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(s.InstanceID)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	devMap := map[string]string{}
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			for _, bdm := range instance.BlockDeviceMappings {
+				if bdm.Ebs == nil {
+					continue
+				}
+				devMap[aws.StringValue(bdm.DeviceName)] = aws.StringValue(bdm.Ebs.VolumeId)
+			}
+		}
+	}
+	return devMap, nil
+}
+
+func applyTags(tagFunc func(*ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error), resourceID string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	ec2Tags := make([]*ec2.Tag, 0, len(tags))
+	for k, v := range tags {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	_, err := tagFunc(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(resourceID)},
+		Tags:      ec2Tags,
+	})
+	return err
+}
+
+// CreateVolume creates an EBS volume of size bytes (rounded up to the
+// nearest GiB, as required by the EC2 API) in the instance's own
+// availability zone, optionally from snapshotID, applying opts for
+// encryption/performance/tags.
+func (s *EBSService) CreateVolume(size int64, snapshotID string, opts EBSVolumeOptions) (string, error) {
+	volumeType := opts.VolumeType
+	if volumeType == "" {
+		volumeType = DEFAULT_VOLUME_TYPE
+	}
+
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(s.AvailabilityZone),
+		Size:             aws.Int64((size + GB - 1) / GB),
+		VolumeType:       aws.String(volumeType),
+	}
+	if snapshotID != "" {
+		input.SnapshotId = aws.String(snapshotID)
+	}
+	if opts.Encrypted {
+		input.Encrypted = aws.Bool(true)
+		if opts.KmsKeyId != "" {
+			input.KmsKeyId = aws.String(opts.KmsKeyId)
+		}
+	}
+	if opts.Iops != 0 {
+		input.Iops = aws.Int64(opts.Iops)
+	}
+	if opts.Throughput != 0 {
+		input.Throughput = aws.Int64(opts.Throughput)
+	}
+
+	resp, err := s.ec2.CreateVolume(input)
+	if err != nil {
+		return "", err
+	}
+	volumeID := aws.StringValue(resp.VolumeId)
+
+	if err := s.waitForVolumeState(volumeID, "available"); err != nil {
+		return "", err
+	}
+	if err := applyTags(s.ec2.CreateTags, volumeID, opts.Tags); err != nil {
+		return "", err
+	}
+
+	log.WithFields(logrus.Fields{
+		"volume":     volumeID,
+		"size":       size,
+		"snapshotID": snapshotID,
+	}).Debug("Created EBS volume")
+	return volumeID, nil
+}
+
+func (s *EBSService) waitForVolumeState(volumeID, state string) error {
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := s.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Volumes) != 0 && aws.StringValue(resp.Volumes[0].State) == state {
+			return nil
+		}
+		time.Sleep(waitInterval)
+	}
+	return fmt.Errorf("timed out waiting for volume %v to reach state %v", volumeID, state)
+}
+
+// AttachVolume attaches volumeID to this instance at the first free
+// device name in the /dev/sdf.../dev/sdp range and returns that device
+// path once EC2 reports the volume in-use. It does not wait for the
+// kernel's device node to appear, and does not check which name the kernel
+// actually gave the device.
+func (s *EBSService) AttachVolume(volumeID string, size int64) (string, error) {
+	devList, err := s.getInstanceDevList()
+	if err != nil {
+		return "", err
+	}
+	var device string
+	for c := firstDeviceName; c <= lastDeviceName; c++ {
+		candidate := fmt.Sprintf("%s%c", devicePrefix, c)
+		if _, taken := devList[candidate]; !taken {
+			device = candidate
+			break
+		}
+	}
+	if device == "" {
+		return "", fmt.Errorf("no free device name available on instance %v", s.InstanceID)
+	}
+
+	_, err = s.ec2.AttachVolume(&ec2.AttachVolumeInput{
+		VolumeId:   aws.String(volumeID),
+		InstanceId: aws.String(s.InstanceID),
+		Device:     aws.String(device),
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := s.waitForVolumeState(volumeID, "in-use"); err != nil {
+		return "", err
+	}
+
+	log.WithFields(logrus.Fields{
+		"volume": volumeID,
+		"device": device,
+	}).Debug("Attached EBS volume")
+	return device, nil
+}
+
+// DetachVolume detaches volumeID from this instance and waits for it to
+// become available again.
+func (s *EBSService) DetachVolume(volumeID string) error {
+	_, err := s.ec2.DetachVolume(&ec2.DetachVolumeInput{
+		VolumeId:   aws.String(volumeID),
+		InstanceId: aws.String(s.InstanceID),
+	})
+	if err != nil {
+		return err
+	}
+	return s.waitForVolumeState(volumeID, "available")
+}
+
+// DeleteVolume deletes volumeID.
+func (s *EBSService) DeleteVolume(volumeID string) error {
+	_, err := s.ec2.DeleteVolume(&ec2.DeleteVolumeInput{
+		VolumeId: aws.String(volumeID),
+	})
+	return err
+}
+
+// CreateSnapshot snapshots volumeID, applying opts.Tags to the resulting
+// snapshot so it's discoverable in the AWS console alongside the volume
+// it came from.
+func (s *EBSService) CreateSnapshot(volumeID, description string, opts EBSVolumeOptions) (string, error) {
+	resp, err := s.ec2.CreateSnapshot(&ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(volumeID),
+		Description: aws.String(description),
+	})
+	if err != nil {
+		return "", err
+	}
+	snapshotID := aws.StringValue(resp.SnapshotId)
+
+	if err := applyTags(s.ec2.CreateTags, snapshotID, opts.Tags); err != nil {
+		return "", err
+	}
+
+	log.WithFields(logrus.Fields{
+		"volume":   volumeID,
+		"snapshot": snapshotID,
+	}).Debug("Created EBS snapshot")
+	return snapshotID, nil
+}
+
+// WaitForSnapshotComplete blocks until snapshotID finishes its initial
+// upload to S3 and reaches the "completed" state.
+func (s *EBSService) WaitForSnapshotComplete(snapshotID string) error {
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := s.ec2.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(snapshotID)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Snapshots) != 0 && aws.StringValue(resp.Snapshots[0].State) == "completed" {
+			return nil
+		}
+		time.Sleep(waitInterval)
+	}
+	return fmt.Errorf("timed out waiting for snapshot %v to complete", snapshotID)
+}
+
+// DeleteSnapshot deletes snapshotID.
+func (s *EBSService) DeleteSnapshot(snapshotID string) error {
+	_, err := s.ec2.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+		SnapshotId: aws.String(snapshotID),
+	})
+	return err
+}
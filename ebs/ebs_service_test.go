@@ -54,7 +54,7 @@ func (s *TestSuite) TestVolumeAndSnapshot(c *C) {
 	c.Assert(originDevCounts, Not(Equals), 0)
 
 	log.Debug("Creating volume1")
-	volumeID1, err := svc.CreateVolume(GB, "", "")
+	volumeID1, err := svc.CreateVolume(GB, "", EBSVolumeOptions{})
 	c.Assert(err, IsNil)
 	c.Assert(volumeID1, Not(Equals), "")
 
@@ -72,7 +72,9 @@ func (s *TestSuite) TestVolumeAndSnapshot(c *C) {
 	c.Assert(len(devMap), Equals, originDevCounts+1)
 
 	log.Debug("Creating snapshot")
-	snapshotID, err := svc.CreateSnapshot(volumeID1, "Test snapshot")
+	snapshotID, err := svc.CreateSnapshot(volumeID1, "Test snapshot", EBSVolumeOptions{
+		Tags: map[string]string{"rancher-volume-test": "TestVolumeAndSnapshot"},
+	})
 	c.Assert(err, IsNil)
 	c.Assert(snapshotID, Not(Equals), "")
 	log.Debug("Creating snapshot ", snapshotID)
@@ -80,7 +82,7 @@ func (s *TestSuite) TestVolumeAndSnapshot(c *C) {
 	c.Assert(err, IsNil)
 
 	log.Debug("Creating volume from snapshot")
-	volumeID2, err := svc.CreateVolume(2*GB, snapshotID, "gp2")
+	volumeID2, err := svc.CreateVolume(2*GB, snapshotID, EBSVolumeOptions{})
 	c.Assert(err, IsNil)
 	c.Assert(volumeID2, Not(Equals), "")
 
@@ -125,3 +127,22 @@ func (s *TestSuite) TestVolumeAndSnapshot(c *C) {
 	err = svc.DeleteVolume(volumeID1)
 	c.Assert(err, IsNil)
 }
+
+func (s *TestSuite) TestCreateEncryptedIOPSVolume(c *C) {
+	svc, err := NewEBSService()
+	c.Assert(err, IsNil)
+
+	log.Debug("Creating encrypted io1 volume")
+	volumeID, err := svc.CreateVolume(4*GB, "", EBSVolumeOptions{
+		Encrypted:  true,
+		VolumeType: "io1",
+		Iops:       100,
+		Tags:       map[string]string{"rancher-volume-test": "TestCreateEncryptedIOPSVolume"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(volumeID, Not(Equals), "")
+
+	log.Debug("Deleting encrypted io1 volume")
+	err = svc.DeleteVolume(volumeID)
+	c.Assert(err, IsNil)
+}
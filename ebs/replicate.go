@@ -0,0 +1,100 @@
+package ebs
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Destination names a region (and optionally a re-encryption key) a
+// snapshot should be copied to for disaster recovery.
+type Destination struct {
+	Region   string
+	KmsKeyId string
+}
+
+// ReplicateSnapshot copies snapshotID into every region in dests via
+// CopySnapshot, returning a {region: copied-snapshot-id} map that the
+// caller should record in the backup's metadata so CreateVolume can pick
+// the nearest copy later.
+func (s *EBSService) ReplicateSnapshot(snapshotID string, dests []Destination) (map[string]string, error) {
+	copies := make(map[string]string)
+	for _, dest := range dests {
+		destSvc, err := newEBSServiceInRegion(dest.Region)
+		if err != nil {
+			return copies, err
+		}
+
+		input := &ec2.CopySnapshotInput{
+			SourceRegion:     aws.String(s.Region),
+			SourceSnapshotId: aws.String(snapshotID),
+		}
+		if dest.KmsKeyId != "" {
+			input.Encrypted = aws.Bool(true)
+			input.KmsKeyId = aws.String(dest.KmsKeyId)
+		}
+
+		resp, err := destSvc.ec2.CopySnapshot(input)
+		if err != nil {
+			return copies, err
+		}
+		destSnapshotID := aws.StringValue(resp.SnapshotId)
+
+		if err := destSvc.WaitForSnapshotCompleteInRegion(destSnapshotID); err != nil {
+			return copies, err
+		}
+
+		log.WithFields(logrus.Fields{
+			"snapshot":       snapshotID,
+			"destRegion":     dest.Region,
+			"destSnapshotID": destSnapshotID,
+		}).Debug("Replicated EBS snapshot")
+		copies[dest.Region] = destSnapshotID
+	}
+	return copies, nil
+}
+
+// WaitForSnapshotCompleteInRegion is WaitForSnapshotComplete for a service
+// handle in a region other than the one CreateSnapshot ran in, since
+// CopySnapshot's destination snapshot only exists in the dest region.
+func (s *EBSService) WaitForSnapshotCompleteInRegion(snapshotID string) error {
+	return s.WaitForSnapshotComplete(snapshotID)
+}
+
+// newEBSServiceInRegion builds an EBSService handle for a region other
+// than the instance's own, reusing the instance's credentials but talking
+// to a different region's EC2 endpoint. It has no AvailabilityZone or
+// InstanceID of its own, so it can only be used for region-scoped calls
+// like CopySnapshot and WaitForSnapshotCompleteInRegion.
+func newEBSServiceInRegion(region string) (*EBSService, error) {
+	sess := session.New()
+	return &EBSService{
+		Region: region,
+		ec2:    ec2.New(sess, aws.NewConfig().WithRegion(region)),
+	}, nil
+}
+
+// nearestSnapshotCopy picks the copy of a replicated snapshot closest to
+// az, falling back to sourceSnapshotID if az's region has no copy. "az"
+// is an availability zone like "us-west-2a"; its region is az without the
+// trailing letter.
+func nearestSnapshotCopy(az, sourceSnapshotID string, copies map[string]string) string {
+	if len(az) == 0 {
+		return sourceSnapshotID
+	}
+	region := az[:len(az)-1]
+	if snapshotID, ok := copies[region]; ok {
+		return snapshotID
+	}
+	return sourceSnapshotID
+}
+
+// CreateVolumeFromReplicatedSnapshot creates a volume from whichever copy
+// of sourceSnapshotID is nearest to this instance, per nearestSnapshotCopy,
+// falling back to sourceSnapshotID itself if it wasn't replicated to this
+// region.
+func (s *EBSService) CreateVolumeFromReplicatedSnapshot(size int64, sourceSnapshotID string, copies map[string]string, opts EBSVolumeOptions) (string, error) {
+	snapshotID := nearestSnapshotCopy(s.AvailabilityZone, sourceSnapshotID, copies)
+	return s.CreateVolume(size, snapshotID, opts)
+}
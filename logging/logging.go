@@ -25,6 +25,7 @@ const (
 	LOG_FIELD_BLOCKSIZE   = "blocksize"
 	LOG_FIELD_KIND        = "kind"
 	LOG_FIELD_ORIN_VOLUME = "original_volume"
+	LOG_FIELD_CHECKSUM    = "checksum"
 
 	LOG_FIELD_EVENT      = "event"
 	LOG_EVENT_INIT       = "init"
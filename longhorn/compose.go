@@ -0,0 +1,70 @@
+package longhorn
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DockerComposeTemplate is the docker-compose.yml used to launch a
+// volume's controller alongside its replica set. COMPOSE_REPLICA_SERVICES
+// is substituted with a block of N replica service definitions built by
+// renderReplicaServices, so the stack isn't pinned to a fixed replica
+// count.
+const DockerComposeTemplate = `
+controller:
+  image: rancher/longhorn-controller
+  command: ["launch", "controller", "--frontend", "tcp", "--stale-replica-timeout", "[STALE_REPLICA_TIMEOUT]", "[VOLUME_NAME]"]
+  volumes_from:
+    - [CONVOY_CONTAINER]
+[REPLICA_SERVICES]`
+
+// RancherComposeTemplate is the accompanying rancher-compose.yml. It
+// carries no per-volume scheduling rules of its own; those are attached
+// as labels on each replica service instead, so they can vary with
+// COMPOSE_REPLICA_SERVICES.
+const RancherComposeTemplate = `
+.catalog:
+  name: "Longhorn"
+  version: "v0.1"
+`
+
+const replicaServiceTemplate = `
+replica-[REPLICA_INDEX]:
+  image: rancher/longhorn-replica
+  command: ["launch", "replica", "--size", "[VOLUME_SIZE]", "/volume"]
+  labels:
+[REPLICA_AFFINITY_LABEL]
+`
+
+const (
+	replicaAffinitySoftLabel = "    io.rancher.scheduler.affinity:container_label_soft_ne: "
+	replicaAffinityHardLabel = "    io.rancher.scheduler.affinity:container_label_ne: "
+)
+
+// renderReplicaServices builds the docker-compose service block for count
+// replicas, each anti-affined away from the others according to
+// hostAffinity ("hard" refuses to co-locate, "soft"/"" merely prefers not
+// to).
+func renderReplicaServices(count int, hostAffinity string) string {
+	label := replicaAffinitySoftLabel
+	if hostAffinity == REPLICA_HOST_AFFINITY_HARD {
+		label = replicaAffinityHardLabel
+	}
+	// Every replica's rule names all replica services, so each one avoids
+	// hosts already running any replica of this stack.
+	names := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		names = append(names, "io.rancher.stack_service.name=${stack_name}/replica-"+strconv.Itoa(i))
+	}
+	label += strings.Join(names, ",")
+
+	services := ""
+	for i := 0; i < count; i++ {
+		index := strconv.Itoa(i)
+		service := replicaServiceTemplate
+		service = strings.Replace(service, "[REPLICA_AFFINITY_LABEL]", label, -1)
+		service = strings.Replace(service, COMPOSE_REPLICA_INDEX, index, -1)
+		services += service
+	}
+	return services
+}
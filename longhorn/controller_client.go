@@ -0,0 +1,168 @@
+package longhorn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	CONTROLLER_PORT = 9501
+
+	CONTROLLER_SNAPSHOT_PATH = "/v1/snapshots"
+	CONTROLLER_BACKUP_PATH   = "/v1/backups"
+	CONTROLLER_REPLICA_PATH  = "/v1/replicas"
+)
+
+// controllerRequest carries just enough to talk to the Longhorn
+// controller's REST API: create/list/revert/purge for snapshots and
+// create/restore/inspect for backups against its configured backup
+// target.
+func controllerRequest(controllerIP, method, path string, body interface{}, out interface{}) error {
+	url := fmt.Sprintf("http://%v:%v%v", controllerIP, CONTROLLER_PORT, path)
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("controller at %v returned %v for %v %v: %v", controllerIP, resp.StatusCode, method, path, string(respBody))
+	}
+	if out != nil && len(respBody) != 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type controllerSnapshot struct {
+	Name    string `json:"name"`
+	Created string `json:"created"`
+}
+
+func createControllerSnapshot(controllerIP, name string) error {
+	return controllerRequest(controllerIP, "POST", CONTROLLER_SNAPSHOT_PATH, map[string]string{"name": name}, nil)
+}
+
+func revertControllerSnapshot(controllerIP, name string) error {
+	return controllerRequest(controllerIP, "POST", CONTROLLER_SNAPSHOT_PATH+"/"+name+"?action=revert", nil, nil)
+}
+
+func purgeControllerSnapshot(controllerIP, name string) error {
+	return controllerRequest(controllerIP, "DELETE", CONTROLLER_SNAPSHOT_PATH+"/"+name, nil, nil)
+}
+
+func getControllerSnapshot(controllerIP, name string) (*controllerSnapshot, error) {
+	snap := &controllerSnapshot{}
+	if err := controllerRequest(controllerIP, "GET", CONTROLLER_SNAPSHOT_PATH+"/"+name, nil, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func createControllerBackup(controllerIP, snapshotName, backupTarget string) (string, error) {
+	resp := &struct {
+		URL string `json:"url"`
+	}{}
+	body := map[string]string{
+		"snapshot":     snapshotName,
+		"backupTarget": backupTarget,
+	}
+	if err := controllerRequest(controllerIP, "POST", CONTROLLER_BACKUP_PATH, body, resp); err != nil {
+		return "", err
+	}
+	return resp.URL, nil
+}
+
+func restoreControllerBackup(controllerIP, backupURL string) error {
+	return controllerRequest(controllerIP, "POST", CONTROLLER_BACKUP_PATH+"?action=restore", map[string]string{"url": backupURL}, nil)
+}
+
+// inspectBackupTarget and deleteBackupTarget talk to the backup target
+// itself (e.g. the Longhorn backup server fronting S3/NFS) rather than a
+// particular volume's controller, since an already-uploaded backup can
+// outlive the volume and controller that created it.
+func inspectBackupTarget(backupURL string) (map[string]string, error) {
+	info := map[string]string{}
+	if err := backupTargetRequest("GET", backupURL+"?action=inspect", nil, &info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func deleteBackupTarget(backupURL string) error {
+	return backupTargetRequest("DELETE", backupURL, nil, nil)
+}
+
+// updateControllerReplicaCount asks a running controller to add or drop
+// replicas to reach count, letting callers change redundancy online
+// instead of recreating the volume.
+func updateControllerReplicaCount(controllerIP string, count int) error {
+	body := map[string]int{"count": count}
+	return controllerRequest(controllerIP, "POST", CONTROLLER_REPLICA_PATH+"?action=updatecount", body, nil)
+}
+
+func backupTargetRequest(method, url string, body interface{}, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("backup target returned %v for %v %v: %v", resp.StatusCode, method, url, string(respBody))
+	}
+	if out != nil && len(respBody) != 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package longhorn
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ControllerClientTestSuite struct {
+}
+
+var _ = Suite(&ControllerClientTestSuite{})
+
+// These exercise backupTargetRequest (and, through it, inspectBackupTarget/
+// deleteBackupTarget) against a real httptest.Server standing in for the
+// backup target. controllerRequest shares the same marshal/status-check/
+// unmarshal logic but isn't covered the same way here: it always dials
+// controllerIP:CONTROLLER_PORT (9501) rather than taking a full URL, so
+// redirecting it at a mock listener would mean threading the port through
+// as a parameter - a production code change beyond what this test-only fix
+// covers.
+
+func (s *ControllerClientTestSuite) TestInspectBackupTarget(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, Equals, "GET")
+		c.Assert(r.URL.Query().Get("action"), Equals, "inspect")
+		json.NewEncoder(w).Encode(map[string]string{"size": "1073741824"})
+	}))
+	defer ts.Close()
+
+	info, err := inspectBackupTarget(ts.URL)
+	c.Assert(err, IsNil)
+	c.Assert(info["size"], Equals, "1073741824")
+}
+
+func (s *ControllerClientTestSuite) TestDeleteBackupTarget(c *C) {
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		c.Assert(r.Method, Equals, "DELETE")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	err := deleteBackupTarget(ts.URL)
+	c.Assert(err, IsNil)
+	c.Assert(called, Equals, true)
+}
+
+func (s *ControllerClientTestSuite) TestBackupTargetRequestErrorStatus(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("backup target is unreachable"))
+	}))
+	defer ts.Close()
+
+	err := deleteBackupTarget(ts.URL)
+	c.Assert(err, ErrorMatches, ".*backup target is unreachable.*")
+}
@@ -0,0 +1,79 @@
+package longhorn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	KEY_PROVIDER_FILE = "file"
+	KEY_PROVIDER_K8S  = "k8s-secret-dir"
+	KEY_PROVIDER_EXEC = "exec"
+
+	MAPPER_PREFIX = "convoy-"
+)
+
+// fetchEncryptionKey resolves the LUKS passphrase for the given volume
+// UUID from a provider string of the form "<kind>:<arg>":
+//
+//	file:<path>          - read the whole file as the key
+//	k8s-secret-dir:<dir> - read <dir>/<uuid> as the key, the layout a
+//	                       Kubernetes secret volume mount produces
+//	exec:<command>       - run command with uuid as its only argument,
+//	                       the key is whatever it prints to stdout
+func fetchEncryptionKey(keyProvider, uuid string) (string, error) {
+	if keyProvider == "" {
+		return "", fmt.Errorf("%v is not configured", LH_KEY_PROVIDER)
+	}
+	parts := strings.SplitN(keyProvider, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid %v %v, expected <kind>:<arg>", LH_KEY_PROVIDER, keyProvider)
+	}
+	kind, arg := parts[0], parts[1]
+
+	switch kind {
+	case KEY_PROVIDER_FILE:
+		key, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(key)), nil
+	case KEY_PROVIDER_K8S:
+		key, err := ioutil.ReadFile(filepath.Join(arg, uuid))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(key)), nil
+	case KEY_PROVIDER_EXEC:
+		output, err := util.ExecuteWithStdin(arg, []string{uuid}, "")
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(output), nil
+	default:
+		return "", fmt.Errorf("Unknown %v kind %v", LH_KEY_PROVIDER, kind)
+	}
+}
+
+func mapperDevicePath(mapperName string) string {
+	return filepath.Join("/dev/mapper", mapperName)
+}
+
+func luksFormat(device, key string) error {
+	_, err := util.ExecuteWithStdin("cryptsetup", []string{"luksFormat", device, "--key-file=-"}, key)
+	return err
+}
+
+func luksOpen(device, mapperName, key string) error {
+	_, err := util.ExecuteWithStdin("cryptsetup", []string{"luksOpen", device, mapperName, "--key-file=-"}, key)
+	return err
+}
+
+func luksClose(mapperName string) error {
+	_, err := util.Execute("cryptsetup", []string{"close", mapperName})
+	return err
+}
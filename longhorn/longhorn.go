@@ -36,11 +36,28 @@ const (
 	LH_RANCHER_ACCESS_KEY  = "lh.rancheraccesskey"
 	LH_RANCHER_SECRET_KEY  = "lh.ranchersecretkey"
 	LH_DEFAULT_VOLUME_SIZE = "lh.defaultvolumesize"
-
-	COMPOSE_VOLUME_NAME = "[VOLUME_NAME]"
-	COMPOSE_VOLUME_SIZE = "[VOLUME_SIZE]"
-	COMPOSE_SLAB_SIZE   = "[SLAB_SIZE]"
-	COMPOSE_CONVOY      = "[CONVOY_CONTAINER]"
+	LH_BACKUP_TARGET       = "lh.backuptarget"
+	LH_KEY_PROVIDER        = "lh.keyprovider"
+
+	COMPOSE_VOLUME_NAME      = "[VOLUME_NAME]"
+	COMPOSE_VOLUME_SIZE      = "[VOLUME_SIZE]"
+	COMPOSE_SLAB_SIZE        = "[SLAB_SIZE]"
+	COMPOSE_CONVOY           = "[CONVOY_CONTAINER]"
+	COMPOSE_REPLICA_SERVICES = "[REPLICA_SERVICES]"
+	COMPOSE_REPLICA_INDEX    = "[REPLICA_INDEX]"
+	COMPOSE_STALE_TIMEOUT    = "[STALE_REPLICA_TIMEOUT]"
+
+	OPT_DOCKER_VOLUME_ID      = "DockerVolumeID"
+	OPT_REPLICA_COUNT         = "ReplicaCount"
+	OPT_REPLICA_HOST_AFFINITY = "ReplicaHostAffinity"
+	OPT_STALE_REPLICA_TIMEOUT = "StaleReplicaTimeout"
+	OPT_ENCRYPTED             = "Encrypted"
+
+	DEFAULT_REPLICA_COUNT         = 2
+	DEFAULT_STALE_REPLICA_TIMEOUT = "20"
+
+	REPLICA_HOST_AFFINITY_SOFT = "soft"
+	REPLICA_HOST_AFFINITY_HARD = "hard"
 )
 
 var (
@@ -48,17 +65,39 @@ var (
 )
 
 type Driver struct {
-	mutex  *sync.RWMutex
 	client *rancherClient.RancherClient
+
+	// volumeLocks holds one *sync.Mutex per volume UUID, guarding
+	// Mount/Umount/Delete against racing on the same volume's NBD device.
+	// locksMutex guards volumeLocks itself and is only ever held long
+	// enough to look up or insert an entry, never across I/O, so a hung
+	// unmount on one volume can't block operations on another.
+	locksMutex  sync.Mutex
+	volumeLocks map[string]*sync.Mutex
+
 	Device
 }
 
+func (d *Driver) volumeLock(id string) *sync.Mutex {
+	d.locksMutex.Lock()
+	defer d.locksMutex.Unlock()
+
+	lock, exists := d.volumeLocks[id]
+	if !exists {
+		lock = &sync.Mutex{}
+		d.volumeLocks[id] = lock
+	}
+	return lock
+}
+
 type Device struct {
 	Root              string
 	DefaultVolumeSize int64
 	RancherURL        string
 	RancherAccessKey  string
 	RancherSecretKey  string
+	BackupTarget      string
+	KeyProvider       string
 }
 
 func (dev *Device) ConfigFile() (string, error) {
@@ -69,16 +108,50 @@ func (dev *Device) ConfigFile() (string, error) {
 }
 
 type Volume struct {
-	UUID       string
-	Size       int64
-	Device     string
-	MountPoint string
-	StackID    string
-	StackName  string
+	UUID         string
+	Size         int64
+	Device       string
+	MountPoint   string
+	StackID      string
+	StackName    string
+	ControllerIP string
+	ReplicaCount int
+	Snapshots    map[string]Snapshot
+
+	// Encrypted and MapperName describe the LUKS layer sitting between
+	// the raw NBD device and the filesystem: when Encrypted, the
+	// mountable device is /dev/mapper/MapperName, opened from Device on
+	// the 0->1 mount transition and closed on the 1->0 transition (and
+	// on delete), rather than mounting Device directly.
+	Encrypted  bool
+	MapperName string
+
+	// MountCount is the number of outstanding Mount calls not yet matched
+	// by an Unmount. util.VolumeMount/util.VolumeUmount (and the NBD
+	// connect/disconnect around them) only run on the 0->1 and 1->0
+	// transitions, so concurrent containers sharing a volume don't race
+	// on mounting it or tear it down while a sibling container is still
+	// using it.
+	MountCount int
+
+	// DockerIDs holds the Docker-supplied mount IDs currently referencing
+	// this volume: Mount records its ID once and Unmount removes it.
+	// Teardown follows MountCount, not this list: Unmount only actually
+	// unmounts once MountCount drops to 0.
+	DockerIDs []string
 
 	configPath string
 }
 
+// Snapshot records the controller-local name of a Longhorn snapshot and
+// when it was taken, so ListSnapshot/GetSnapshotInfo can answer without
+// round-tripping to the controller for anything but the live state.
+type Snapshot struct {
+	Name     string
+	VolumeID string
+	Created  string
+}
+
 func (v *Volume) ConfigFile() (string, error) {
 	if v.UUID == "" {
 		return "", fmt.Errorf("BUG: Invalid empty volume UUID")
@@ -90,6 +163,9 @@ func (v *Volume) ConfigFile() (string, error) {
 }
 
 func (v *Volume) GetDevice() (string, error) {
+	if v.Encrypted {
+		return mapperDevicePath(v.MapperName), nil
+	}
 	return v.Device, nil
 }
 
@@ -158,6 +234,8 @@ func Init(root string, config map[string]string) (convoydriver.ConvoyDriver, err
 			RancherAccessKey:  accessKey,
 			RancherSecretKey:  secretKey,
 			DefaultVolumeSize: volumeSize,
+			BackupTarget:      config[LH_BACKUP_TARGET],
+			KeyProvider:       config[LH_KEY_PROVIDER],
 		}
 	}
 
@@ -175,9 +253,13 @@ func Init(root string, config map[string]string) (convoydriver.ConvoyDriver, err
 		return nil, err
 	}
 	d := &Driver{
-		mutex:  &sync.RWMutex{},
-		client: client,
-		Device: *dev,
+		client:      client,
+		volumeLocks: make(map[string]*sync.Mutex),
+		Device:      *dev,
+	}
+
+	if err := d.reconcile(); err != nil {
+		return nil, err
 	}
 
 	return d, nil
@@ -193,6 +275,8 @@ func (d *Driver) Info() (map[string]string, error) {
 		"RancherURL":       d.RancherURL,
 		"RancherAccessKey": d.RancherAccessKey,
 		"RancherSecretKey": d.RancherSecretKey,
+		"BackupTarget":     d.BackupTarget,
+		"KeyProvider":      d.KeyProvider,
 	}, nil
 }
 
@@ -213,9 +297,24 @@ func (d *Driver) CreateVolume(id string, opts map[string]string) error {
 		size = d.DefaultVolumeSize
 	}
 
+	replicaCount := DEFAULT_REPLICA_COUNT
+	if countOpt := opts[OPT_REPLICA_COUNT]; countOpt != "" {
+		count, err := strconv.Atoi(countOpt)
+		if err != nil || count < 1 {
+			return fmt.Errorf("Invalid %v: %v", OPT_REPLICA_COUNT, countOpt)
+		}
+		replicaCount = count
+	}
+
+	staleReplicaTimeout := opts[OPT_STALE_REPLICA_TIMEOUT]
+	if staleReplicaTimeout == "" {
+		staleReplicaTimeout = DEFAULT_STALE_REPLICA_TIMEOUT
+	}
+
 	volume := d.blankVolume(id)
 	volume.Size = size
 	volume.StackName = getStackName(id)
+	volume.ReplicaCount = replicaCount
 
 	sizeString := strconv.FormatInt(size, 10)
 	dockerCompose := DockerComposeTemplate
@@ -223,6 +322,8 @@ func (d *Driver) CreateVolume(id string, opts map[string]string) error {
 	dockerCompose = strings.Replace(dockerCompose, COMPOSE_VOLUME_SIZE, sizeString, -1)
 	dockerCompose = strings.Replace(dockerCompose, COMPOSE_SLAB_SIZE, sizeString, -1)
 	dockerCompose = strings.Replace(dockerCompose, COMPOSE_CONVOY, "testcon", -1)
+	dockerCompose = strings.Replace(dockerCompose, COMPOSE_STALE_TIMEOUT, staleReplicaTimeout, -1)
+	dockerCompose = strings.Replace(dockerCompose, COMPOSE_REPLICA_SERVICES, renderReplicaServices(replicaCount, opts[OPT_REPLICA_HOST_AFFINITY]), -1)
 	rancherCompose := RancherComposeTemplate
 
 	config := &rancherClient.Environment{
@@ -236,7 +337,8 @@ func (d *Driver) CreateVolume(id string, opts map[string]string) error {
 	}
 	volume.StackID = env.Id
 
-	if err := d.waitForServices(env, 2, "inactive"); err != nil {
+	targetServiceCount := replicaCount + 1
+	if err := d.waitForServices(env, targetServiceCount, "inactive"); err != nil {
 		log.Debugf("Failed waiting services to be ready to launch. Cleaning up %v", env.Name)
 		if err := d.client.Environment.Delete(env); err != nil {
 			return err
@@ -253,7 +355,7 @@ func (d *Driver) CreateVolume(id string, opts map[string]string) error {
 		return err
 	}
 
-	controllerIP, err := d.getControllerIP(env)
+	controllerIP, err := d.getControllerIP(env, targetServiceCount)
 	if err != nil {
 		log.Debugf("Failed to get controller IP. Cleaning up %v", env.Name)
 		if err := d.client.Environment.Delete(env); err != nil {
@@ -270,15 +372,37 @@ func (d *Driver) CreateVolume(id string, opts map[string]string) error {
 		}
 		return err
 	}
-	if _, err := util.Execute("mkfs", []string{"-t", "ext4", dev}); err != nil {
+	mkfsTarget := dev
+	encrypted := opts[OPT_ENCRYPTED] == "true"
+	mapperName := ""
+	if encrypted {
+		mapperName = MAPPER_PREFIX + id
+		key, err := fetchEncryptionKey(d.KeyProvider, id)
+		if err != nil {
+			return err
+		}
+		if err := luksFormat(dev, key); err != nil {
+			return err
+		}
+		if err := luksOpen(dev, mapperName, key); err != nil {
+			return err
+		}
+		mkfsTarget = mapperDevicePath(mapperName)
+	}
+
+	if _, err := util.Execute("mkfs", []string{"-t", "ext4", mkfsTarget}); err != nil {
 		return err
 	}
 	volume.Device = dev
+	volume.ControllerIP = controllerIP
+	volume.Encrypted = encrypted
+	volume.MapperName = mapperName
+	volume.Snapshots = make(map[string]Snapshot)
 	return util.ObjectSave(volume)
 }
 
-func (d *Driver) getControllerIP(env *rancherClient.Environment) (string, error) {
-	if err := d.waitForServices(env, 2, "active"); err != nil {
+func (d *Driver) getControllerIP(env *rancherClient.Environment, targetServiceCount int) (string, error) {
+	if err := d.waitForServices(env, targetServiceCount, "active"); err != nil {
 		return "", err
 	}
 	var serviceCollection rancherClient.ServiceCollection
@@ -343,18 +467,29 @@ func (d *Driver) waitForServices(env *rancherClient.Environment, targetServiceCo
 }
 
 func (d *Driver) DeleteVolume(id string, opts map[string]string) error {
+	lock := d.volumeLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
 	volume := d.blankVolume(id)
 
 	if err := util.ObjectLoad(volume); err != nil {
 		return err
 	}
 
-	if volume.MountPoint != "" {
-		return fmt.Errorf("Cannot delete volume %v. It is still mounted", id)
+	if volume.MountCount > 0 {
+		return fmt.Errorf("Cannot delete volume %v. It is still mounted by %v client(s)", id, volume.MountCount)
 	}
 
-	if err := util.NBDDisconnect(volume.Device); err != nil {
-		return fmt.Errorf("Cannot disconnect NBD device %v for volume %v", volume.Device, id)
+	if volume.Device != "" {
+		if volume.Encrypted {
+			if err := luksClose(volume.MapperName); err != nil {
+				return fmt.Errorf("Cannot close LUKS device %v for volume %v: %v", volume.MapperName, id, err)
+			}
+		}
+		if err := util.NBDDisconnect(volume.Device); err != nil {
+			return fmt.Errorf("Cannot disconnect NBD device %v for volume %v", volume.Device, id)
+		}
 	}
 
 	env, err := d.client.Environment.ById(volume.StackID)
@@ -371,38 +506,112 @@ func (d *Driver) DeleteVolume(id string, opts map[string]string) error {
 }
 
 func (d *Driver) MountVolume(id string, opts map[string]string) (string, error) {
+	lock := d.volumeLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
 	volume := d.blankVolume(id)
 	if err := util.ObjectLoad(volume); err != nil {
 		return "", err
 	}
 
-	mountPoint, err := util.VolumeMount(volume, opts[convoydriver.OPT_MOUNT_POINT])
-	if err != nil {
-		return "", err
+	if volume.MountCount == 0 {
+		if volume.Device == "" {
+			dev, err := util.NBDConnect(volume.ControllerIP)
+			if err != nil {
+				return "", err
+			}
+			volume.Device = dev
+		}
+
+		if volume.Encrypted {
+			key, err := fetchEncryptionKey(d.KeyProvider, volume.UUID)
+			if err != nil {
+				return "", err
+			}
+			if err := luksOpen(volume.Device, volume.MapperName, key); err != nil {
+				return "", err
+			}
+		}
+
+		mountPoint, err := util.VolumeMount(volume, opts[convoydriver.OPT_MOUNT_POINT])
+		if err != nil {
+			return "", err
+		}
+		volume.MountPoint = mountPoint
+	}
+	volume.MountCount++
+
+	if dockerID := opts[OPT_DOCKER_VOLUME_ID]; dockerID != "" && !containsString(volume.DockerIDs, dockerID) {
+		volume.DockerIDs = append(volume.DockerIDs, dockerID)
 	}
 
 	if err := util.ObjectSave(volume); err != nil {
 		return "", err
 	}
 
-	return mountPoint, nil
+	return volume.MountPoint, nil
 }
 
-func (d *Driver) UmountVolume(id string) error {
+func (d *Driver) UmountVolume(id string, opts map[string]string) error {
+	lock := d.volumeLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
 	volume := d.blankVolume(id)
 	if err := util.ObjectLoad(volume); err != nil {
 		return err
 	}
 
+	if volume.MountCount == 0 {
+		return fmt.Errorf("Volume %v is not mounted", id)
+	}
+
+	if dockerID := opts[OPT_DOCKER_VOLUME_ID]; dockerID != "" {
+		volume.DockerIDs = removeString(volume.DockerIDs, dockerID)
+	}
+	volume.MountCount--
+
+	if volume.MountCount > 0 {
+		return util.ObjectSave(volume)
+	}
+
 	if err := util.VolumeUmount(volume); err != nil {
 		return err
 	}
+	volume.MountPoint = ""
 
-	if err := util.ObjectSave(volume); err != nil {
+	if volume.Encrypted {
+		if err := luksClose(volume.MapperName); err != nil {
+			return err
+		}
+	}
+
+	if err := util.NBDDisconnect(volume.Device); err != nil {
 		return err
 	}
+	volume.Device = ""
 
-	return nil
+	return util.ObjectSave(volume)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	result := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
 }
 
 func (d *Driver) MountPoint(id string) (string, error) {
@@ -419,21 +628,200 @@ func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 		return nil, err
 	}
 	return map[string]string{
-		"Size":      strconv.FormatInt(volume.Size, 10),
-		"Device":    volume.Device,
-		"StackName": volume.StackName,
-		"StackID":   volume.StackID,
+		"Size":         strconv.FormatInt(volume.Size, 10),
+		"Device":       volume.Device,
+		"StackName":    volume.StackName,
+		"StackID":      volume.StackID,
+		"ReplicaCount": strconv.Itoa(volume.ReplicaCount),
+		"Encrypted":    strconv.FormatBool(volume.Encrypted),
 	}, nil
 }
 
+// UpdateVolume talks to the volume's running Longhorn controller to
+// change mutable, already-provisioned settings without recreating the
+// volume. Currently this only covers OPT_REPLICA_COUNT.
+func (d *Driver) UpdateVolume(id string, opts map[string]string) error {
+	lock := d.volumeLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+
+	countOpt, exists := opts[OPT_REPLICA_COUNT]
+	if !exists {
+		return fmt.Errorf("Nothing to update; only %v is currently supported", OPT_REPLICA_COUNT)
+	}
+	count, err := strconv.Atoi(countOpt)
+	if err != nil || count < 1 {
+		return fmt.Errorf("Invalid %v: %v", OPT_REPLICA_COUNT, countOpt)
+	}
+	if volume.ControllerIP == "" {
+		return fmt.Errorf("Volume %v has no active controller to reach for a replica count change", id)
+	}
+
+	if err := updateControllerReplicaCount(volume.ControllerIP, count); err != nil {
+		return err
+	}
+	volume.ReplicaCount = count
+	return util.ObjectSave(volume)
+}
+
 func (d *Driver) ListVolume(opts map[string]string) (map[string]map[string]string, error) {
-	return nil, nil
+	pattern := filepath.Join(d.Root, LONGHORN_CFG_PREFIX+VOLUME_CFG_PREFIX+"*"+CFG_POSTFIX)
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := LONGHORN_CFG_PREFIX + VOLUME_CFG_PREFIX
+	volumes := make(map[string]map[string]string)
+	for _, path := range matches {
+		name := filepath.Base(path)
+		id := strings.TrimSuffix(strings.TrimPrefix(name, prefix), CFG_POSTFIX)
+		info, err := d.GetVolumeInfo(id)
+		if err != nil {
+			return nil, err
+		}
+		volumes[id] = info
+	}
+	return volumes, nil
 }
 
 func (d *Driver) SnapshotOps() (convoydriver.SnapshotOperations, error) {
-	return nil, fmt.Errorf("Longhorn doesn't support snapshot ops")
+	return d, nil
 }
 
 func (d *Driver) BackupOps() (convoydriver.BackupOperations, error) {
-	return nil, fmt.Errorf("Longhorn doesn't support backup ops")
+	return d, nil
+}
+
+// CreateSnapshot asks the volume's own Longhorn controller to snapshot its
+// current state. Snapshots live on the controller, keyed by volume, so the
+// snapshot name id is only meaningful together with volumeID.
+func (d *Driver) CreateSnapshot(id, volumeID string) error {
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+
+	if err := createControllerSnapshot(volume.ControllerIP, id); err != nil {
+		return err
+	}
+
+	snap, err := getControllerSnapshot(volume.ControllerIP, id)
+	if err != nil {
+		return err
+	}
+
+	if volume.Snapshots == nil {
+		volume.Snapshots = make(map[string]Snapshot)
+	}
+	volume.Snapshots[id] = Snapshot{
+		Name:     id,
+		VolumeID: volumeID,
+		Created:  snap.Created,
+	}
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) DeleteSnapshot(id, volumeID string) error {
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+
+	if _, exists := volume.Snapshots[id]; !exists {
+		return fmt.Errorf("Cannot find snapshot %v for volume %v", id, volumeID)
+	}
+
+	if err := purgeControllerSnapshot(volume.ControllerIP, id); err != nil {
+		return err
+	}
+
+	delete(volume.Snapshots, id)
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) GetSnapshotInfo(id, volumeID string) (map[string]string, error) {
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return nil, err
+	}
+
+	snapshot, exists := volume.Snapshots[id]
+	if !exists {
+		return nil, fmt.Errorf("Cannot find snapshot %v for volume %v", id, volumeID)
+	}
+
+	snap, err := getControllerSnapshot(volume.ControllerIP, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"Name":     snapshot.Name,
+		"VolumeID": snapshot.VolumeID,
+		"Created":  snap.Created,
+	}, nil
+}
+
+func (d *Driver) ListSnapshot(opts map[string]string) (map[string]map[string]string, error) {
+	volumeID := opts[convoydriver.OPT_VOLUME_UUID]
+	if volumeID == "" {
+		return nil, fmt.Errorf("Longhorn snapshots can only be listed for a single volume; missing %v", convoydriver.OPT_VOLUME_UUID)
+	}
+
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return nil, err
+	}
+
+	snapshots := make(map[string]map[string]string)
+	for name, snapshot := range volume.Snapshots {
+		snapshots[name] = map[string]string{
+			"Name":     snapshot.Name,
+			"VolumeID": snapshot.VolumeID,
+			"Created":  snapshot.Created,
+		}
+	}
+	return snapshots, nil
+}
+
+// CreateBackup hands the named snapshot to the controller to upload to
+// destURL (falling back to the driver's configured lh.backuptarget when
+// destURL is empty), and returns the backup URL the controller reports
+// back, which is also what callers must pass to the other Backup* methods.
+func (d *Driver) CreateBackup(id, volumeID, destURL string, opts map[string]string) (string, error) {
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+
+	if _, exists := volume.Snapshots[id]; !exists {
+		return "", fmt.Errorf("Cannot find snapshot %v for volume %v", id, volumeID)
+	}
+
+	if destURL == "" {
+		destURL = d.BackupTarget
+	}
+	if destURL == "" {
+		return "", fmt.Errorf("BUG: Destination URL was not specified and lh.backuptarget was not configured")
+	}
+
+	return createControllerBackup(volume.ControllerIP, id, destURL)
+}
+
+func (d *Driver) DeleteBackup(backupURL string) error {
+	return deleteBackupTarget(backupURL)
+}
+
+func (d *Driver) GetBackupInfo(backupURL string) (map[string]string, error) {
+	return inspectBackupTarget(backupURL)
+}
+
+func (d *Driver) ListBackup(destURL string, opts map[string]string) (map[string]string, error) {
+	return nil, fmt.Errorf("Longhorn does not support listing backups at a destination; inspect a specific backup URL instead")
 }
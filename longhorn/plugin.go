@@ -0,0 +1,186 @@
+package longhorn
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+)
+
+// pluginContentType is the content type the Docker Volume Plugin protocol
+// requires on every response.
+const pluginContentType = "application/vnd.docker.plugins.v1.1+json"
+
+type pluginRequest struct {
+	Name string
+	ID   string
+	Opts map[string]string
+}
+
+type pluginResponse struct {
+	Mountpoint   string              `json:"Mountpoint,omitempty"`
+	Err          string              `json:"Err"`
+	Volume       *pluginVolume       `json:"Volume,omitempty"`
+	Volumes      []*pluginVolume     `json:"Volumes,omitempty"`
+	Capabilities *pluginCapabilities `json:"Capabilities,omitempty"`
+	Implements   []string            `json:"Implements,omitempty"`
+}
+
+type pluginVolume struct {
+	Name       string `json:"Name"`
+	Mountpoint string `json:"Mountpoint,omitempty"`
+}
+
+type pluginCapabilities struct {
+	Scope string `json:"Scope"`
+}
+
+// ListenAndServePlugin serves the Docker Volume Plugin HTTP protocol over
+// a unix socket at sockFile, so this driver can be registered as a native
+// Docker managed plugin without going through convoy's own translation
+// layer. It reuses the same CreateVolume/MountVolume/UmountVolume/
+// DeleteVolume/ListVolume implementations convoy itself calls.
+func (d *Driver) ListenAndServePlugin(sockFile string) error {
+	os.Remove(sockFile)
+	l, err := net.Listen("unix", sockFile)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", d.pluginActivate)
+	mux.HandleFunc("/VolumeDriver.Create", d.pluginCreate)
+	mux.HandleFunc("/VolumeDriver.Remove", d.pluginRemove)
+	mux.HandleFunc("/VolumeDriver.Mount", d.pluginMount)
+	mux.HandleFunc("/VolumeDriver.Path", d.pluginPath)
+	mux.HandleFunc("/VolumeDriver.Unmount", d.pluginUnmount)
+	mux.HandleFunc("/VolumeDriver.Get", d.pluginGet)
+	mux.HandleFunc("/VolumeDriver.List", d.pluginList)
+	mux.HandleFunc("/VolumeDriver.Capabilities", d.pluginCapabilities)
+
+	log.Debugf("Docker Volume Plugin listening on %v", sockFile)
+	return http.Serve(l, mux)
+}
+
+func decodePluginRequest(r *http.Request) (*pluginRequest, error) {
+	req := &pluginRequest{}
+	if r.ContentLength == 0 {
+		return req, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func writePluginResponse(w http.ResponseWriter, resp *pluginResponse) {
+	w.Header().Set("Content-Type", pluginContentType)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func pluginError(w http.ResponseWriter, err error) {
+	writePluginResponse(w, &pluginResponse{Err: err.Error()})
+}
+
+func (d *Driver) pluginActivate(w http.ResponseWriter, r *http.Request) {
+	writePluginResponse(w, &pluginResponse{Implements: []string{"VolumeDriver"}})
+}
+
+func (d *Driver) pluginCreate(w http.ResponseWriter, r *http.Request) {
+	req, err := decodePluginRequest(r)
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	if err := d.CreateVolume(req.Name, req.Opts); err != nil {
+		pluginError(w, err)
+		return
+	}
+	writePluginResponse(w, &pluginResponse{})
+}
+
+func (d *Driver) pluginRemove(w http.ResponseWriter, r *http.Request) {
+	req, err := decodePluginRequest(r)
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	if err := d.DeleteVolume(req.Name, nil); err != nil {
+		pluginError(w, err)
+		return
+	}
+	writePluginResponse(w, &pluginResponse{})
+}
+
+func (d *Driver) pluginMount(w http.ResponseWriter, r *http.Request) {
+	req, err := decodePluginRequest(r)
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	mountPoint, err := d.MountVolume(req.Name, map[string]string{OPT_DOCKER_VOLUME_ID: req.ID})
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	writePluginResponse(w, &pluginResponse{Mountpoint: mountPoint})
+}
+
+func (d *Driver) pluginPath(w http.ResponseWriter, r *http.Request) {
+	req, err := decodePluginRequest(r)
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	mountPoint, err := d.MountPoint(req.Name)
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	writePluginResponse(w, &pluginResponse{Mountpoint: mountPoint})
+}
+
+func (d *Driver) pluginUnmount(w http.ResponseWriter, r *http.Request) {
+	req, err := decodePluginRequest(r)
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	if err := d.UmountVolume(req.Name, map[string]string{OPT_DOCKER_VOLUME_ID: req.ID}); err != nil {
+		pluginError(w, err)
+		return
+	}
+	writePluginResponse(w, &pluginResponse{})
+}
+
+func (d *Driver) pluginGet(w http.ResponseWriter, r *http.Request) {
+	req, err := decodePluginRequest(r)
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	mountPoint, err := d.MountPoint(req.Name)
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	writePluginResponse(w, &pluginResponse{Volume: &pluginVolume{Name: req.Name, Mountpoint: mountPoint}})
+}
+
+func (d *Driver) pluginList(w http.ResponseWriter, r *http.Request) {
+	volumes, err := d.ListVolume(nil)
+	if err != nil {
+		pluginError(w, err)
+		return
+	}
+	list := make([]*pluginVolume, 0, len(volumes))
+	for id := range volumes {
+		mountPoint, _ := d.MountPoint(id)
+		list = append(list, &pluginVolume{Name: id, Mountpoint: mountPoint})
+	}
+	writePluginResponse(w, &pluginResponse{Volumes: list})
+}
+
+func (d *Driver) pluginCapabilities(w http.ResponseWriter, r *http.Request) {
+	writePluginResponse(w, &pluginResponse{Capabilities: &pluginCapabilities{Scope: "local"}})
+}
@@ -0,0 +1,101 @@
+package longhorn
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/logging"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	RECONCILE_RECOVERED  = "recovered"
+	RECONCILE_ORPHANED   = "orphaned"
+	RECONCILE_REATTACHED = "reattached"
+)
+
+// reconcile walks every volume config file under Root and brings its
+// recorded state back in line with Rancher after a convoyd restart:
+// stacks deleted out-of-band while convoyd was down are dropped,
+// controllers that moved to a new IP get a fresh NBD connection, and
+// volumes that were attached but whose nbd-client isn't actually running
+// get reconnected. A per-volume failure is logged and skipped rather
+// than failing Init outright, so one bad volume doesn't block every
+// other volume from coming back up.
+func (d *Driver) reconcile() error {
+	pattern := filepath.Join(d.Root, LONGHORN_CFG_PREFIX+VOLUME_CFG_PREFIX+"*"+CFG_POSTFIX)
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	prefix := LONGHORN_CFG_PREFIX + VOLUME_CFG_PREFIX
+	for _, path := range matches {
+		name := filepath.Base(path)
+		id := strings.TrimSuffix(strings.TrimPrefix(name, prefix), CFG_POSTFIX)
+		if err := d.reconcileVolume(id); err != nil {
+			log.Errorf("Failed to reconcile volume %v on Init: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) reconcileVolume(id string) error {
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+
+	env, err := d.client.Environment.ById(volume.StackID)
+	if err != nil || env == nil || env.Id == "" {
+		logInitEvent(id, RECONCILE_ORPHANED)
+		return util.ObjectDelete(volume)
+	}
+
+	controllerIP, err := d.getControllerIP(env, volume.ReplicaCount+1)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case controllerIP != volume.ControllerIP:
+		if volume.Device != "" {
+			util.NBDDisconnect(volume.Device)
+		}
+		dev, err := util.NBDConnect(controllerIP)
+		if err != nil {
+			return err
+		}
+		volume.Device = dev
+		volume.ControllerIP = controllerIP
+		logInitEvent(id, RECONCILE_REATTACHED)
+	case volume.Device != "":
+		attached, err := util.NBDDeviceAttached(volume.Device)
+		if err != nil {
+			return err
+		}
+		if !attached {
+			dev, err := util.NBDConnect(controllerIP)
+			if err != nil {
+				return err
+			}
+			volume.Device = dev
+			logInitEvent(id, RECONCILE_REATTACHED)
+		} else {
+			logInitEvent(id, RECONCILE_RECOVERED)
+		}
+	default:
+		logInitEvent(id, RECONCILE_RECOVERED)
+	}
+
+	return util.ObjectSave(volume)
+}
+
+func logInitEvent(id, reason string) {
+	log.WithFields(logrus.Fields{
+		logging.LOG_FIELD_EVENT:  logging.LOG_EVENT_INIT,
+		logging.LOG_FIELD_VOLUME: id,
+		logging.LOG_FIELD_REASON: reason,
+	}).Info("Reconciled volume on driver Init")
+}
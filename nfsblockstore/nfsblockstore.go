@@ -0,0 +1,221 @@
+package nfsblockstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancherio/volmgr/blockstore"
+	"github.com/rancherio/volmgr/util"
+	"github.com/rancherio/volmgr/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NFSBlockStoreDriver mounts a single NFS export when the driver is created
+// or its saved config is reloaded (unless it's already mounted), and serves
+// every subsequent call as a plain path underneath that
+// mount plus Path - the same prefix-under-one-root layout S3BlockStoreDriver
+// uses, except here the "object store" is just whatever filesystem the NFS
+// server exports.
+type NFSBlockStoreDriver struct {
+	ID         string
+	ServerPath string
+	MountPoint string
+	MountOpts  string
+	Path       string
+}
+
+const (
+	KIND = "nfs"
+
+	NFS_SERVER_PATH = "nfs.serverpath"
+	NFS_MOUNT_OPTS  = "nfs.mountopts"
+	NFS_PATH        = "nfs.path"
+
+	MOUNTS_DIR = "nfs_mounts"
+)
+
+func init() {
+	blockstore.RegisterDriver(KIND, initFunc)
+}
+
+func initFunc(root, cfgName string, config map[string]string) (blockstore.BlockStoreDriver, error) {
+	b := &NFSBlockStoreDriver{}
+	if cfgName != "" {
+		if util.ConfigExists(root, cfgName) {
+			if err := util.LoadConfig(root, cfgName, b); err != nil {
+				return nil, err
+			}
+			if err := b.mount(); err != nil {
+				return nil, err
+			}
+			return b, nil
+		}
+		return nil, fmt.Errorf("Wrong configuration file for NFS blockstore driver")
+	}
+
+	b.ServerPath = config[NFS_SERVER_PATH]
+	b.MountOpts = config[NFS_MOUNT_OPTS]
+	b.Path = config[NFS_PATH]
+	if b.ServerPath == "" {
+		return nil, fmt.Errorf("Cannot find all required fields: %v", NFS_SERVER_PATH)
+	}
+	b.MountPoint = filepath.Join(root, MOUNTS_DIR, utils.GetChecksum([]byte(b.ServerPath))[:16])
+
+	if err := b.mount(); err != nil {
+		return nil, err
+	}
+
+	//Test connection
+	if _, err := b.List(""); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// mount is idempotent: it's called both the first time a blockstore is
+// registered and every time its driver config is reloaded afterward
+// (e.g. on daemon restart), since an NFS mount doesn't survive a reboot.
+func (d *NFSBlockStoreDriver) mount() error {
+	if err := os.MkdirAll(d.MountPoint, 0700); err != nil {
+		return err
+	}
+	if isMounted(d.MountPoint) {
+		return nil
+	}
+	args := []string{"-t", "nfs"}
+	if d.MountOpts != "" {
+		args = append(args, "-o", d.MountOpts)
+	}
+	args = append(args, d.ServerPath, d.MountPoint)
+	if _, err := util.Execute("mount", args); err != nil {
+		log.Errorf("Failed to mount NFS export %v at %v: %v", d.ServerPath, d.MountPoint, err)
+		return err
+	}
+	return nil
+}
+
+// isMounted checks /proc/mounts rather than just trusting a flag on d,
+// since the mount doesn't survive a reboot but d's persisted config does.
+func isMounted(mountPoint string) bool {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[1] == mountPoint {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *NFSBlockStoreDriver) localPath(path string) string {
+	return filepath.Join(d.MountPoint, d.Path, path)
+}
+
+func (d *NFSBlockStoreDriver) Kind() string {
+	return KIND
+}
+
+func (d *NFSBlockStoreDriver) FinalizeInit(root, cfgName, id string) error {
+	d.ID = id
+	if err := d.MkDirAll(""); err != nil {
+		return err
+	}
+	return util.SaveConfig(root, cfgName, d)
+}
+
+func (d *NFSBlockStoreDriver) FileExists(filePath string) bool {
+	_, err := os.Stat(d.localPath(filePath))
+	return err == nil
+}
+
+func (d *NFSBlockStoreDriver) FileSize(filePath string) int64 {
+	st, err := os.Stat(d.localPath(filePath))
+	if err != nil {
+		return -1
+	}
+	return st.Size()
+}
+
+func (d *NFSBlockStoreDriver) MkDirAll(dirName string) error {
+	return os.MkdirAll(d.localPath(dirName), 0700)
+}
+
+func (d *NFSBlockStoreDriver) Remove(name string) error {
+	return os.Remove(d.localPath(name))
+}
+
+func (d *NFSBlockStoreDriver) RemoveAll(name string) error {
+	return os.RemoveAll(d.localPath(name))
+}
+
+// Read ignores ctx: the NFS export is just a mounted filesystem, so a
+// read is a local os.Open with no network round trip of its own to
+// cancel.
+func (d *NFSBlockStoreDriver) Read(ctx context.Context, src string) (io.ReadCloser, error) {
+	return os.Open(d.localPath(src))
+}
+
+// ReadRange is a plain seek+limit: the NFS export is just a filesystem,
+// so there's no range-GET round trip to save, but the method still has
+// to exist to satisfy BlockStoreDriver.
+func (d *NFSBlockStoreDriver) ReadRange(ctx context.Context, src string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(d.localPath(src))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &limitedReadCloser{io.LimitReader(f, length), f}, nil
+}
+
+func (d *NFSBlockStoreDriver) Write(ctx context.Context, dst string, rs io.ReadSeeker) error {
+	path := d.localPath(dst)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, rs)
+	return err
+}
+
+// limitedReadCloser pairs an io.LimitReader over a range read with the
+// underlying file's Close, so ReadRange callers still get a plain
+// io.ReadCloser to defer Close() on.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (d *NFSBlockStoreDriver) List(listPath string) ([]string, error) {
+	var result []string
+
+	path := d.localPath(listPath)
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	for _, info := range infos {
+		result = append(result, info.Name())
+	}
+	return result, nil
+}
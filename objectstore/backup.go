@@ -0,0 +1,354 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/rancher-volume/driver"
+)
+
+// VolumeDataFile is, for now, where a plugin-backed volume's restored
+// content lives within its mount point: this driver era has no notion of
+// a raw block device (storagedriver.VolumeOperations only mounts and
+// unmounts directories), so a backup restores into a single flat file at
+// the root of the volume instead of writing arbitrary-offset blocks to a
+// device. Exported so the caller reading a volume's current content to
+// back it up (server.doBackupCreate) and RestoreBackup agree on where
+// that file lives.
+const VolumeDataFile = "convoy-data.img"
+
+// backupReadBufSize bounds how much of the source stream CreateBackup
+// holds in memory at once; it's well above chunkMaxSize so every full
+// read still has a chance to find a cut point before the carry buffer is
+// forced to emit a max-size chunk.
+const backupReadBufSize = 8 * chunkMaxSize
+
+// ChunkMapping is one entry in a backup's SnapshotMap: a content-defined
+// chunk's position in the original stream and the SHA-256 checksum of
+// its content, which is also its object name under chunks/sha256/.
+type ChunkMapping struct {
+	Offset   int64
+	Length   int64
+	Checksum string
+}
+
+// SnapshotMap is the manifest for one backup: the ordered list of
+// content-defined chunks that reconstruct it. Two backups of different
+// volumes (or two backups of the same volume taken at different times)
+// that happen to share a run of bytes share the same ChunkMapping.Checksum
+// entries, and so the same chunk object, instead of only deduping data
+// that lines up on matching fixed-size block offsets.
+type SnapshotMap struct {
+	ID     string
+	Chunks []ChunkMapping
+}
+
+// CreateBackup content-defined-chunks source, uploading every chunk the
+// destination doesn't already have (deduplicating against every other
+// backup ever taken to destURL, not just this volume's own history), then
+// writes the manifest last so a reader never sees a manifest referencing
+// a chunk that didn't finish uploading. It returns the backup URL to pass
+// to LoadVolume/RestoreBackup later.
+//
+// ctx is checked between chunks, not just at entry: this is the slow part
+// of doBackupCreate, and a caller whose request was cancelled (client
+// disconnect, or Start's shutdown deadline) shouldn't have to wait for the
+// whole upload to finish before that cancellation takes effect.
+//
+// If sourceBackupURL is set (the volume was created with processVolumeCreate's
+// backupURL option), CreateBackup first warms destURL with every chunk
+// already present at sourceBackupURL's destination: a backup of a volume
+// that hasn't been touched since it was cloned then uploads nothing at
+// all, even when sourceBackupURL points at a different destination than
+// destURL.
+func CreateBackup(ctx context.Context, destURL, volumeID string, volumeSize int64, backupID string, source io.Reader, sourceBackupURL string) (string, error) {
+	objDriver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := loadVolumeConfig(volumeID, objDriver); err != nil {
+		if err := saveVolumeConfig(volumeID, objDriver, &Volume{Size: volumeSize}); err != nil {
+			return "", err
+		}
+	}
+	if snapshotExists(backupID, volumeID, objDriver) {
+		return "", fmt.Errorf("backup %v of volume %v already exists in %v", backupID, volumeID, destURL)
+	}
+
+	if sourceBackupURL != "" {
+		if err := warmChunksFromSource(objDriver, sourceBackupURL); err != nil {
+			return "", err
+		}
+	}
+
+	manifest := &SnapshotMap{ID: backupID}
+	if err := chunkStream(source, func(c ChunkMapping, data []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := uploadChunk(objDriver, c, data); err != nil {
+			return err
+		}
+		manifest.Chunks = append(manifest.Chunks, c)
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	if err := saveSnapshotMap(backupID, volumeID, objDriver, manifest); err != nil {
+		return "", err
+	}
+	return EncodeBackupURL(destURL, volumeID, backupID), nil
+}
+
+// uploadChunk skips the PUT entirely when the destination already has an
+// object at this checksum: the HEAD-before-PUT that makes cross-backup
+// dedup actually save any transfer, not just storage.
+func uploadChunk(objDriver ObjectStoreDriver, c ChunkMapping, data []byte) error {
+	path := getChunkFilePath(c.Checksum)
+	if objDriver.FileSize(path) >= 0 {
+		return nil
+	}
+	return objDriver.Write(path, bytes.NewReader(data))
+}
+
+// warmChunksFromSource copies every chunk object sourceBackupURL's manifest
+// references into objDriver, skipping any checksum objDriver already has.
+// It's best-effort: a source chunk that's gone missing (e.g. already
+// GC'd) is not an error here, since uploadChunk will simply re-upload it
+// from the live volume data like it would have without a source at all.
+func warmChunksFromSource(objDriver ObjectStoreDriver, sourceBackupURL string) error {
+	srcDestURL, srcVolumeID, srcBackupID, err := decodeBackupURL(sourceBackupURL)
+	if err != nil {
+		return err
+	}
+	srcDriver, err := GetObjectStoreDriver(srcDestURL)
+	if err != nil {
+		return err
+	}
+	manifest, err := loadSnapshotMap(srcBackupID, srcVolumeID, srcDriver)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, c := range manifest.Chunks {
+		if seen[c.Checksum] {
+			continue
+		}
+		seen[c.Checksum] = true
+
+		path := getChunkFilePath(c.Checksum)
+		if objDriver.FileSize(path) >= 0 {
+			continue
+		}
+		rc, err := srcDriver.Read(path)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			continue
+		}
+		if err := objDriver.Write(path, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkStream reads r to completion, holding back chunkMaxSize bytes of
+// carry at a time so a cut point spanning a read boundary is never missed,
+// and calls emit with each chunk's boundary and its data as they're found.
+// Until EOF the last chunk of each pass stays in carry, since it ends where
+// the data read so far ends rather than at a content-defined cut point.
+func chunkStream(r io.Reader, emit func(ChunkMapping, []byte) error) error {
+	var (
+		carry  []byte
+		offset int64
+		buf    = make([]byte, backupReadBufSize)
+	)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			carry = append(carry, buf[:n]...)
+		}
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		atEOF := readErr == io.EOF
+
+		cutLimit := len(carry)
+		if !atEOF {
+			cutLimit -= chunkMaxSize
+		}
+		if cutLimit > 0 {
+			if err := emitChunks(carry[:cutLimit], offset, emit, &carry, &offset, false); err != nil {
+				return err
+			}
+		}
+		if atEOF {
+			if len(carry) > 0 {
+				if err := emitChunks(carry, offset, emit, &carry, &offset, true); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// emitChunks emits data's chunks and drops them from the front of carry.
+// Unless final is set, the last chunk is not emitted and stays in carry.
+func emitChunks(data []byte, offset int64, emit func(ChunkMapping, []byte) error, carry *[]byte, carryOffset *int64, final bool) error {
+	chunks := chunkBoundaries(offset, data)
+	if !final && len(chunks) > 0 {
+		chunks = chunks[:len(chunks)-1]
+	}
+	for _, c := range chunks {
+		rel := c.Offset - offset
+		if err := emit(c, data[rel:rel+c.Length]); err != nil {
+			return err
+		}
+	}
+	consumed := int64(0)
+	if len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		consumed = last.Offset + last.Length - offset
+	}
+	*carryOffset = offset + consumed
+	*carry = (*carry)[consumed:]
+	return nil
+}
+
+// LoadVolume reads a backup's volume record, just enough to size a fresh
+// volume before it's even created (see processVolumeCreate's use of it).
+func LoadVolume(backupURL string) (*Volume, error) {
+	destURL, volumeID, _, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	objDriver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	return loadVolumeConfig(volumeID, objDriver)
+}
+
+// RestoreBackup reads backupURL's manifest and streams its chunks into
+// volumeID's mount point, in manifest order, coalescing consecutive
+// manifest entries that share a checksum (e.g. runs of zeroed space) into
+// a single object read instead of fetching the same chunk twice.
+//
+// Like CreateBackup, ctx is checked once per manifest entry so a restore
+// that's no longer wanted (the request was cancelled, or shutdown's
+// deadline passed) stops pulling chunks instead of running to completion.
+func RestoreBackup(ctx context.Context, backupURL, volumeID string, d driver.Driver) error {
+	destURL, srcVolumeID, backupID, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	objDriver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := loadSnapshotMap(backupID, srcVolumeID, objDriver)
+	if err != nil {
+		return err
+	}
+
+	volOps, err := d.VolumeOps()
+	if err != nil {
+		return err
+	}
+	mountPoint, err := volOps.MountVolume(volumeID, nil)
+	if err != nil {
+		return err
+	}
+	defer volOps.UmountVolume(volumeID)
+
+	dst, err := os.OpenFile(filepath.Join(mountPoint, VolumeDataFile), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	var lastChecksum string
+	var lastData []byte
+	for _, c := range manifest.Chunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data := lastData
+		if c.Checksum != lastChecksum {
+			rc, err := objDriver.Read(getChunkFilePath(c.Checksum))
+			if err != nil {
+				return err
+			}
+			data, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			lastChecksum, lastData = c.Checksum, data
+		}
+		if _, err := dst.WriteAt(data, c.Offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBackups returns the backup URL of every backup volumeID has under
+// destURL.
+func ListBackups(destURL, volumeID string) ([]string, error) {
+	objDriver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := getSnapshots(volumeID, objDriver)
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, 0, len(backups))
+	for backupID := range backups {
+		urls = append(urls, EncodeBackupURL(destURL, volumeID, backupID))
+	}
+	return urls, nil
+}
+
+// InspectBackup returns the manifest backupURL points at.
+func InspectBackup(backupURL string) (*SnapshotMap, error) {
+	destURL, volumeID, backupID, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	objDriver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	return loadSnapshotMap(backupID, volumeID, objDriver)
+}
+
+// DeleteBackup removes one backup's manifest. It deliberately leaves the
+// chunk objects it referenced alone: they may still be shared by other
+// backups, so reclaiming them is GC's job, not delete's.
+func DeleteBackup(backupURL string) error {
+	destURL, volumeID, backupID, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	objDriver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+	return objDriver.Remove(getSnapshotsPath(volumeID) + getSnapshotConfigName(backupID))
+}
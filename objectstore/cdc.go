@@ -0,0 +1,116 @@
+package objectstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+)
+
+// Content-defined chunking for the backup format: a rolling hash over a
+// sliding window decides where to cut, so identical data dedups against
+// the same chunk object wherever it appears, rather than only when it
+// happens to land on the same fixed-offset block boundary. This is the
+// same approach blockstore.ChunkData uses for its changed-block dedup,
+// tuned here for whole-volume backups: a bigger average chunk size since
+// backups are usually much larger than a single changed block.
+const (
+	chunkWindowSize = 48
+	chunkAvgBits    = 20
+	chunkMinSize    = 256 * 1024
+	chunkMaxSize    = 4 * 1024 * 1024
+
+	chunkPolynomial = 1099511628211
+
+	chunksObjectDir = "chunks/sha256"
+)
+
+// chunkWindowPow is chunkPolynomial^chunkWindowSize (mod 2^64), the weight
+// the byte leaving the window carries in the hash value.
+var chunkWindowPow = func() uint64 {
+	p := uint64(1)
+	for i := 0; i < chunkWindowSize; i++ {
+		p *= chunkPolynomial
+	}
+	return p
+}()
+
+type rollingWindow struct {
+	buf   []byte
+	pos   int
+	full  bool
+	value uint64
+}
+
+func newRollingWindow() *rollingWindow {
+	return &rollingWindow{buf: make([]byte, chunkWindowSize)}
+}
+
+func (w *rollingWindow) roll(b byte) uint64 {
+	old := w.buf[w.pos]
+	w.buf[w.pos] = b
+	w.pos = (w.pos + 1) % chunkWindowSize
+	if w.pos == 0 {
+		w.full = true
+	}
+	w.value = w.value*chunkPolynomial + uint64(b) - uint64(old)*chunkWindowPow
+	return w.value
+}
+
+// chunkCutMask is the bitmask whose trailing zero bits make a rolling
+// hash match roughly once every 1<<avgBits bytes.
+func chunkCutMask(avgBits uint) uint64 {
+	return (uint64(1) << avgBits) - 1
+}
+
+// chunkBoundaries splits data into content-defined chunks averaging
+// 1<<chunkAvgBits bytes, clamped to [chunkMinSize, chunkMaxSize] except the
+// final chunk, which takes whatever is left and may be smaller than
+// chunkMinSize, and checksums each one with SHA-256.
+func chunkBoundaries(baseOffset int64, data []byte) []ChunkMapping {
+	mask := chunkCutMask(chunkAvgBits)
+	w := newRollingWindow()
+	var chunks []ChunkMapping
+	start := 0
+	for i, b := range data {
+		v := w.roll(b)
+		size := i - start + 1
+		if size < chunkMinSize {
+			continue
+		}
+		if (w.full && v&mask == 0) || size >= chunkMaxSize {
+			chunks = append(chunks, ChunkMapping{
+				Offset:   baseOffset + int64(start),
+				Length:   int64(size),
+				Checksum: sha256Hex(data[start : i+1]),
+			})
+			start = i + 1
+			w = newRollingWindow()
+		}
+	}
+	if start < len(data) {
+		chunks = append(chunks, ChunkMapping{
+			Offset:   baseOffset + int64(start),
+			Length:   int64(len(data) - start),
+			Checksum: sha256Hex(data[start:]),
+		})
+	}
+	return chunks
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// getChunksPath is the directory every backup's chunks live under,
+// regardless of which volume or backup first wrote them.
+func getChunksPath() string {
+	return filepath.Join(BLOCKSTORE_BASE, chunksObjectDir) + "/"
+}
+
+// getChunkFilePath returns chunks/sha256/<aa>/<bb>/<checksum>, two layers
+// of the checksum's own leading bytes deep so no single directory ends up
+// with every chunk the destination has ever stored.
+func getChunkFilePath(checksum string) string {
+	return filepath.Join(getChunksPath(), checksum[0:2], checksum[2:4], checksum)
+}
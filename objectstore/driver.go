@@ -0,0 +1,110 @@
+package objectstore
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// ObjectStoreDriver is the object store's side of the backup pipeline: a
+// flat, path-addressed blob store. It's deliberately narrower than
+// storagedriver.VolumeOperations, since every concrete backend (vfs, S3,
+// Ceph RBD, ...) can implement "put this path" / "get this path" even
+// when it has no notion of a mountable volume at all.
+type ObjectStoreDriver interface {
+	Kind() string
+	FileExists(filePath string) bool
+	FileSize(filePath string) int64
+	LastModified(filePath string) (time.Time, error)
+	Read(filePath string) (io.ReadCloser, error)
+	Write(filePath string, data io.Reader) error
+	List(path string) ([]string, error)
+	Remove(name string) error
+}
+
+// InitFunc creates an ObjectStoreDriver from the destination URL's
+// remainder (everything but the scheme that picked this driver) plus any
+// driver-specific options encoded in its query string.
+type InitFunc func(destURL *url.URL) (ObjectStoreDriver, error)
+
+var initializers = map[string]InitFunc{}
+
+// RegisterDriver makes an object store backend available to
+// GetObjectStoreDriver under the URL scheme kind (e.g. "vfs", "s3").
+func RegisterDriver(kind string, initFunc InitFunc) {
+	initializers[kind] = initFunc
+}
+
+// GetObjectStoreDriver resolves destURL's scheme to a registered backend
+// and hands it the parsed URL to configure itself from.
+func GetObjectStoreDriver(destURL string) (ObjectStoreDriver, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+	initFunc, ok := initializers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("driver %v is not supported", u.Scheme)
+	}
+	return initFunc(u)
+}
+
+// Volume is the object store's own record that a volume has ever been
+// backed up to it: just enough to size a fresh volume being restored
+// from one of its backups, mirroring blockstore.Volume.
+type Volume struct {
+	Size         int64
+	Name         string
+	LastBackupID string
+}
+
+// ObjectStore is the destination-wide config written once, the first
+// time anything is backed up to a given destination URL.
+type ObjectStore struct {
+	UUID string
+	Kind string
+}
+
+// Image is a content-addressable base image stored alongside backups, as
+// referenced by getImageObjectStorePath/getImageCfgObjectStorePath.
+type Image struct {
+	UUID string
+	Name string
+	Size int64
+}
+
+// decodeBackupURL splits a backup URL of the form
+// <dest-scheme>://<dest-path>?volume=<id>&backup=<id>[&<driver opts>] into
+// the destination URL (with the volume/backup params stripped back out,
+// since those aren't a destination driver option) and the two ids.
+func decodeBackupURL(backupURL string) (destURL, volumeID, backupID string, err error) {
+	u, err := url.Parse(backupURL)
+	if err != nil {
+		return "", "", "", err
+	}
+	q := u.Query()
+	volumeID = q.Get("volume")
+	backupID = q.Get("backup")
+	if volumeID == "" {
+		return "", "", "", fmt.Errorf("backup URL %v is missing volume=", backupURL)
+	}
+	q.Del("volume")
+	q.Del("backup")
+	u.RawQuery = q.Encode()
+	return u.String(), volumeID, backupID, nil
+}
+
+// EncodeBackupURL is decodeBackupURL's inverse, used by backup creation to
+// hand callers back a URL that LoadVolume/RestoreBackup can consume.
+func EncodeBackupURL(destURL, volumeID, backupID string) string {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return destURL
+	}
+	q := u.Query()
+	q.Set("volume", volumeID)
+	q.Set("backup", backupID)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,72 @@
+package objectstore
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+)
+
+// defaultGCGracePeriod is how recently-written chunk objects are skipped
+// by GC, so a backup that's still uploading (whose manifest hasn't been
+// written yet, so none of its chunks are "referenced" as far as GC can
+// tell) never has one of its chunks raced out from under it.
+const defaultGCGracePeriod = time.Hour
+
+// GC walks every backup manifest for volumeID under destURL, marks every
+// chunk checksum any of them reference, then removes whichever chunk
+// objects under that destination's chunks/ tree are unreferenced and
+// older than grace.
+//
+// Like CreateBackup, ctx is checked once per candidate chunk, so GC
+// cancelled mid-run (client disconnect, or Start's shutdown deadline)
+// stops removing objects instead of running to completion unobserved.
+func GC(ctx context.Context, destURL, volumeID string, grace time.Duration) (int, error) {
+	objDriver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return 0, err
+	}
+
+	backups, err := getSnapshots(volumeID, objDriver)
+	if err != nil {
+		return 0, err
+	}
+
+	referenced := make(map[string]bool)
+	for backupID := range backups {
+		manifest, err := loadSnapshotMap(backupID, volumeID, objDriver)
+		if err != nil {
+			return 0, err
+		}
+		for _, c := range manifest.Chunks {
+			referenced[c.Checksum] = true
+		}
+	}
+
+	chunksPath := getChunksPath()
+	files, err := objDriver.List(chunksPath)
+	if err != nil {
+		// No chunk has ever been written to this destination.
+		return 0, nil
+	}
+
+	removed := 0
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		checksum := filepath.Base(f)
+		if referenced[checksum] {
+			continue
+		}
+		fullPath := filepath.Join(chunksPath, f)
+		modTime, err := objDriver.LastModified(fullPath)
+		if err != nil || time.Since(modTime) < grace {
+			continue
+		}
+		if err := objDriver.Remove(fullPath); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
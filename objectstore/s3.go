@@ -0,0 +1,147 @@
+package objectstore
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func init() {
+	RegisterDriver("s3", newS3ObjectStoreDriver)
+}
+
+// s3ObjectStoreDriver stores objects as keys in a single S3 bucket, with
+// filePath used verbatim as the key: the same flat layout vfsObjectStoreDriver
+// gives it, since getBlockFilePath/getSnapshotConfigName already produce
+// object-store-shaped relative paths.
+type s3ObjectStoreDriver struct {
+	service *s3.S3
+	bucket  string
+}
+
+// newS3ObjectStoreDriver expects a destination URL of the form
+// s3://<bucket>?region=<region>[&endpoint=<url>], mirroring how
+// "convoy blockstore register --kind s3 --opts bucket=... region=..."
+// encodes its options into the destURL's query string. Any path in the
+// URL is ignored: keys are filePath verbatim from the root of the bucket.
+func newS3ObjectStoreDriver(destURL *url.URL) (ObjectStoreDriver, error) {
+	bucket := destURL.Host
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 destination URL %v is missing a bucket", destURL)
+	}
+	opts := destURL.Query()
+	region := opts.Get("region")
+	if region == "" {
+		return nil, fmt.Errorf("s3 destination URL %v is missing region=", destURL)
+	}
+
+	cfg := aws.NewConfig().WithRegion(region)
+	if endpoint := opts.Get("endpoint"); endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3ObjectStoreDriver{service: s3.New(sess), bucket: bucket}, nil
+}
+
+func (s *s3ObjectStoreDriver) Kind() string {
+	return "s3"
+}
+
+func (s *s3ObjectStoreDriver) FileExists(filePath string) bool {
+	_, err := s.service.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(filePath),
+	})
+	return err == nil
+}
+
+func (s *s3ObjectStoreDriver) FileSize(filePath string) int64 {
+	out, err := s.service.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(filePath),
+	})
+	if err != nil || out.ContentLength == nil {
+		return -1
+	}
+	return *out.ContentLength
+}
+
+func (s *s3ObjectStoreDriver) LastModified(filePath string) (time.Time, error) {
+	out, err := s.service.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(filePath),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return *out.LastModified, nil
+}
+
+func (s *s3ObjectStoreDriver) Read(filePath string) (io.ReadCloser, error) {
+	out, err := s.service.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(filePath),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3ObjectStoreDriver) Write(filePath string, data io.Reader) error {
+	body, ok := data.(io.ReadSeeker)
+	if !ok {
+		return fmt.Errorf("s3 driver requires a seekable reader for %v", filePath)
+	}
+	_, err := s.service.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(filePath),
+		Body:   body,
+	})
+	return err
+}
+
+// List returns every key under path, mirroring vfsObjectStoreDriver.List's
+// path-relative semantics via a plain ListObjects with Prefix=path.
+func (s *s3ObjectStoreDriver) List(path string) ([]string, error) {
+	prefix := path
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var names []string
+	err := s.service.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			names = append(names, strings.TrimPrefix(*obj.Key, prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (s *s3ObjectStoreDriver) Remove(name string) error {
+	_, err := s.service.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,326 @@
+package s3blockstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/rancherio/volmgr/api"
+)
+
+const (
+	defaultPartSize    = 64 * 1024 * 1024
+	defaultParallelism = 4
+	defaultMaxRetries  = 3
+
+	// throttleRetryAfterSeconds is the Retry-After hint attached to a
+	// throttled transfer. It's a flat guess rather than anything read off
+	// the AWS response (S3 doesn't send one): by the time a throttling
+	// error reaches here, the SDK's own exponential backoff (MaxRetries)
+	// has already exhausted its retries, so a few seconds is a reasonable
+	// floor for a caller waiting to try again.
+	throttleRetryAfterSeconds = 5
+)
+
+// throttlingErrorCodes are the aws-sdk-go error codes S3/the SDK use to
+// say "slow down" rather than "this request is wrong" - worth telling
+// callers apart from a genuine failure so they know retrying later will
+// actually help.
+var throttlingErrorCodes = map[string]bool{
+	"SlowDown":                               true,
+	"RequestLimitExceeded":                   true,
+	"ThrottlingException":                    true,
+	"ProvisionedThroughputExceededException": true,
+}
+
+// wrapThrottling converts an aws-sdk-go throttling error into an
+// *api.HTTPError carrying a Retry-After hint, so writeHandlerError (see
+// server.go) can surface it to the caller as a 503 instead of a plain
+// 400. Any other error, including a nil one, passes through unchanged.
+func wrapThrottling(err error) error {
+	if err == nil {
+		return nil
+	}
+	if awsErr, ok := err.(awserr.Error); ok && throttlingErrorCodes[awsErr.Code()] {
+		return api.NewThrottledError(awsErr.Message(), throttleRetryAfterSeconds)
+	}
+	return err
+}
+
+// AWSSDKService is the aws-sdk-go-backed S3Service implementation,
+// selected with s3.driver=awssdk. Unlike MinioService it signs requests
+// with SigV4 through the SDK's own client, retries 5xx/throttling
+// responses with the SDK's exponential backoff (MaxRetries), and
+// uploads through s3manager so a block goes out as parallel multipart
+// parts instead of one single PUT.
+type AWSSDKService struct {
+	Keys       S3Keys
+	Region     string
+	BucketName string
+	Endpoint   string
+	UseSSL     bool
+
+	ServerSideEncryption string
+	KMSKeyID             string
+	StorageClass         string
+
+	// PartSize is the size, in bytes, of each multipart upload part.
+	// Zero means defaultPartSize (64 MiB).
+	PartSize int64
+	// Parallelism is how many parts are uploaded concurrently. Zero
+	// means defaultParallelism.
+	Parallelism int
+	// MaxRetries is how many times the SDK retries a request that
+	// failed with a 5xx or throttling response before giving up. Zero
+	// means defaultMaxRetries.
+	MaxRetries int
+
+	sessionMu sync.Mutex
+	session   *session.Session
+	s3        *s3.S3
+}
+
+func (a *AWSSDKService) Bucket() string {
+	return a.BucketName
+}
+
+// getSession lazily builds the session/S3 client pair, guarded by
+// sessionMu rather than a plain nil-check on a.session: this service is
+// reloaded from config with both fields nil and then shared across
+// blockstore's concurrent per-volume worker pool, so a plain nil-check
+// would let multiple goroutines race through session.NewSession/s3.New
+// on the first backup/restore after a daemon restart. A mutex (rather
+// than sync.Once) is used so a transient failure - e.g. credentials not
+// resolvable yet during a racy daemon start - doesn't get cached forever;
+// the next call simply tries again.
+func (a *AWSSDKService) getSession() (*session.Session, error) {
+	a.sessionMu.Lock()
+	defer a.sessionMu.Unlock()
+
+	if a.session != nil {
+		return a.session, nil
+	}
+
+	cfg := aws.NewConfig().
+		WithRegion(a.Region).
+		WithCredentials(credentials.NewStaticCredentials(a.Keys.AccessKey, a.Keys.SecretKey, "")).
+		WithMaxRetries(a.maxRetries())
+	if a.Endpoint != "" {
+		cfg = cfg.WithEndpoint(a.Endpoint).WithS3ForcePathStyle(true)
+	}
+	if !a.UseSSL {
+		cfg = cfg.WithDisableSSL(true)
+	}
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.session = sess
+	a.s3 = s3.New(sess)
+	return sess, nil
+}
+
+func (a *AWSSDKService) client() (*s3.S3, error) {
+	if _, err := a.getSession(); err != nil {
+		return nil, err
+	}
+	return a.s3, nil
+}
+
+func (a *AWSSDKService) maxRetries() int {
+	if a.MaxRetries == 0 {
+		return defaultMaxRetries
+	}
+	return a.MaxRetries
+}
+
+func (a *AWSSDKService) partSize() int64 {
+	if a.PartSize == 0 {
+		return defaultPartSize
+	}
+	return a.PartSize
+}
+
+func (a *AWSSDKService) parallelism() int {
+	if a.Parallelism == 0 {
+		return defaultParallelism
+	}
+	return a.Parallelism
+}
+
+func (a *AWSSDKService) StatObject(bucket, key string) (int64, bool, error) {
+	client, err := a.client()
+	if err != nil {
+		return 0, false, err
+	}
+	out, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return aws.Int64Value(out.ContentLength), true, nil
+}
+
+func (a *AWSSDKService) ListObjects(bucket, key string) ([]S3Object, error) {
+	client, err := a.client()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []S3Object
+	err = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(key),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			result = append(result, S3Object{Key: obj.Key, Size: obj.Size})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (a *AWSSDKService) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	client, err := a.client()
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, wrapThrottling(err)
+	}
+	return out.Body, nil
+}
+
+func (a *AWSSDKService) GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	client, err := a.client()
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, wrapThrottling(err)
+	}
+	return out.Body, nil
+}
+
+func (a *AWSSDKService) PutObject(ctx context.Context, bucket, key string, rs io.ReadSeeker) error {
+	sess, err := a.getSession()
+	if err != nil {
+		return err
+	}
+
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = a.partSize()
+		u.Concurrency = a.parallelism()
+	})
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   rs,
+	}
+	switch a.ServerSideEncryption {
+	case "":
+	case "AES256":
+		input.ServerSideEncryption = aws.String("AES256")
+	case "aws:kms":
+		input.ServerSideEncryption = aws.String("aws:kms")
+		if a.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(a.KMSKeyID)
+		}
+	default:
+		return fmt.Errorf("unsupported server-side encryption mode %q, expected \"AES256\" or \"aws:kms\"", a.ServerSideEncryption)
+	}
+	if a.StorageClass != "" {
+		input.StorageClass = aws.String(a.StorageClass)
+	}
+
+	_, err = uploader.UploadWithContext(ctx, input)
+	return wrapThrottling(err)
+}
+
+// deleteObjectsBatchSize is the most object keys a single S3
+// DeleteObjects call will accept.
+const deleteObjectsBatchSize = 1000
+
+func (a *AWSSDKService) DeleteObjects(bucket, key string) error {
+	objects, err := a.ListObjects(bucket, key)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+
+	client, err := a.client()
+	if err != nil {
+		return err
+	}
+	ids := make([]*s3.ObjectIdentifier, 0, len(objects))
+	for _, obj := range objects {
+		if obj.Key == nil {
+			continue
+		}
+		ids = append(ids, &s3.ObjectIdentifier{Key: obj.Key})
+	}
+
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > deleteObjectsBatchSize {
+			batch = batch[:deleteObjectsBatchSize]
+		}
+		if _, err := client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: batch},
+		}); err != nil {
+			return err
+		}
+		ids = ids[len(batch):]
+	}
+	return nil
+}
+
+func (a *AWSSDKService) EnsureBucket(bucket string) error {
+	client, err := a.client()
+	if err != nil {
+		return err
+	}
+	if _, err := client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)}); err == nil {
+		return nil
+	}
+	_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	return err
+}
+
+func (a *AWSSDKService) RemoveBucket(bucket string) error {
+	client, err := a.client()
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+	return err
+}
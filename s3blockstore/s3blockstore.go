@@ -1,6 +1,8 @@
 package s3blockstore
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/rancherio/volmgr/blockstore"
@@ -8,6 +10,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -15,19 +18,58 @@ type S3BlockStoreDriver struct {
 	ID      string
 	Path    string
 	Service S3Service
+
+	// BucketPerVolume, when set, gives each volume its own S3 bucket
+	// (named Service.Bucket()+"-"+the volume's ID) instead of a shared
+	// prefix under Service.Bucket(), so an operator can scope IAM policy
+	// and lifecycle rules per volume. The bucket is created the first
+	// time this driver MkDirAll's a volume's root directory (i.e. on
+	// BlockStoreAddVolume) and removed when that root is RemoveAll'd.
+	BucketPerVolume bool
+
+	// knownBuckets caches which per-volume buckets this process has
+	// already confirmed exist, so AddVolume's several MkDirAll calls for
+	// the same new volume (root, snapshots, blocks) don't each pay for
+	// their own S3 BucketExists round trip. It's deliberately not
+	// persisted through FinalizeInit/util.SaveConfig: it's just a
+	// same-process cache, rebuilt lazily as volumes are touched again.
+	knownBuckets map[string]bool
 }
 
 const (
 	KIND = "s3"
 
-	S3_ACCESS_KEY = "s3.access_key"
-	S3_SECRET_KEY = "s3.secret_key"
-	S3_REGION     = "s3.region"
-	S3_BUCKET     = "s3.bucket"
-	S3_PATH       = "s3.path"
+	S3_ACCESS_KEY        = "s3.access_key"
+	S3_SECRET_KEY        = "s3.secret_key"
+	S3_REGION            = "s3.region"
+	S3_BUCKET            = "s3.bucket"
+	S3_PATH              = "s3.path"
+	S3_ENDPOINT          = "s3.endpoint"
+	S3_SSE               = "s3.sse"
+	S3_KMS_KEY_ID        = "s3.kms_key_id"
+	S3_STORAGE_CLASS     = "s3.storage_class"
+	S3_BUCKET_PER_VOLUME = "s3.bucket_per_volume"
+
+	// S3_DRIVER selects the S3Service implementation: "v2" (the
+	// default) for the original minio-go client, or "awssdk" for the
+	// aws-sdk-go-backed one with SigV4 signing, retries, and parallel
+	// multipart upload. S3_PART_SIZE/S3_PARALLELISM/S3_MAX_RETRIES only
+	// apply to "awssdk"; they're ignored by "v2".
+	S3_DRIVER      = "s3.driver"
+	S3_PART_SIZE   = "s3.part_size"
+	S3_PARALLELISM = "s3.parallelism"
+	S3_MAX_RETRIES = "s3.max_retries"
 
 	ENV_AWS_ACCESS_KEY = "AWS_ACCESS_KEY_ID"
 	ENV_AWS_SECRET_KEY = "AWS_SECRET_ACCESS_KEY"
+
+	// volumeDirName is the path component blockstore.go's getVolumePath
+	// shards volume IDs under. It isn't exported by that package, so
+	// BucketPerVolume mode matches on the literal here to tell a
+	// volume-rooted path apart from everything else this driver is
+	// asked to store, such as the global block pool or blockstore-level
+	// config files.
+	volumeDirName = "volume"
 )
 
 func init() {
@@ -48,16 +90,68 @@ func initFunc(root, cfgName string, config map[string]string) (blockstore.BlockS
 		}
 	}
 
-	b.Service.Keys.AccessKey = config[S3_ACCESS_KEY]
-	b.Service.Keys.SecretKey = config[S3_SECRET_KEY]
-	b.Service.Region = config[S3_REGION]
-	b.Service.Bucket = config[S3_BUCKET]
+	keys := S3Keys{AccessKey: config[S3_ACCESS_KEY], SecretKey: config[S3_SECRET_KEY]}
+	region := config[S3_REGION]
+	bucket := config[S3_BUCKET]
+	sse := config[S3_SSE]
 	b.Path = config[S3_PATH]
-	if b.Service.Keys.AccessKey == "" || b.Service.Keys.SecretKey == "" ||
-		b.Service.Region == "" || b.Service.Bucket == "" || b.Path == "" {
+	b.BucketPerVolume = config[S3_BUCKET_PER_VOLUME] == "true"
+	if keys.AccessKey == "" || keys.SecretKey == "" || region == "" || bucket == "" || b.Path == "" {
 		return nil, fmt.Errorf("Cannot find all required fields: %v %v %v %v %v",
 			S3_ACCESS_KEY, S3_SECRET_KEY, S3_REGION, S3_BUCKET, S3_PATH)
 	}
+	switch sse {
+	case "", "AES256", "aws:kms":
+	default:
+		return nil, fmt.Errorf("invalid value for %v: %v (expected \"AES256\" or \"aws:kms\")", S3_SSE, sse)
+	}
+
+	switch config[S3_DRIVER] {
+	case "", "v2":
+		b.Service = &MinioService{
+			Keys:                 keys,
+			Region:               region,
+			BucketName:           bucket,
+			Endpoint:             config[S3_ENDPOINT],
+			ServerSideEncryption: sse,
+			KMSKeyID:             config[S3_KMS_KEY_ID],
+			StorageClass:         config[S3_STORAGE_CLASS],
+		}
+	case "awssdk":
+		svc := &AWSSDKService{
+			Keys:                 keys,
+			Region:               region,
+			BucketName:           bucket,
+			Endpoint:             config[S3_ENDPOINT],
+			ServerSideEncryption: sse,
+			KMSKeyID:             config[S3_KMS_KEY_ID],
+			StorageClass:         config[S3_STORAGE_CLASS],
+		}
+		if v := config[S3_PART_SIZE]; v != "" {
+			size, err := util.ParseSize(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %v: %v", S3_PART_SIZE, err)
+			}
+			svc.PartSize = size
+		}
+		if v := config[S3_PARALLELISM]; v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %v: %v", S3_PARALLELISM, err)
+			}
+			svc.Parallelism = n
+		}
+		if v := config[S3_MAX_RETRIES]; v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %v: %v", S3_MAX_RETRIES, err)
+			}
+			svc.MaxRetries = n
+		}
+		b.Service = svc
+	default:
+		return nil, fmt.Errorf("invalid value for %v: %v (expected \"v2\" or \"awssdk\")", S3_DRIVER, config[S3_DRIVER])
+	}
 
 	//Test connection
 	if _, err := b.List(""); err != nil {
@@ -66,6 +160,77 @@ func initFunc(root, cfgName string, config map[string]string) (blockstore.BlockS
 	return b, nil
 }
 
+// s3BlockStoreDriverJSON mirrors S3BlockStoreDriver's persisted fields,
+// except Service is kept as raw JSON alongside a ServiceKind tag
+// recording which concrete type it was encoded from: util.SaveConfig/
+// util.LoadConfig round-trip a driver through encoding/json, which can't
+// unmarshal into a bare interface field on its own, so
+// S3BlockStoreDriver's own MarshalJSON/UnmarshalJSON below use this to
+// pick MinioService or AWSSDKService back out on reload (e.g. on daemon
+// restart, via initFunc's cfgName path).
+type s3BlockStoreDriverJSON struct {
+	ID              string
+	Path            string
+	BucketPerVolume bool
+	ServiceKind     string
+	Service         json.RawMessage
+}
+
+func (s *S3BlockStoreDriver) MarshalJSON() ([]byte, error) {
+	var kind string
+	switch s.Service.(type) {
+	case *MinioService:
+		kind = "v2"
+	case *AWSSDKService:
+		kind = "awssdk"
+	default:
+		return nil, fmt.Errorf("unknown S3Service implementation %T", s.Service)
+	}
+	serviceJSON, err := json.Marshal(s.Service)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&s3BlockStoreDriverJSON{
+		ID:              s.ID,
+		Path:            s.Path,
+		BucketPerVolume: s.BucketPerVolume,
+		ServiceKind:     kind,
+		Service:         serviceJSON,
+	})
+}
+
+func (s *S3BlockStoreDriver) UnmarshalJSON(data []byte) error {
+	aux := &s3BlockStoreDriverJSON{}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	s.ID = aux.ID
+	s.Path = aux.Path
+	s.BucketPerVolume = aux.BucketPerVolume
+
+	switch aux.ServiceKind {
+	case "", "v2":
+		svc := &MinioService{}
+		if len(aux.Service) > 0 {
+			if err := json.Unmarshal(aux.Service, svc); err != nil {
+				return err
+			}
+		}
+		s.Service = svc
+	case "awssdk":
+		svc := &AWSSDKService{}
+		if len(aux.Service) > 0 {
+			if err := json.Unmarshal(aux.Service, svc); err != nil {
+				return err
+			}
+		}
+		s.Service = svc
+	default:
+		return fmt.Errorf("unknown S3Service kind %q in saved config", aux.ServiceKind)
+	}
+	return nil
+}
+
 func (s *S3BlockStoreDriver) Kind() string {
 	return KIND
 }
@@ -74,6 +239,38 @@ func (s *S3BlockStoreDriver) updatePath(path string) string {
 	return filepath.Join(s.Path, path)
 }
 
+// volumeIDFromPath extracts a volume ID from a path shaped the way
+// blockstore.go's getVolumePath/getSnapshotsPath/getBlocksPath build it:
+// volume/<id[:2]>/<id[2:4]>/<id>[/...]. atRoot reports whether path is
+// the volume's root directory itself rather than something underneath
+// it. ok is false for any path that doesn't have that shape, e.g. the
+// global block pool or a blockstore config file.
+func volumeIDFromPath(path string) (id string, atRoot bool, ok bool) {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i, p := range parts {
+		if p == volumeDirName && len(parts) > i+3 {
+			return parts[i+3], len(parts) == i+4, true
+		}
+	}
+	return "", false, false
+}
+
+func (s *S3BlockStoreDriver) volumeBucketName(volumeID string) string {
+	return s.Service.Bucket() + "-" + volumeID
+}
+
+// bucketFor returns the bucket path's objects belong in: the per-volume
+// bucket if BucketPerVolume is set and path falls under a volume's
+// directory tree, the shared configured bucket otherwise.
+func (s *S3BlockStoreDriver) bucketFor(path string) string {
+	if s.BucketPerVolume {
+		if volumeID, _, ok := volumeIDFromPath(path); ok {
+			return s.volumeBucketName(volumeID)
+		}
+	}
+	return s.Service.Bucket()
+}
+
 func (s *S3BlockStoreDriver) FinalizeInit(root, cfgName, id string) error {
 	s.ID = id
 	if err := util.SaveConfig(root, cfgName, s); err != nil {
@@ -86,7 +283,7 @@ func (s *S3BlockStoreDriver) List(listPath string) ([]string, error) {
 	var result []string
 
 	path := s.updatePath(listPath)
-	contents, err := s.Service.ListObjects(path)
+	contents, err := s.Service.ListObjects(s.bucketFor(path), path)
 	if err != nil {
 		log.Error("Fail to list s3: ", err)
 		return result, err
@@ -110,36 +307,93 @@ func (s *S3BlockStoreDriver) FileExists(filePath string) bool {
 
 func (s *S3BlockStoreDriver) FileSize(filePath string) int64 {
 	path := s.updatePath(filePath)
-	contents, err := s.Service.ListObjects(path)
-	if err != nil {
+	size, exists, err := s.Service.StatObject(s.bucketFor(path), path)
+	if err != nil || !exists {
 		return -1
 	}
+	return size
+}
 
-	if len(contents) == 0 {
-		return -1
+// MkDirAll is otherwise a no-op: S3 has no real directory hierarchy, just
+// a flat key space under s.Path, so there's nothing to create ahead of a
+// Write under a new prefix. The one exception is BucketPerVolume mode,
+// where dirName landing on a volume's directory tree means this is
+// BlockStoreAddVolume provisioning that volume, so its bucket is created
+// here if it doesn't already exist.
+func (s *S3BlockStoreDriver) MkDirAll(dirName string) error {
+	if !s.BucketPerVolume {
+		return nil
 	}
-
-	//TODO deal with multiple returns
-	return *contents[0].Size
+	path := s.updatePath(dirName)
+	volumeID, _, ok := volumeIDFromPath(path)
+	if !ok {
+		return nil
+	}
+	bucket := s.volumeBucketName(volumeID)
+	if s.knownBuckets[bucket] {
+		return nil
+	}
+	if err := s.Service.EnsureBucket(bucket); err != nil {
+		return err
+	}
+	if s.knownBuckets == nil {
+		s.knownBuckets = make(map[string]bool)
+	}
+	s.knownBuckets[bucket] = true
+	return nil
 }
 
 func (s *S3BlockStoreDriver) Remove(name string) error {
 	path := s.updatePath(name)
-	return s.Service.DeleteObjects(path)
+	return s.Service.DeleteObjects(s.bucketFor(path), path)
+}
+
+// RemoveAll removes every object under name's prefix. Remove already does
+// this, since DeleteObjects lists and deletes everything under the prefix
+// rather than a single key. In BucketPerVolume mode, if name is a
+// volume's root directory itself (i.e. the whole volume is being
+// removed, not just something under it), the now-empty per-volume bucket
+// is deleted too.
+func (s *S3BlockStoreDriver) RemoveAll(name string) error {
+	if err := s.Remove(name); err != nil {
+		return err
+	}
+	if !s.BucketPerVolume {
+		return nil
+	}
+	path := s.updatePath(name)
+	volumeID, atRoot, ok := volumeIDFromPath(path)
+	if !ok || !atRoot {
+		return nil
+	}
+	bucket := s.volumeBucketName(volumeID)
+	if err := s.Service.RemoveBucket(bucket); err != nil {
+		return err
+	}
+	delete(s.knownBuckets, bucket)
+	return nil
 }
 
-func (s *S3BlockStoreDriver) Read(src string) (io.ReadCloser, error) {
+func (s *S3BlockStoreDriver) Read(ctx context.Context, src string) (io.ReadCloser, error) {
 	path := s.updatePath(src)
-	rc, err := s.Service.GetObject(path)
+	rc, err := s.Service.GetObject(ctx, s.bucketFor(path), path)
 	if err != nil {
 		return nil, err
 	}
 	return rc, nil
 }
 
-func (s *S3BlockStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+func (s *S3BlockStoreDriver) Write(ctx context.Context, dst string, rs io.ReadSeeker) error {
 	path := s.updatePath(dst)
-	return s.Service.PutObject(path, rs)
+	return s.Service.PutObject(ctx, s.bucketFor(path), path, rs)
+}
+
+// ReadRange reads length bytes starting at offset out of src, as a
+// server-side ranged GET rather than a full Read the caller would have
+// to seek/discard into itself.
+func (s *S3BlockStoreDriver) ReadRange(ctx context.Context, src string, offset, length int64) (io.ReadCloser, error) {
+	path := s.updatePath(src)
+	return s.Service.GetObjectRange(ctx, s.bucketFor(path), path, offset, length)
 }
 
 func (s *S3BlockStoreDriver) Upload(src, dst string) error {
@@ -149,7 +403,7 @@ func (s *S3BlockStoreDriver) Upload(src, dst string) error {
 	}
 	defer file.Close()
 	path := s.updatePath(dst)
-	return s.Service.PutObject(path, file)
+	return s.Service.PutObject(context.Background(), s.bucketFor(path), path, file)
 }
 
 func (s *S3BlockStoreDriver) Download(src, dst string) error {
@@ -162,7 +416,7 @@ func (s *S3BlockStoreDriver) Download(src, dst string) error {
 	}
 	defer f.Close()
 	path := s.updatePath(src)
-	rc, err := s.Service.GetObject(path)
+	rc, err := s.Service.GetObject(context.Background(), s.bucketFor(path), path)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,300 @@
+package s3blockstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	minio "github.com/minio/minio-go"
+
+	"github.com/rancherio/volmgr/api"
+)
+
+// S3Object carries just enough of minio's ObjectInfo to match the
+// pointer-style access already used by S3BlockStoreDriver (mirrors the
+// shape of the AWS SDK's s3.Object, which the rest of this package was
+// written against).
+type S3Object struct {
+	Key  *string
+	Size *int64
+}
+
+type S3Keys struct {
+	AccessKey string
+	SecretKey string
+}
+
+// S3Service is the S3 client abstraction S3BlockStoreDriver talks to.
+// MinioService is the original, minio-go-backed implementation.
+// AWSSDKService (see awssdk.go) is a newer, aws-sdk-go-backed one with
+// SigV4 signing, exponential-backoff retries, and parallel multipart
+// upload; pick between them with the s3.driver config key ("v2", the
+// default, or "awssdk").
+type S3Service interface {
+	// Bucket is the default bucket this service was configured with.
+	// Every method below also takes an explicit bucket argument, since
+	// BucketPerVolume mode routes some calls to a different, per-volume
+	// bucket instead.
+	Bucket() string
+	// StatObject reports key's size and whether it exists via a single
+	// HEAD-equivalent request, rather than ListObjects's list-and-scan.
+	StatObject(bucket, key string) (size int64, exists bool, err error)
+	ListObjects(bucket, key string) ([]S3Object, error)
+	// GetObject/GetObjectRange/PutObject take ctx so a block transfer
+	// can be cancelled the moment the caller's own request is done
+	// instead of running a multi-megabyte upload/download nobody is
+	// waiting for anymore. MinioService ignores it: its vendored client
+	// predates context support.
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+	// GetObjectRange is GetObject narrowed to a server-side ranged GET,
+	// so a caller reading one chunk out of a large block doesn't have
+	// to download and discard everything before it.
+	GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error)
+	PutObject(ctx context.Context, bucket, key string, rs io.ReadSeeker) error
+	DeleteObjects(bucket, key string) error
+	// EnsureBucket creates bucket if it doesn't already exist. It's
+	// used by BucketPerVolume mode to provision a volume's own bucket
+	// the first time the volume is added.
+	EnsureBucket(bucket string) error
+	// RemoveBucket deletes bucket, which must already be empty. It's
+	// used by BucketPerVolume mode to tear down a volume's bucket when
+	// the volume is removed.
+	RemoveBucket(bucket string) error
+}
+
+// MinioService is the original S3Service implementation, backed by
+// minio-go.
+type MinioService struct {
+	Keys       S3Keys
+	Region     string
+	BucketName string
+	Endpoint   string
+	UseSSL     bool
+
+	// ServerSideEncryption is the SSE mode requested for every object
+	// this service writes: "" for none, "AES256" for SSE-S3, or
+	// "aws:kms" for SSE-KMS (in which case KMSKeyID, if set, names the
+	// CMK to encrypt with).
+	ServerSideEncryption string
+	// KMSKeyID names the AWS KMS key used when ServerSideEncryption is
+	// "aws:kms". If empty, S3 encrypts with the account's default CMK.
+	KMSKeyID string
+	// StorageClass, if set, is passed through as the object's S3 storage
+	// class (e.g. "STANDARD_IA", "GLACIER").
+	StorageClass string
+
+	client *minio.Client
+}
+
+func (s *MinioService) Bucket() string {
+	return s.BucketName
+}
+
+func (s *MinioService) getClient() (*minio.Client, error) {
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	client, err := minio.NewWithRegion(endpoint, s.Keys.AccessKey, s.Keys.SecretKey, s.UseSSL, s.Region)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	return client, nil
+}
+
+// StatObject is a thin wrapper around minio's own StatObject, which is
+// itself a single HEAD request.
+func (s *MinioService) StatObject(bucket, key string) (int64, bool, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return 0, false, err
+	}
+	info, err := client.StatObject(bucket, key)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return info.Size, true, nil
+}
+
+func (s *MinioService) ListObjects(bucket, key string) ([]S3Object, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	var result []S3Object
+	for obj := range client.ListObjectsV2(bucket, key, true, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objKey := obj.Key
+		objSize := obj.Size
+		result = append(result, S3Object{Key: &objKey, Size: &objSize})
+	}
+	return result, nil
+}
+
+func (s *MinioService) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.GetObject(bucket, key)
+	if err != nil {
+		return nil, wrapMinioThrottling(err)
+	}
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, wrapMinioThrottling(err)
+	}
+	return obj, nil
+}
+
+// GetObjectRange relies on minio's *Object already being a lazy,
+// range-request-backed io.Seeker: seeking to offset before reading just
+// narrows the GET it issues under the hood instead of fetching and
+// discarding the bytes before offset.
+func (s *MinioService) GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.GetObject(bucket, key)
+	if err != nil {
+		return nil, wrapMinioThrottling(err)
+	}
+	if _, err := obj.Seek(offset, os.SEEK_SET); err != nil {
+		obj.Close()
+		return nil, wrapMinioThrottling(err)
+	}
+	return &limitedReadCloser{io.LimitReader(obj, length), obj}, nil
+}
+
+func (s *MinioService) PutObject(ctx context.Context, bucket, key string, rs io.ReadSeeker) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	size, err := rs.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	log.Debugf("Uploading %v bytes to s3://%v/%v", size, bucket, key)
+
+	metadata := map[string][]string{}
+	switch s.ServerSideEncryption {
+	case "":
+	case "AES256":
+		metadata["x-amz-server-side-encryption"] = []string{"AES256"}
+	case "aws:kms":
+		metadata["x-amz-server-side-encryption"] = []string{"aws:kms"}
+		if s.KMSKeyID != "" {
+			metadata["x-amz-server-side-encryption-aws-kms-key-id"] = []string{s.KMSKeyID}
+		}
+	default:
+		return fmt.Errorf("unsupported server-side encryption mode %q, expected \"AES256\" or \"aws:kms\"", s.ServerSideEncryption)
+	}
+	if s.StorageClass != "" {
+		metadata["x-amz-storage-class"] = []string{s.StorageClass}
+	}
+	if len(metadata) > 0 {
+		_, err = client.PutObjectWithMetadata(bucket, key, rs, metadata, nil)
+		return wrapMinioThrottling(err)
+	}
+
+	_, err = client.PutObject(bucket, key, rs, "application/octet-stream")
+	return wrapMinioThrottling(err)
+}
+
+// minioThrottleErrorCodes mirrors throttlingErrorCodes (awssdk.go) for the
+// S3-compatible XML error codes minio-go surfaces through
+// minio.ToErrorResponse instead of awserr.Error.
+var minioThrottleErrorCodes = map[string]bool{
+	"SlowDown":             true,
+	"RequestLimitExceeded": true,
+	"ThrottlingException":  true,
+}
+
+// wrapMinioThrottling is wrapThrottling's MinioService counterpart: same
+// *api.HTTPError-with-Retry-After translation, but recognizing minio-go's
+// ErrorResponse.Code instead of aws-sdk-go's awserr.Error.Code. Any other
+// error, including a nil one, passes through unchanged.
+func wrapMinioThrottling(err error) error {
+	if err == nil {
+		return nil
+	}
+	if code := minio.ToErrorResponse(err).Code; minioThrottleErrorCodes[code] {
+		return api.NewThrottledError(err.Error(), throttleRetryAfterSeconds)
+	}
+	return err
+}
+
+func (s *MinioService) DeleteObjects(bucket, key string) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	objects, err := s.ListObjects(bucket, key)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if obj.Key == nil {
+			continue
+		}
+		if err := client.RemoveObject(bucket, *obj.Key); err != nil {
+			return fmt.Errorf("failed to remove %v: %v", *obj.Key, err)
+		}
+	}
+	return nil
+}
+
+func (s *MinioService) EnsureBucket(bucket string) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	exists, err := client.BucketExists(bucket)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return client.MakeBucket(bucket, s.Region)
+}
+
+func (s *MinioService) RemoveBucket(bucket string) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	return client.RemoveBucket(bucket)
+}
+
+// limitedReadCloser pairs an io.LimitReader over a range read with the
+// underlying object's Close, so GetObjectRange callers still get a plain
+// io.ReadCloser to defer Close() on.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
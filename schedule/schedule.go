@@ -0,0 +1,257 @@
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancherio/volmgr/utils"
+
+	. "github.com/rancherio/volmgr/logging"
+)
+
+const (
+	POLICY_CFG_PREFIX  = "schedule_"
+	POLICY_CFG_POSTFIX = ".json"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "schedule"})
+)
+
+func generateError(fields logrus.Fields, format string, v ...interface{}) error {
+	return ErrorWithFields("schedule", fields, format, v)
+}
+
+// Policy is a GFS (grandfather-father-son) retention policy attached to a
+// single volume: Interval controls how often a snapshot is taken, and
+// Hourly/Daily/Weekly/Monthly control how many of the most recent snapshots
+// in each tier survive pruning.
+type Policy struct {
+	VolumeUUID string
+	Interval   time.Duration
+	Hourly     int
+	Daily      int
+	Weekly     int
+	Monthly    int
+}
+
+// SnapshotDriver is the subset of volume/snapshot operations a running
+// Policy needs. It's implemented against whichever snapshot subsystem the
+// caller wires up (blockstore, devmapper, objectstore, ...).
+type SnapshotDriver interface {
+	CreateSnapshot(volumeUUID string) (snapshotID string, err error)
+	ListSnapshots(volumeUUID string) (map[string]time.Time, error)
+	RemoveSnapshot(volumeUUID, snapshotID string) error
+	// HasPendingBackup reports whether a snapshot is the parent of an
+	// outstanding incremental backup chain and must not be pruned yet.
+	HasPendingBackup(volumeUUID, snapshotID string) bool
+}
+
+func getPolicyCfgName(volumeUUID string) string {
+	return POLICY_CFG_PREFIX + volumeUUID + POLICY_CFG_POSTFIX
+}
+
+// SetPolicy persists a retention policy for a volume, replacing any
+// existing one. The caller is responsible for (re)starting a Scheduler
+// against it if the daemon is already running.
+func SetPolicy(root string, policy Policy) error {
+	if policy.VolumeUUID == "" {
+		return fmt.Errorf("volume uuid is required for a snapshot schedule")
+	}
+	if err := utils.SaveConfig(root, getPolicyCfgName(policy.VolumeUUID), &policy); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_VOLUME: policy.VolumeUUID,
+		LOG_FIELD_EVENT:  LOG_EVENT_ADD,
+	}).Debug("Saved snapshot schedule policy")
+	return nil
+}
+
+// GetPolicy loads the retention policy for a volume, or nil if none is set.
+func GetPolicy(root, volumeUUID string) (*Policy, error) {
+	if !utils.ConfigExists(root, getPolicyCfgName(volumeUUID)) {
+		return nil, nil
+	}
+	policy := &Policy{}
+	if err := utils.LoadConfig(root, getPolicyCfgName(volumeUUID), policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// ClearPolicy removes a volume's retention policy. The caller must also
+// Stop() any running Scheduler entry for the volume.
+func ClearPolicy(root, volumeUUID string) error {
+	if !utils.ConfigExists(root, getPolicyCfgName(volumeUUID)) {
+		return nil
+	}
+	return utils.RemoveConfig(root, getPolicyCfgName(volumeUUID))
+}
+
+// Scheduler runs one ticker goroutine per active Policy, creating a
+// snapshot on each tick and then pruning according to the GFS policy.
+type Scheduler struct {
+	root   string
+	driver SnapshotDriver
+
+	mu       sync.Mutex
+	policies map[string]chan struct{} // volumeUUID -> stop channel
+}
+
+func NewScheduler(root string, driver SnapshotDriver) *Scheduler {
+	return &Scheduler{
+		root:     root,
+		driver:   driver,
+		policies: make(map[string]chan struct{}),
+	}
+}
+
+// LoadAll starts a goroutine for every policy found under root, meant to be
+// called once at daemon startup so policies persist across restarts.
+func (s *Scheduler) LoadAll() error {
+	ids := utils.ListConfigIDs(s.root, POLICY_CFG_PREFIX, POLICY_CFG_POSTFIX)
+	for _, volumeUUID := range ids {
+		policy, err := GetPolicy(s.root, volumeUUID)
+		if err != nil {
+			return err
+		}
+		if policy == nil {
+			continue
+		}
+		s.Start(*policy)
+	}
+	return nil
+}
+
+// Start begins (or restarts) running a policy.
+func (s *Scheduler) Start(policy Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stop, exists := s.policies[policy.VolumeUUID]; exists {
+		close(stop)
+	}
+	stop := make(chan struct{})
+	s.policies[policy.VolumeUUID] = stop
+	go s.run(policy, stop)
+}
+
+// Stop cancels the running goroutine for a volume, if any.
+func (s *Scheduler) Stop(volumeUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stop, exists := s.policies[volumeUUID]; exists {
+		close(stop)
+		delete(s.policies, volumeUUID)
+	}
+}
+
+func (s *Scheduler) run(policy Policy, stop chan struct{}) {
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.tick(policy); err != nil {
+				log.WithFields(logrus.Fields{
+					LOG_FIELD_VOLUME: policy.VolumeUUID,
+					LOG_FIELD_REASON: LOG_REASON_FAILURE,
+				}).Error("Scheduled snapshot failed: ", err)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) tick(policy Policy) error {
+	snapshotID, err := s.driver.CreateSnapshot(policy.VolumeUUID)
+	if err != nil {
+		return generateError(logrus.Fields{LOG_FIELD_VOLUME: policy.VolumeUUID}, "failed to create scheduled snapshot: %v", err)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_VOLUME:   policy.VolumeUUID,
+		LOG_FIELD_SNAPSHOT: snapshotID,
+		LOG_FIELD_EVENT:    LOG_EVENT_CREATE,
+	}).Debug("Created scheduled snapshot")
+
+	snapshots, err := s.driver.ListSnapshots(policy.VolumeUUID)
+	if err != nil {
+		return err
+	}
+
+	for _, discard := range snapshotsToPrune(time.Now(), snapshots, policy) {
+		if s.driver.HasPendingBackup(policy.VolumeUUID, discard) {
+			log.Debugf("Skipping prune of %v, it's the parent of an outstanding incremental backup", discard)
+			continue
+		}
+		if err := s.driver.RemoveSnapshot(policy.VolumeUUID, discard); err != nil {
+			return err
+		}
+		log.WithFields(logrus.Fields{
+			LOG_FIELD_VOLUME:   policy.VolumeUUID,
+			LOG_FIELD_SNAPSHOT: discard,
+			LOG_FIELD_EVENT:    LOG_EVENT_REMOVE,
+			LOG_FIELD_REASON:   "retention-policy",
+		}).Debug("Pruned snapshot")
+	}
+	return nil
+}
+
+type snapshotEntry struct {
+	id        string
+	createdAt time.Time
+}
+
+// snapshotsToPrune applies a grandfather-father-son policy to a volume's
+// snapshots and returns the IDs that fall outside every retention tier:
+// the Hourly most recent snapshots are always kept, then one snapshot per
+// day is promoted into the Daily tier, one per week into Weekly, and one
+// per month into Monthly.
+func snapshotsToPrune(now time.Time, snapshots map[string]time.Time, policy Policy) []string {
+	entries := make([]snapshotEntry, 0, len(snapshots))
+	for id, t := range snapshots {
+		entries = append(entries, snapshotEntry{id, t})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].createdAt.After(entries[j].createdAt)
+	})
+
+	keep := make(map[string]bool)
+	for i, e := range entries {
+		if i < policy.Hourly {
+			keep[e.id] = true
+		}
+	}
+
+	promote := func(bucket func(time.Time) string, n int) {
+		seen := make(map[string]bool)
+		for _, e := range entries {
+			if len(seen) >= n {
+				break
+			}
+			b := bucket(e.createdAt)
+			if !seen[b] {
+				seen[b] = true
+				keep[e.id] = true
+			}
+		}
+	}
+	promote(func(t time.Time) string { return t.Format("2006-01-02") }, policy.Daily)
+	promote(func(t time.Time) string { y, w := t.ISOWeek(); return fmt.Sprintf("%d-W%d", y, w) }, policy.Weekly)
+	promote(func(t time.Time) string { return t.Format("2006-01") }, policy.Monthly)
+
+	var discard []string
+	for _, e := range entries {
+		if !keep[e.id] {
+			discard = append(discard, e.id)
+		}
+	}
+	return discard
+}
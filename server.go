@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -13,8 +15,11 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	. "github.com/rancherio/volmgr/logging"
 )
@@ -23,21 +28,21 @@ func createRouter(s *Server) *mux.Router {
 	router := mux.NewRouter()
 	m := map[string]map[string]RequestHandler{
 		"GET": {
-			"/info":                                                                           s.doInfo,
-			"/volumes/":                                                                       s.doVolumeList,
-			"/volumes/uuid":                                                                   s.doVolumeListByName,
-			"/volumes/{volume-uuid}/":                                                         s.doVolumeList,
+			"/info":                   s.doInfo,
+			"/volumes/":               s.doVolumeList,
+			"/volumes/uuid":           s.doVolumeListByName,
+			"/volumes/{volume-uuid}/": s.doVolumeList,
 			"/volumes/{volume-uuid}/snapshots/{snapshot-uuid}/":                               s.doVolumeList,
 			"/blockstores/{blockstore-uuid}/volumes/{volume-uuid}/":                           s.doBlockStoreListVolume,
 			"/blockstores/{blockstore-uuid}/volumes/{volume-uuid}/snapshots/{snapshot-uuid}/": s.doBlockStoreListVolume,
 		},
 		"POST": {
-			"/volumes/create":                                                                        s.doVolumeCreate,
-			"/volumes/{volume-uuid}/mount":                                                           s.doVolumeMount,
-			"/volumes/{volume-uuid}/umount":                                                          s.doVolumeUmount,
-			"/volumes/{volume-uuid}/snapshots/create":                                                s.doSnapshotCreate,
-			"/blockstores/register":                                                                  s.doBlockStoreRegister,
-			"/blockstores/{blockstore-uuid}/volumes/{volume-uuid}/add":                               s.doBlockStoreAddVolume,
+			"/volumes/create":                                          s.doVolumeCreate,
+			"/volumes/{volume-uuid}/mount":                             s.doVolumeMount,
+			"/volumes/{volume-uuid}/umount":                            s.doVolumeUmount,
+			"/volumes/{volume-uuid}/snapshots/create":                  s.doSnapshotCreate,
+			"/blockstores/register":                                    s.doBlockStoreRegister,
+			"/blockstores/{blockstore-uuid}/volumes/{volume-uuid}/add": s.doBlockStoreAddVolume,
 			"/blockstores/{blockstore-uuid}/volumes/{volume-uuid}/snapshots/{snapshot-uuid}/backup":  s.doSnapshotBackup,
 			"/blockstores/{blockstore-uuid}/volumes/{volume-uuid}/snapshots/{snapshot-uuid}/restore": s.doSnapshotRestore,
 			"/blockstores/{blockstore-uuid}/images/add":                                              s.doBlockStoreAddImage,
@@ -56,7 +61,7 @@ func createRouter(s *Server) *mux.Router {
 	for method, routes := range m {
 		for route, f := range routes {
 			log.Debugf("Registering %s, %s", method, route)
-			handler := makeHandlerFunc(method, route, API_VERSION, f)
+			handler := makeHandlerFunc(method, route, API_VERSION, &s.inFlight, f)
 			router.Path("/v{version:[0-9.]+}" + route).Methods(method).HandlerFunc(handler)
 			router.Path(route).Methods(method).HandlerFunc(handler)
 		}
@@ -88,9 +93,22 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(info))
 }
 
-type RequestHandler func(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error
-
-func makeHandlerFunc(method string, route string, version string, f RequestHandler) http.HandlerFunc {
+// RequestHandler takes ctx, derived from the request itself, so a handler
+// wrapping a long operation (blockstore.BackupSnapshotWithOptions and
+// friends already take one) can pass it all the way down to the
+// BlockStoreDriver/S3Service call doing the actual transfer, and have
+// that transfer abandoned once the client disconnects instead of running
+// to completion unobserved. doInfo is the only RequestHandler actually
+// implemented in this package right now, so ctx has nowhere to flow to
+// yet - it's here so the next handler added doesn't have to change this
+// signature to get it.
+type RequestHandler func(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error
+
+// makeHandlerFunc wraps every call to f in inFlight.Add/Done, so
+// startServer's graceful shutdown can wait for whatever's already running
+// (a snapshot backup, an S3 upload) to finish - or time out - before
+// calling StorageDriver.Shutdown() out from under it.
+func makeHandlerFunc(method string, route string, version string, inFlight *sync.WaitGroup, f RequestHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Debugf("Calling: %v, %v, request: %v, %v", method, route, r.Method, r.RequestURI)
 
@@ -101,13 +119,39 @@ func makeHandlerFunc(method string, route string, version string, f RequestHandl
 				return
 			}
 		}
-		if err := f(version, w, r, mux.Vars(r)); err != nil {
+
+		inFlight.Add(1)
+		defer inFlight.Done()
+
+		if err := f(r.Context(), version, w, r, mux.Vars(r)); err != nil {
 			log.Errorf("Handler for %s %s returned error: %s", method, route, err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeHandlerError(w, err)
 		}
 	}
 }
 
+// writeHandlerError writes a RequestHandler's error back to the client: a
+// *api.HTTPError is written as a structured JSON body with its own Status
+// (and a Retry-After header, if RetryAfterSeconds is set), so a caller can
+// branch on Code instead of scraping response text. Any other error falls
+// back to the plain-text StatusBadRequest response this handler always
+// wrote before HTTPError existed.
+func writeHandlerError(w http.ResponseWriter, err error) {
+	httpErr, ok := err.(*api.HTTPError)
+	if !ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if httpErr.RetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(httpErr.RetryAfterSeconds))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpErr.Status)
+	if encErr := json.NewEncoder(w).Encode(httpErr); encErr != nil {
+		log.Errorf("Failed to encode HTTPError response: %s", encErr)
+	}
+}
+
 func loadServerConfig(c *cli.Context) (*Server, error) {
 	config := Config{}
 	root := c.String("root")
@@ -125,16 +169,26 @@ func loadServerConfig(c *cli.Context) (*Server, error) {
 	}
 
 	server := &Server{
-		Config:        config,
-		StorageDriver: driver,
-		NameVolumeMap: make(map[string]string),
+		Config:         config,
+		StorageDriver:  driver,
+		NameVolumeMap:  make(map[string]string),
+		MountRefCounts: make(map[string]int),
 	}
 
 	server.updateNameVolumeMap()
 	return server, nil
 }
 
+// updateNameVolumeMap rebuilds s.NameVolumeMap from every volume config on
+// disk. Two configs can legitimately collide on Name if the server
+// crashed mid-delete, leaving a stale config behind that was never
+// cleaned up; rather than hard-failing every subsequent start,
+// resolveNameConflict breaks the tie using the mount refcounts persisted
+// at the last clean shutdown (see serverState) - the name that was
+// actually mounted wins, and only an unresolvable collision still
+// returns the conflict error it always has.
 func (s *Server) updateNameVolumeMap() error {
+	prior := s.loadState()
 	volumeUUIDs := util.ListConfigIDs(s.Root, VOLUME_CFG_PREFIX, CFG_POSTFIX)
 	for _, uuid := range volumeUUIDs {
 		volume := s.loadVolume(uuid)
@@ -143,8 +197,14 @@ func (s *Server) updateNameVolumeMap() error {
 		}
 		if volume.Name != "" {
 			if oldUUID, exists := s.NameVolumeMap[volume.Name]; exists && oldUUID != uuid {
-				return fmt.Errorf("Duplicate volume name detected! %v used by both %v and %v",
-					oldUUID, uuid)
+				winner, resolved := resolveNameConflict(prior, oldUUID, uuid)
+				if !resolved {
+					return api.NewHTTPError(http.StatusConflict, "name_conflict",
+						fmt.Sprintf("Duplicate volume name %v detected, used by both %v and %v", volume.Name, oldUUID, uuid))
+				}
+				log.Warnf("Duplicate volume name %v used by both %v and %v; keeping %v, which was mounted at last clean shutdown", volume.Name, oldUUID, uuid, winner)
+				s.NameVolumeMap[volume.Name] = winner
+				continue
 			}
 			s.NameVolumeMap[volume.Name] = uuid
 		}
@@ -154,6 +214,93 @@ func (s *Server) updateNameVolumeMap() error {
 	return nil
 }
 
+// resolveNameConflict breaks a duplicate-name tie between two volume
+// UUIDs using the mount refcounts prior recorded at the last clean
+// shutdown. It only has an answer when exactly one of the two was
+// mounted then; if both or neither were (or prior is nil, e.g. the first
+// start against this root), ok is false and the caller should keep
+// treating the collision as fatal rather than guess.
+func resolveNameConflict(prior *serverState, a, b string) (winner string, ok bool) {
+	if prior == nil {
+		return "", false
+	}
+	aMounted := prior.MountRefCounts[a] > 0
+	bMounted := prior.MountRefCounts[b] > 0
+	if aMounted == bMounted {
+		return "", false
+	}
+	if aMounted {
+		return a, true
+	}
+	return b, true
+}
+
+// serverState is the subset of Server's bookkeeping that's persisted
+// across restarts: NameVolumeMap is rebuilt from the volume configs on
+// every start anyway, but MountRefCounts isn't recoverable any other
+// way, and resolveNameConflict needs last-known-good values for it to
+// survive a crash instead of just whatever's in memory at the next
+// unclean start.
+type serverState struct {
+	NameVolumeMap  map[string]string
+	MountRefCounts map[string]int
+}
+
+const serverStateCfg = "server_state.cfg"
+
+// saveState persists NameVolumeMap and MountRefCounts so the next start
+// has something to resolve a name collision against. It only logs on
+// failure rather than returning an error: it runs from cleanup(), during
+// shutdown, where there's no caller left to hand an error back to.
+func (s *Server) saveState() {
+	state := serverState{NameVolumeMap: s.NameVolumeMap, MountRefCounts: s.MountRefCounts}
+	if err := util.SaveConfig(s.Root, serverStateCfg, &state); err != nil {
+		log.Errorf("Failed to save server state: %v", err)
+	}
+}
+
+// loadState returns the state saved by the last saveState call, or nil if
+// there isn't one (first start against this root, or a crash before any
+// clean shutdown ever ran).
+func (s *Server) loadState() *serverState {
+	if !util.ConfigExists(s.Root, serverStateCfg) {
+		return nil
+	}
+	state := &serverState{}
+	if err := util.LoadConfig(s.Root, serverStateCfg, state); err != nil {
+		log.Errorf("Failed to load server state: %v", err)
+		return nil
+	}
+	return state
+}
+
+// mountRef and unmountRef are the bookkeeping side of doVolumeMount/
+// doVolumeUmount: they let cleanup() tell whether a volume is still
+// mounted before tearing down the storage driver, and give
+// resolveNameConflict something to break a duplicate-name tie with after
+// a crash. doVolumeMount/doVolumeUmount, registered in createRouter,
+// aren't implemented anywhere in this package yet (the only RequestHandler
+// that is, right now, is doInfo) - until one of them calls mountRef,
+// MountRefCounts stays empty and hasActiveMounts always reports false.
+func (s *Server) mountRef(uuid string) {
+	s.MountRefCounts[uuid]++
+}
+
+func (s *Server) unmountRef(uuid string) {
+	if s.MountRefCounts[uuid] > 0 {
+		s.MountRefCounts[uuid]--
+	}
+}
+
+func (s *Server) hasActiveMounts() bool {
+	for _, count := range s.MountRefCounts {
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func serverEnvironmentSetup(c *cli.Context) error {
 	root := c.String("root")
 	if root == "" {
@@ -193,12 +340,21 @@ func writeResponseOutput(w http.ResponseWriter, v interface{}) error {
 	return err
 }
 
+// cleanup persists NameVolumeMap/MountRefCounts for the next start, then
+// shuts down the storage driver - but only if nothing is mounted.
+// Shutdown() used to be skipped unconditionally ("cleanup doesn't work
+// with mounted volume") because tearing down the driver out from under a
+// mounted volume can corrupt it; now that mounts are refcounted, that
+// check can be made directly instead of never calling Shutdown at all.
 func (s *Server) cleanup() {
-	/* cleanup doesn't works with mounted volume
+	s.saveState()
+	if s.hasActiveMounts() {
+		log.Warn("Skipping storage driver shutdown: volumes are still mounted")
+		return
+	}
 	if err := s.StorageDriver.Shutdown(); err != nil {
-		log.Error("fail to shutdown driver: ", err.Error())
+		log.Errorf("Failed to shutdown driver: %v", err)
 	}
-	*/
 }
 
 func environmentCleanup() {
@@ -221,6 +377,11 @@ func cmdStartServer(c *cli.Context) {
 	}
 }
 
+// defaultShutdownTimeout bounds how long startServer waits, on SIGTERM/
+// SIGINT, for in-flight requests to drain before giving up on them and
+// calling cleanup() anyway. --shutdown-timeout overrides it.
+const defaultShutdownTimeout = 30 * time.Second
+
 func startServer(c *cli.Context) error {
 	var err error
 	if err = serverEnvironmentSetup(c); err != nil {
@@ -243,6 +404,15 @@ func startServer(c *cli.Context) error {
 	}
 	defer server.cleanup()
 
+	server.ShutdownTimeout = defaultShutdownTimeout
+	if raw := c.String("shutdown-timeout"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("Invalid shutdown-timeout %q: %v", raw, err)
+		}
+		server.ShutdownTimeout = d
+	}
+
 	server.Router = createRouter(server)
 
 	if err := util.MkdirIfNotExists(filepath.Dir(sockFile)); err != nil {
@@ -254,26 +424,59 @@ func startServer(c *cli.Context) error {
 		fmt.Println("listen err", err)
 		return err
 	}
-	defer l.Close()
+
+	httpServer := &http.Server{Handler: server.Router}
 
 	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
 	signal.Notify(sigs, os.Interrupt, os.Kill, syscall.SIGTERM)
+
+	serveErrs := make(chan error, 1)
 	go func() {
-		sig := <-sigs
-		fmt.Printf("Caught signal %s: shutting down.\n", sig)
-		done <- true
+		serveErrs <- httpServer.Serve(l)
 	}()
 
-	go func() {
-		err = http.Serve(l, server.Router)
-		if err != nil {
+	select {
+	case sig := <-sigs:
+		fmt.Printf("Caught signal %s: shutting down.\n", sig)
+	case err := <-serveErrs:
+		l.Close()
+		if err != nil && err != http.ErrServerClosed {
 			log.Error("http server error", err.Error())
+			return err
 		}
-		done <- true
+		return nil
+	}
+
+	// Stop accepting new connections right away. httpServer.Shutdown and
+	// the inFlight drain both race against the same deadline rather than
+	// running one after the other, so a handler that's slow to notice
+	// its connection closing doesn't eat into the drain's own budget -
+	// they're two views of the same in-progress work (a snapshot backup,
+	// an S3 upload), not two sequential steps.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), server.ShutdownTimeout)
+	defer cancel()
+
+	httpShutdownDone := make(chan error, 1)
+	go func() {
+		httpShutdownDone <- httpServer.Shutdown(shutdownCtx)
+	}()
+
+	drained := make(chan struct{})
+	go func() {
+		server.inFlight.Wait()
+		close(drained)
 	}()
 
-	<-done
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		log.Warnf("Timed out after %v waiting for in-flight requests to finish", server.ShutdownTimeout)
+	}
+
+	if err := <-httpShutdownDone; err != nil {
+		log.Errorf("Error shutting down HTTP server cleanly: %v", err)
+	}
+
 	return nil
 }
 
@@ -335,9 +538,10 @@ func initServer(c *cli.Context) (*Server, error) {
 		DefaultVolumeSize: size,
 	}
 	server := &Server{
-		Config:        config,
-		StorageDriver: driver,
-		NameVolumeMap: make(map[string]string),
+		Config:         config,
+		StorageDriver:  driver,
+		NameVolumeMap:  make(map[string]string),
+		MountRefCounts: make(map[string]int),
 	}
 	err = util.SaveConfig(root, getCfgName(), &config)
 	return server, err
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+
+	"github.com/rancher/rancher-volume/api"
+	"github.com/rancher/rancher-volume/objectstore"
+	"github.com/rancher/rancher-volume/util"
+)
+
+// defaultBackupGCGracePeriod mirrors objectstore's own default: skip
+// chunks younger than this so doBackupGC never races an in-flight
+// doBackupCreate whose manifest hasn't been written yet.
+const defaultBackupGCGracePeriod = time.Hour
+
+// doBackupCreate content-defined-chunks the volume's current content to
+// request.URL, deduplicating against every other backup ever taken to
+// that destination. Backups are per-volume rather than per-snapshot for
+// now, since this tree has no snapshot subsystem yet (see doSnapshotCreate);
+// request.SnapshotUUID is read as the UUID of the volume to back up.
+func (s *Server) doBackupCreate(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupCreateConfig{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if request.URL == "" {
+		return util.RequiredMissingError("url")
+	}
+
+	// SnapshotUUID is actually a volume UUID - see processBackupCreate.
+	unlock := s.VolumeLocks.Lock(request.SnapshotUUID)
+	defer unlock()
+
+	resp, err := s.processBackupCreate(ctx, request)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, *resp)
+}
+
+// processBackupCreate is doBackupCreate's logic without the HTTP
+// request/response plumbing, so CreateBackup can drive it directly too.
+func (s *Server) processBackupCreate(ctx context.Context, request *api.BackupCreateConfig) (*api.BackupResponse, error) {
+	volume := s.loadVolume(request.SnapshotUUID)
+	if volume == nil {
+		return nil, fmt.Errorf("Cannot find volume %v", request.SnapshotUUID)
+	}
+
+	volOps, err := s.getVolumeOpsForVolume(volume)
+	if err != nil {
+		return nil, err
+	}
+	mountPoint, err := volOps.MountVolume(volume.UUID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer volOps.UmountVolume(volume.UUID)
+
+	src, err := os.Open(filepath.Join(mountPoint, objectstore.VolumeDataFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		// Nothing has been written to the volume yet: back up an empty
+		// stream rather than failing outright.
+		src, err = os.Open(os.DevNull)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer src.Close()
+
+	backupID := uuid.New()
+	backupURL, err := objectstore.CreateBackup(ctx, request.URL, volume.UUID, volume.Size, backupID, src, volume.SourceBackupURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.BackupResponse{
+		URL:          backupURL,
+		VolumeUUID:   volume.UUID,
+		SnapshotUUID: request.SnapshotUUID,
+	}, nil
+}
+
+func (s *Server) doBackupList(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	query := r.URL.Query()
+	destURL := query.Get("URL")
+	volumeUUID := query.Get("VolumeUUID")
+	if destURL == "" {
+		return util.RequiredMissingError("URL")
+	}
+	if volumeUUID == "" {
+		return util.RequiredMissingError("VolumeUUID")
+	}
+
+	urls, err := objectstore.ListBackups(destURL, volumeUUID)
+	if err != nil {
+		return err
+	}
+
+	resp := api.BackupsResponse{Backups: make(map[string]api.BackupResponse)}
+	for _, backupURL := range urls {
+		resp.Backups[backupURL] = api.BackupResponse{URL: backupURL, VolumeUUID: volumeUUID}
+	}
+	return writeResponseOutput(w, resp)
+}
+
+func (s *Server) doBackupInspect(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	backupURL := r.URL.Query().Get("URL")
+	if backupURL == "" {
+		return util.RequiredMissingError("URL")
+	}
+
+	manifest, err := objectstore.InspectBackup(backupURL)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, manifest)
+}
+
+func (s *Server) doBackupDelete(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupDeleteConfig{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if request.URL == "" {
+		return util.RequiredMissingError("url")
+	}
+	return objectstore.DeleteBackup(request.URL)
+}
+
+// doBackupReplicate copies request.URL's manifest and referenced chunks
+// to request.Dest, reusing whatever request.Dest already has by checksum
+// (and, if request.IncrementalFromURL is set, assuming it already has
+// everything that backup referenced without re-checking).
+func (s *Server) doBackupReplicate(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupReplicateConfig{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if request.URL == "" {
+		return util.RequiredMissingError("url")
+	}
+	if request.Dest == "" {
+		return util.RequiredMissingError("dest")
+	}
+
+	backupURL, err := objectstore.ReplicateBackup(ctx, request.URL, request.Dest, request.IncrementalFromURL)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, api.BackupResponse{URL: backupURL})
+}
+
+// doBackupGC removes every chunk object under request.URL that no live
+// backup of request.VolumeUUID references anymore and that's older than
+// request.GracePeriodSeconds (defaultBackupGCGracePeriod if omitted).
+func (s *Server) doBackupGC(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupGCConfig{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if request.URL == "" {
+		return util.RequiredMissingError("url")
+	}
+	if request.VolumeUUID == "" {
+		return util.RequiredMissingError("VolumeUUID")
+	}
+
+	grace := defaultBackupGCGracePeriod
+	if request.GracePeriodSeconds > 0 {
+		grace = time.Duration(request.GracePeriodSeconds) * time.Second
+	}
+
+	removed, err := objectstore.GC(ctx, request.URL, request.VolumeUUID, grace)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, api.BackupGCResponse{ChunksRemoved: removed})
+}
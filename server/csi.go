@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/rancher-volume/api"
+	"github.com/rancher/rancher-volume/objectstore"
+)
+
+// The methods in this file are the same entry points the HTTP handlers in
+// volume.go/backup.go call (processVolumeCreate, processVolumeMount, ...),
+// exported so a second frontend - the csi package's gRPC services - can
+// drive the identical Server and StorageDriver the HTTP API uses, without
+// going through HTTP or duplicating any of this package's locking,
+// indexing, or event-publishing.
+
+// CreateVolume is doVolumeCreate's logic without the HTTP request/response
+// plumbing. Callers must not already hold VolumeLocks.Lock(name).
+func (s *Server) CreateVolume(ctx context.Context, name, driverName string, size int64, opts ...CreateOption) (*Volume, error) {
+	unlock := s.VolumeLocks.Lock(name)
+	defer unlock()
+	return s.processVolumeCreate(ctx, name, driverName, size, opts...)
+}
+
+// DeleteVolume is doVolumeDelete's logic, addressed by UUID directly.
+func (s *Server) DeleteVolume(ctx context.Context, volumeUUID string, opts ...RemoveOption) error {
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+	return s.processVolumeDelete(ctx, volumeUUID, opts...)
+}
+
+// GetVolume looks up a volume by UUID, returning nil if it doesn't exist.
+func (s *Server) GetVolume(volumeUUID string) *Volume {
+	return s.loadVolume(volumeUUID)
+}
+
+// MountVolume is doVolumeMount's logic, addressed by UUID directly.
+func (s *Server) MountVolume(volumeUUID, mountPoint string) (string, error) {
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+
+	volume := s.loadVolume(volumeUUID)
+	if volume == nil {
+		return "", fmt.Errorf("volume %v doesn't exist", volumeUUID)
+	}
+	return s.processVolumeMount(volume, &api.VolumeMountRequest{VolumeUUID: volumeUUID, MountPoint: mountPoint})
+}
+
+// UnmountVolume is doVolumeUmount's logic, addressed by UUID directly.
+func (s *Server) UnmountVolume(volumeUUID string) error {
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+
+	volume := s.loadVolume(volumeUUID)
+	if volume == nil {
+		return fmt.Errorf("volume %v doesn't exist", volumeUUID)
+	}
+	return s.processVolumeUmount(volume)
+}
+
+// CreateBackup is doBackupCreate's logic, callable without an HTTP
+// request. Like doBackupCreate, it holds volumeUUID's lock for the
+// duration of the backup so it can't race a concurrent mount/delete of
+// the same volume - but a concurrent backup of a different volume
+// proceeds in parallel.
+func (s *Server) CreateBackup(ctx context.Context, destURL, volumeUUID string) (*api.BackupResponse, error) {
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+	return s.processBackupCreate(ctx, &api.BackupCreateConfig{URL: destURL, SnapshotUUID: volumeUUID})
+}
+
+// DeleteBackup is doBackupDelete's logic, callable without an HTTP request.
+func (s *Server) DeleteBackup(backupURL string) error {
+	return objectstore.DeleteBackup(backupURL)
+}
+
+// ListBackups is doBackupList's logic, callable without an HTTP request.
+func (s *Server) ListBackups(destURL, volumeUUID string) ([]string, error) {
+	return objectstore.ListBackups(destURL, volumeUUID)
+}
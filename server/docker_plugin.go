@@ -0,0 +1,425 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/rancher/rancher-volume/api"
+	"github.com/rancher/rancher-volume/util"
+)
+
+// dockerPluginSockFile is where the Docker daemon looks for a managed
+// plugin's socket when it's addressed as --volume-driver=convoy. It's
+// served alongside, not instead of, convoy's own API socket: both listen
+// on the same *mux.Router, so every route registered in createRouter is
+// reachable from either one.
+const dockerPluginSockFile = "/run/docker/plugins/convoy.sock"
+
+// dockerPluginContentType is the content type the Docker Volume Plugin
+// protocol requires on every response.
+const dockerPluginContentType = "application/vnd.docker.plugins.v1.1+json"
+
+type dockerPluginRequest struct {
+	Name string
+	ID   string
+	Opts map[string]string
+}
+
+type dockerPluginResponse struct {
+	Mountpoint   string                    `json:"Mountpoint,omitempty"`
+	Err          string                    `json:"Err"`
+	Volume       *dockerPluginVolume       `json:"Volume,omitempty"`
+	Volumes      []*dockerPluginVolume     `json:"Volumes,omitempty"`
+	Capabilities *dockerPluginCapabilities `json:"Capabilities,omitempty"`
+	Implements   []string                  `json:"Implements,omitempty"`
+}
+
+type dockerPluginVolume struct {
+	Name       string `json:"Name"`
+	Mountpoint string `json:"Mountpoint,omitempty"`
+}
+
+type dockerPluginCapabilities struct {
+	Scope string `json:"Scope"`
+}
+
+// listenDockerPlugin opens the unix socket Docker discovers convoy's
+// volume plugin on. It's a plain net.Listener, not an http.Server of its
+// own, so the caller can hand it the same router that already serves the
+// regular API.
+func listenDockerPlugin() (net.Listener, error) {
+	if err := util.MkdirIfNotExists(filepath.Dir(dockerPluginSockFile)); err != nil {
+		return nil, err
+	}
+	os.Remove(dockerPluginSockFile)
+	return net.Listen("unix", dockerPluginSockFile)
+}
+
+// dockerPluginSpecDir is where the Docker daemon looks for a plugin's
+// discovery file when it isn't found under /run/docker/plugins, e.g.
+// because it's being reached over --plugin-host from a different host in
+// a Swarm cluster rather than the local unix socket.
+const dockerPluginSpecDir = "/etc/docker/plugins"
+
+// dockerPluginSpecName is the plugin name Docker matches against
+// --volume-driver=convoy, shared by both the unix socket
+// (dockerPluginSockFile) and the discovery files writePluginSpec writes.
+const dockerPluginSpecName = "convoy"
+
+// listenDockerPluginTCP opens an additional TCP listener for the Docker
+// Volume Plugin endpoints when --plugin-host is given, wrapped in mutual
+// TLS the same way the main --host listener is (see listenTLS). This is
+// served alongside, not instead of, the unix socket from
+// listenDockerPlugin, so convoy can be reached as a remote volume plugin
+// by a Docker daemon on another host in a Swarm / multi-host cluster
+// while still working unmodified for local, single-host use. It returns a
+// nil listener, not an error, when --plugin-host is unset.
+//
+// Unlike the unix socket, this exposes the full API (Server.Router, same
+// as --host), not just the plugin routes, so an operator setting
+// --plugin-host without --auth-token and without --plugin-tls-ca is
+// opting into an unauthenticated network-reachable API exactly as they
+// would be by setting --host without --auth-token.
+func listenDockerPluginTCP(c *cli.Context) (net.Listener, error) {
+	host := c.String("plugin-host")
+	if host == "" {
+		return nil, nil
+	}
+	return listenTLS(host, c.String("plugin-tls-cert"), c.String("plugin-tls-key"), c.String("plugin-tls-ca"))
+}
+
+// pluginSpecJSON is the .json discovery file format the Docker daemon
+// reads for a plugin it can't assume a bare TCP address for, i.e. one
+// requiring TLS: Addr plus the client TLS material needed to dial it.
+type pluginSpecJSON struct {
+	Addr      string          `json:"Addr"`
+	TLSConfig *pluginTLSPaths `json:"TLSConfig,omitempty"`
+}
+
+type pluginTLSPaths struct {
+	CAFile   string `json:"CAFile,omitempty"`
+	CertFile string `json:"CertFile,omitempty"`
+	KeyFile  string `json:"KeyFile,omitempty"`
+}
+
+// writePluginSpec advertises host as convoy's remote Docker Volume Plugin
+// endpoint under dockerPluginSpecDir, so a Docker daemon on another host
+// in the cluster can discover it the same way it discovers a local,
+// unix-socket-based plugin. A plain .spec file (a bare address) is enough
+// for an unencrypted listener; TLS can't be expressed in that format, so
+// a TLS-enabled listener gets a .json file with an https:// Addr and
+// tlsCA (the CA that signed the listener's certificate, also used by
+// listenTLS to verify incoming client certs), if any, as CAFile. It can't
+// populate CertFile/KeyFile: those would be the connecting Docker
+// daemon's own client identity for mutual TLS, which the server never
+// possesses, so an operator requiring mutual TLS must provision and
+// configure that daemon's client cert/key out of band.
+//
+// host is advertised verbatim, so a wildcard --plugin-host like
+// 0.0.0.0:8989 (valid for listenTLS, which only needs it to bind) is
+// written as-is and isn't a routable address for a remote daemon; an
+// operator serving this to other hosts in a cluster should pass
+// --plugin-host a specific, externally-reachable address.
+func writePluginSpec(host string, tlsEnabled bool, tlsCA string) error {
+	if err := util.MkdirIfNotExists(dockerPluginSpecDir); err != nil {
+		return err
+	}
+
+	specPath := filepath.Join(dockerPluginSpecDir, dockerPluginSpecName+".spec")
+	jsonPath := filepath.Join(dockerPluginSpecDir, dockerPluginSpecName+".json")
+
+	if !tlsEnabled {
+		os.Remove(jsonPath)
+		return util.WriteFile(specPath, []byte("tcp://"+host))
+	}
+
+	spec := &pluginSpecJSON{Addr: "https://" + host}
+	if tlsCA != "" {
+		spec.TLSConfig = &pluginTLSPaths{CAFile: tlsCA}
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	os.Remove(specPath)
+	return util.WriteFile(jsonPath, data)
+}
+
+func decodeDockerPluginRequest(r *http.Request) (*dockerPluginRequest, error) {
+	req := &dockerPluginRequest{}
+	if r.ContentLength == 0 {
+		return req, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func writeDockerPluginResponse(w http.ResponseWriter, resp *dockerPluginResponse) {
+	w.Header().Set("Content-Type", dockerPluginContentType)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func dockerPluginError(w http.ResponseWriter, err error) {
+	writeDockerPluginResponse(w, &dockerPluginResponse{Err: err.Error()})
+}
+
+func (s *Server) dockerActivate(w http.ResponseWriter, r *http.Request) {
+	writeDockerPluginResponse(w, &dockerPluginResponse{Implements: []string{"VolumeDriver"}})
+}
+
+// dockerCreateVolume is idempotent: docker run re-attaching to a volume
+// convoy already knows about must not fail Create just because it
+// already exists.
+func (s *Server) dockerCreateVolume(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeDockerPluginRequest(r)
+	if err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+
+	// See doVolumeCreate: no UUID is minted yet, so this is keyed by the
+	// requested name instead.
+	unlock := s.VolumeLocks.Lock(req.Name)
+	defer unlock()
+
+	if s.loadVolumeByName(req.Name) != nil {
+		writeDockerPluginResponse(w, &dockerPluginResponse{})
+		return
+	}
+
+	size := s.DefaultVolumeSize
+	if sizeOpt := req.Opts["size"]; sizeOpt != "" {
+		size, err = util.ParseSize(sizeOpt)
+		if err != nil {
+			dockerPluginError(w, err)
+			return
+		}
+	}
+
+	// "snapshot" is accepted as an alias for "backup": in convoy's object
+	// store model a snapshot is only ever reachable through the backup URL
+	// it was uploaded under, so "create a volume from this snapshot" and
+	// "create a volume from this backup" are the same restore.
+	backupURL := req.Opts["backup"]
+	if backupURL == "" {
+		backupURL = req.Opts["snapshot"]
+	}
+	opts := []CreateOption{}
+	if backupURL != "" {
+		opts = append(opts, WithBackupURL(backupURL))
+	}
+
+	if _, err := s.processVolumeCreate(r.Context(), req.Name, req.Opts["driver"], size, opts...); err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+	writeDockerPluginResponse(w, &dockerPluginResponse{})
+}
+
+func (s *Server) dockerRemoveVolume(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeDockerPluginRequest(r)
+	if err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+
+	volume := s.loadVolumeByName(req.Name)
+	if volume == nil {
+		dockerPluginError(w, fmt.Errorf("volume %v doesn't exist", req.Name))
+		return
+	}
+
+	unlock := s.VolumeLocks.Lock(volume.UUID)
+	defer unlock()
+
+	if err := s.processVolumeDelete(r.Context(), volume.UUID); err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+	writeDockerPluginResponse(w, &dockerPluginResponse{})
+}
+
+// dockerMountVolume reference-counts by req.ID, so the same volume shared
+// between several containers on this host is only actually mounted once
+// and only actually unmounted once the last container lets go of it.
+func (s *Server) dockerMountVolume(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeDockerPluginRequest(r)
+	if err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+
+	// Look up the UUID and take its lock before loading the volume, not
+	// after: loading first and locking second would let two concurrent
+	// mounts of the same volume each hold their own pre-lock copy of
+	// MountCount/DockerIDs, so the second to actually run under the lock
+	// would save over the first's update instead of building on it.
+	volumeUUID := s.NameUUIDIndex.Get(req.Name)
+	if volumeUUID == "" {
+		dockerPluginError(w, fmt.Errorf("volume %v doesn't exist", req.Name))
+		return
+	}
+
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+
+	volume := s.loadVolume(volumeUUID)
+	if volume == nil {
+		dockerPluginError(w, fmt.Errorf("volume %v doesn't exist", req.Name))
+		return
+	}
+
+	if volume.MountCount == 0 {
+		mountPoint, err := s.processVolumeMount(volume, &api.VolumeMountRequest{VolumeUUID: volume.UUID})
+		if err != nil {
+			dockerPluginError(w, err)
+			return
+		}
+		volume.MountPoint = mountPoint
+	}
+	volume.DockerIDs = append(volume.DockerIDs, req.ID)
+	volume.MountCount++
+	if err := s.saveVolume(volume); err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+
+	writeDockerPluginResponse(w, &dockerPluginResponse{Mountpoint: volume.MountPoint})
+}
+
+func (s *Server) dockerUnmountVolume(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeDockerPluginRequest(r)
+	if err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+
+	// See dockerMountVolume: look up the UUID and lock it before loading
+	// the volume, so this doesn't save a pre-lock copy over a concurrent
+	// mount/unmount's update.
+	volumeUUID := s.NameUUIDIndex.Get(req.Name)
+	if volumeUUID == "" {
+		dockerPluginError(w, fmt.Errorf("volume %v doesn't exist", req.Name))
+		return
+	}
+
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+
+	volume := s.loadVolume(volumeUUID)
+	if volume == nil {
+		dockerPluginError(w, fmt.Errorf("volume %v doesn't exist", req.Name))
+		return
+	}
+
+	if volume.MountCount == 0 {
+		dockerPluginError(w, fmt.Errorf("volume %v is not mounted", req.Name))
+		return
+	}
+
+	volume.DockerIDs = removeString(volume.DockerIDs, req.ID)
+	volume.MountCount--
+	if volume.MountCount == 0 {
+		if err := s.processVolumeUmount(volume); err != nil {
+			dockerPluginError(w, err)
+			return
+		}
+		volume.MountPoint = ""
+	}
+	if err := s.saveVolume(volume); err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+	writeDockerPluginResponse(w, &dockerPluginResponse{})
+}
+
+func (s *Server) dockerVolumePath(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeDockerPluginRequest(r)
+	if err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+
+	volume := s.loadVolumeByName(req.Name)
+	if volume == nil {
+		dockerPluginError(w, fmt.Errorf("volume %v doesn't exist", req.Name))
+		return
+	}
+	mountPoint, err := s.getVolumeMountPoint(volume)
+	if err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+	writeDockerPluginResponse(w, &dockerPluginResponse{Mountpoint: mountPoint})
+}
+
+func (s *Server) dockerGetVolume(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeDockerPluginRequest(r)
+	if err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+
+	volume := s.loadVolumeByName(req.Name)
+	if volume == nil {
+		dockerPluginError(w, fmt.Errorf("volume %v doesn't exist", req.Name))
+		return
+	}
+	mountPoint, err := s.getVolumeMountPoint(volume)
+	if err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+	writeDockerPluginResponse(w, &dockerPluginResponse{
+		Volume: &dockerPluginVolume{Name: volume.Name, Mountpoint: mountPoint},
+	})
+}
+
+func (s *Server) dockerListVolumes(w http.ResponseWriter, r *http.Request) {
+	volumeUUIDs, err := util.ListConfigIDs(s.Root, VOLUME_CFG_PREFIX, CFG_POSTFIX)
+	if err != nil {
+		dockerPluginError(w, err)
+		return
+	}
+
+	volumes := make([]*dockerPluginVolume, 0, len(volumeUUIDs))
+	for _, uuid := range volumeUUIDs {
+		volume := s.loadVolume(uuid)
+		if volume == nil || volume.Name == "" {
+			continue
+		}
+		mountPoint, _ := s.getVolumeMountPoint(volume)
+		volumes = append(volumes, &dockerPluginVolume{Name: volume.Name, Mountpoint: mountPoint})
+	}
+	writeDockerPluginResponse(w, &dockerPluginResponse{Volumes: volumes})
+}
+
+// dockerCapabilities reports "global" scope, meaning the volume is usable
+// from any host in the cluster, only when convoy is backed by a shared
+// remote driver. The local devicemapper driver ties a volume to this
+// host's block devices, so it stays "local".
+func (s *Server) dockerCapabilities(w http.ResponseWriter, r *http.Request) {
+	scope := "local"
+	if s.DefaultDriver != "" && s.DefaultDriver != "devicemapper" {
+		scope = "global"
+	}
+	writeDockerPluginResponse(w, &dockerPluginResponse{Capabilities: &dockerPluginCapabilities{Scope: scope}})
+}
+
+func removeString(list []string, target string) []string {
+	result := make([]string, 0, len(list))
+	for _, s := range list {
+		if s != target {
+			result = append(result, s)
+		}
+	}
+	return result
+}
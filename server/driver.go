@@ -0,0 +1,55 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/rancher/rancher-volume/driver"
+	"github.com/rancher/rancher-volume/storagedriver"
+)
+
+// getDriver resolves driverName to a Driver, preferring an already
+// initialized one cached in StorageDrivers. Names of the form
+// "plugin:<name>" route to an out-of-process Docker Volume Plugin
+// instead of one of Convoy's built-in drivers; those are looked up
+// directly rather than through driver.GetDriver's built-in registry, and
+// cached the same way so repeated calls don't redo plugin discovery and
+// the health check on every request.
+func (s *Server) getDriver(driverName string) (driver.Driver, error) {
+	if driverName == "" {
+		driverName = s.DefaultDriver
+	}
+
+	if d, ok := s.StorageDrivers[driverName]; ok {
+		return d, nil
+	}
+
+	var (
+		d   driver.Driver
+		err error
+	)
+	if strings.HasPrefix(driverName, "plugin:") {
+		d, err = storagedriver.NewPluginDriver(strings.TrimPrefix(driverName, "plugin:"))
+	} else {
+		d, err = driver.GetDriver(driverName, s.Root, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.StorageDrivers == nil {
+		s.StorageDrivers = map[string]driver.Driver{}
+	}
+	s.StorageDrivers[driverName] = d
+	return d, nil
+}
+
+// getVolumeOpsForVolume resolves the VolumeOperations for whichever
+// driver created volume, so callers never need to know whether it's a
+// built-in or plugin-backed driver.
+func (s *Server) getVolumeOpsForVolume(volume *Volume) (storagedriver.VolumeOperations, error) {
+	d, err := s.getDriver(volume.DriverName)
+	if err != nil {
+		return nil, err
+	}
+	return d.VolumeOps()
+}
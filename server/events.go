@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rancher/rancher-volume/api"
+	"github.com/rancher/rancher-volume/util"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// eventWriter streams api.Event frames to an http.ResponseWriter as
+// newline-delimited JSON, flushing after every frame so a client watching
+// a long operation (backup restore, snapshot upload, ...) sees progress
+// as it happens instead of at the end of a fully-buffered response.
+type eventWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func newEventWriter(w http.ResponseWriter) *eventWriter {
+	flusher, _ := w.(http.Flusher)
+	return &eventWriter{w: w, flusher: flusher}
+}
+
+// Send encodes event as one newline-delimited JSON frame. event is
+// usually an api.Event (a single operation's progress) or an
+// api.VolumeEvent (a subscribed lifecycle notification) but isn't
+// restricted to either, since both just need "encode, flush" from here.
+func (e *eventWriter) Send(event interface{}) error {
+	if !e.started {
+		e.w.Header().Set("Content-Type", ndjsonContentType)
+		e.started = true
+	}
+	if err := json.NewEncoder(e.w).Encode(event); err != nil {
+		return err
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return nil
+}
+
+// wantsEventStream reports whether the client asked for the
+// application/x-ndjson progress stream instead of a single buffered
+// response.
+func wantsEventStream(r *http.Request) bool {
+	return r.Header.Get("Accept") == ndjsonContentType
+}
+
+// publishVolumeEvent records a volume lifecycle notification on the
+// server's event broker, for anything subscribed through doEventsSubscribe.
+func (s *Server) publishVolumeEvent(action string, volume *Volume) {
+	now := time.Now()
+	s.Events.Publish(api.VolumeEvent{
+		Type:   "volume",
+		Action: action,
+		Actor: api.EventActor{
+			UUID:   volume.UUID,
+			Name:   volume.Name,
+			Driver: volume.DriverName,
+		},
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	})
+}
+
+// doEventsSubscribe streams every volume lifecycle event published after
+// it's called, as newline-delimited JSON VolumeEvents, until the client
+// disconnects. since (RFC3339) replays buffered history starting from
+// that point before switching to live events; without since no buffered
+// history is sent. until (RFC3339) ends the stream at the first matching
+// event at or after that time, without sending that event; until such an
+// event arrives the stream stays open. filters uses
+// the same encoding as the volume list filter and is matched against the
+// event's type/action/driver fields.
+func (s *Server) doEventsSubscribe(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	if stream, err := util.GetLowerCaseFlag(r, "stream", true, nil); err != nil {
+		return err
+	} else if stream != "1" {
+		return fmt.Errorf("stream=1 is the only supported value for stream=")
+	}
+
+	filters, err := parseListFilters(r)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	var since, until time.Time
+	if raw := query.Get("since"); raw != "" {
+		if since, err = time.Parse(time.RFC3339, raw); err != nil {
+			return err
+		}
+	}
+	if raw := query.Get("until"); raw != "" {
+		if until, err = time.Parse(time.RFC3339, raw); err != nil {
+			return err
+		}
+	}
+
+	matches := func(event api.VolumeEvent) bool {
+		return filters.Match("type", event.Type) &&
+			filters.Match("action", event.Action) &&
+			filters.Match("driver", event.Actor.Driver)
+	}
+
+	events := newEventWriter(w)
+	var backlog []api.VolumeEvent
+	if !since.IsZero() {
+		backlog = s.Events.Since(since)
+	}
+	ch, unsubscribe := s.Events.Subscribe()
+	defer unsubscribe()
+
+	for _, event := range backlog {
+		if !matches(event) {
+			continue
+		}
+		if !until.IsZero() && event.TimeNano >= until.UnixNano() {
+			return nil
+		}
+		if err := events.Send(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if !matches(event) {
+				continue
+			}
+			if !until.IsZero() && event.TimeNano >= until.UnixNano() {
+				return nil
+			}
+			if err := events.Send(event); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
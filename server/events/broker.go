@@ -0,0 +1,93 @@
+// Package events is the volume lifecycle event broker behind
+// GET /v1/events?stream=1: a small ring buffer of recent events plus one
+// channel per live subscriber, so a new subscriber can replay recent
+// history and every subscriber sees events as they're published without
+// a slow one blocking publishers or its peers.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rancher/rancher-volume/api"
+)
+
+// historySize bounds how many past events Since can replay to a new
+// subscriber; older events are dropped to keep the broker's memory use
+// flat regardless of how long the server's been running.
+const historySize = 256
+
+// subscriberBuffer is how many unconsumed events a subscriber channel
+// holds before Publish starts dropping events for it rather than
+// blocking every other subscriber (and the publishing goroutine) on one
+// slow reader.
+const subscriberBuffer = 64
+
+// Broker fans out VolumeEvents to every live subscriber. The zero value
+// is not usable; use NewBroker.
+type Broker struct {
+	mu      sync.Mutex
+	history []api.VolumeEvent
+	subs    map[chan api.VolumeEvent]struct{}
+}
+
+// NewBroker returns an empty, ready-to-use Broker.
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[chan api.VolumeEvent]struct{})}
+}
+
+// Publish appends event to the history and delivers it to every current
+// subscriber, dropping it for any subscriber whose buffer is already
+// full instead of waiting for it to drain.
+func (b *Broker) Publish(event api.VolumeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.history = append(b.history, event)
+	if len(b.history) > historySize {
+		b.history = b.history[len(b.history)-historySize:]
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a new subscriber and returns its event channel and
+// a function to unregister it. The caller must call the returned
+// function once it's done reading to release the channel.
+func (b *Broker) Subscribe() (<-chan api.VolumeEvent, func()) {
+	ch := make(chan api.VolumeEvent, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.mu.Unlock()
+	}
+	return ch, unsubscribe
+}
+
+// Since returns the buffered events at or after t, oldest first.
+func (b *Broker) Since(t time.Time) []api.VolumeEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	since := t.UnixNano()
+	result := make([]api.VolumeEvent, 0, len(b.history))
+	for _, event := range b.history {
+		if event.TimeNano >= since {
+			result = append(result, event)
+		}
+	}
+	return result
+}
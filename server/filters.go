@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Filters is a lightweight stand-in for Docker's filters.Args: a set of
+// field names, each mapped to the set of values that satisfy it. An item
+// matches a Filters if it matches every field present.
+type Filters map[string][]string
+
+// Has reports whether any value was supplied for field.
+func (f Filters) Has(field string) bool {
+	return len(f[field]) > 0
+}
+
+// Match reports whether value satisfies any of the values supplied for
+// field. It's a no-op (always matches) if field wasn't supplied.
+func (f Filters) Match(field, value string) bool {
+	values, ok := f[field]
+	if !ok {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseListFilters reads the filters used by /v1/volumes listings into a
+// Filters: the Docker-compatible filters=<json-encoded map[string][]string>
+// query parameter, merged with the plain, repeatable driver=, dangling=,
+// name= and label= query parameters for backward compatibility with
+// callers that don't JSON-encode their filter.
+func parseListFilters(r *http.Request) (Filters, error) {
+	filters := Filters{}
+	query := r.URL.Query()
+	if raw := query.Get("filters"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range []string{"driver", "dangling", "name"} {
+		if values, ok := query[field]; ok {
+			filters[field] = values
+		}
+	}
+	if labels, ok := query["label"]; ok {
+		filters["label"] = labels
+	}
+	return filters, nil
+}
+
+// matchLabels reports whether every label= filter value (key=value or
+// bare key) is satisfied by the given label set.
+func matchLabels(filters Filters, labels map[string]string) bool {
+	for _, want := range filters["label"] {
+		parts := strings.SplitN(want, "=", 2)
+		actual, ok := labels[parts[0]]
+		if !ok {
+			return false
+		}
+		if len(parts) == 2 && actual != parts[1] {
+			return false
+		}
+	}
+	return true
+}
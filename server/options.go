@@ -0,0 +1,71 @@
+package server
+
+import "github.com/rancher/rancher-volume/api"
+
+// createOptions holds the optional, as opposed to required, inputs to
+// processVolumeCreate. New optional inputs should be added here and
+// exposed through a CreateOption rather than growing the function's
+// positional parameter list.
+type createOptions struct {
+	backupURL string
+	labels    map[string]string
+	progress  func(api.Event)
+}
+
+// CreateOption configures a volume creation call.
+type CreateOption func(*createOptions)
+
+// WithBackupURL restores the new volume from the given backup instead of
+// creating it empty.
+func WithBackupURL(url string) CreateOption {
+	return func(o *createOptions) {
+		o.backupURL = url
+	}
+}
+
+// WithLabels attaches the given labels to the new volume, making it
+// selectable by the label= filter on /v1/volumes listings.
+func WithLabels(labels map[string]string) CreateOption {
+	return func(o *createOptions) {
+		o.labels = labels
+	}
+}
+
+// WithProgress reports backup-restore progress through fn as the volume
+// is created, instead of the caller finding out only once creation
+// finishes.
+func WithProgress(fn func(api.Event)) CreateOption {
+	return func(o *createOptions) {
+		o.progress = fn
+	}
+}
+
+// removeOptions holds the optional inputs to processVolumeDelete.
+type removeOptions struct {
+	force bool
+}
+
+// RemoveOption configures a volume removal call.
+type RemoveOption func(*removeOptions)
+
+// WithForce removes the volume even if it's still mounted.
+func WithForce(force bool) RemoveOption {
+	return func(o *removeOptions) {
+		o.force = force
+	}
+}
+
+// getOptions holds the optional inputs to a volume list/inspect call.
+type getOptions struct {
+	filters Filters
+}
+
+// GetOption configures a volume list/inspect call.
+type GetOption func(*getOptions)
+
+// WithFilters restricts a list/inspect call to volumes matching filters.
+func WithFilters(filters Filters) GetOption {
+	return func(o *getOptions) {
+		o.filters = filters
+	}
+}
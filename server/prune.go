@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rancher/rancher-volume/util"
+)
+
+// PruneReport summarizes the result of a snapshot prune call, mirroring
+// the shape of Docker's build cache prune report.
+type PruneReport struct {
+	SnapshotsDeleted []string
+	SpaceReclaimed   int64
+}
+
+// VolumesPruneReport summarizes the result of a volume prune call.
+type VolumesPruneReport struct {
+	VolumesDeleted []string
+	SpaceReclaimed int64
+}
+
+// parsePruneFilters merges the all query param with the filters=<json>
+// expression (until=, label=, dangling=) into a single Filters, understood
+// by volumeMatchesFilters and pruneVolumeSnapshots. all=1 sets dangling to
+// both true and false. keep-storage is read by doVolumePrune, not here.
+func parsePruneFilters(r *http.Request) (Filters, error) {
+	filters := Filters{}
+	if raw := r.URL.Query().Get("filters"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+			return nil, err
+		}
+	}
+	if all, err := util.GetLowerCaseFlag(r, "all", false, nil); err != nil {
+		return nil, err
+	} else if all == "1" {
+		filters["dangling"] = []string{"true", "false"}
+	}
+	return filters, nil
+}
+
+// matchUntil reports whether createdTime (RFC3339) is older than every
+// until= duration in filters. It's permissive: an unparsable createdTime
+// or duration is treated as a non-match rather than an error, since
+// prune should never abort a whole run over one bad timestamp.
+func matchUntil(filters Filters, createdTime string) bool {
+	for _, until := range filters["until"] {
+		d, err := time.ParseDuration(until)
+		if err != nil {
+			return false
+		}
+		created, err := time.Parse(time.RFC3339, createdTime)
+		if err != nil {
+			return false
+		}
+		if time.Since(created) < d {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) doVolumePrune(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	filters, err := parsePruneFilters(r)
+	if err != nil {
+		return err
+	}
+	// keep-storage=<bytes> stops the run once that much space is reclaimed.
+	var keepStorage int64
+	if raw := r.URL.Query().Get("keep-storage"); raw != "" {
+		if keepStorage, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return err
+		}
+	}
+
+	volumes, err := s.Volumes().List(ctx, filters)
+	if err != nil {
+		return err
+	}
+
+	report := &VolumesPruneReport{}
+	for _, volume := range volumes {
+		if keepStorage > 0 && report.SpaceReclaimed >= keepStorage {
+			break
+		}
+		if len(volume.Snapshots) != 0 || !matchUntil(filters, volume.CreatedTime) {
+			continue
+		}
+		deleted, size, err := s.pruneVolumeIfUnmounted(ctx, volume)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			report.VolumesDeleted = append(report.VolumesDeleted, volume.UUID)
+			report.SpaceReclaimed += size
+		}
+	}
+
+	return writeResponseOutput(w, report)
+}
+
+// pruneVolumeIfUnmounted deletes volume if it isn't currently mounted,
+// under volume's own lock so it can't race a mount/umount/delete of that
+// same volume - but, unlike the old single GlobalLock, doesn't block
+// doVolumePrune's other volumes, or any other handler, from making
+// progress on volumes of their own while this one's deleting.
+func (s *Server) pruneVolumeIfUnmounted(ctx context.Context, volume *Volume) (deleted bool, size int64, err error) {
+	unlock := s.VolumeLocks.Lock(volume.UUID)
+	defer unlock()
+
+	volOps, err := s.getVolumeOpsForVolume(volume)
+	if err != nil {
+		return false, 0, err
+	}
+	mountPoint, err := volOps.MountPoint(volume.UUID)
+	if err != nil || mountPoint != "" {
+		return false, 0, nil
+	}
+	if err := s.processVolumeDelete(ctx, volume.UUID); err != nil {
+		return false, 0, err
+	}
+	return true, volume.Size, nil
+}
+
+func (s *Server) doSnapshotPrune(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	filters, err := parsePruneFilters(r)
+	if err != nil {
+		return err
+	}
+
+	report := &PruneReport{}
+	volumeUUIDs, err := util.ListConfigIDs(s.Root, VOLUME_CFG_PREFIX, CFG_POSTFIX)
+	if err != nil {
+		return err
+	}
+	for _, volumeUUID := range volumeUUIDs {
+		deleted, err := s.pruneVolumeSnapshots(volumeUUID, filters)
+		if err != nil {
+			return err
+		}
+		report.SnapshotsDeleted = append(report.SnapshotsDeleted, deleted...)
+	}
+
+	return writeResponseOutput(w, report)
+}
+
+// pruneVolumeSnapshots removes every snapshot of volumeUUID's volume
+// that matches filters, under that volume's own lock so distinct
+// volumes' snapshots still prune in parallel instead of one at a time
+// behind a single lock. It loads the volume itself only after taking
+// the lock, rather than being handed an already-loaded *Volume, so its
+// final saveVolume can't overwrite a mount/unmount/backup that committed
+// to the same volume while this call was waiting on the lock.
+func (s *Server) pruneVolumeSnapshots(volumeUUID string, filters Filters) ([]string, error) {
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+
+	volume := s.loadVolume(volumeUUID)
+	if volume == nil {
+		return nil, nil
+	}
+
+	var deleted []string
+	for snapshotUUID, snapshot := range volume.Snapshots {
+		if !filters.Match("name", snapshot.Name) || !matchUntil(filters, snapshot.CreatedTime) {
+			continue
+		}
+		volOps, err := s.getVolumeOpsForVolume(volume)
+		if err != nil {
+			return deleted, err
+		}
+		if err := volOps.DeleteSnapshot(snapshotUUID, volume.UUID); err != nil {
+			return deleted, err
+		}
+		delete(volume.Snapshots, snapshotUUID)
+		if err := s.SnapshotVolumeIndex.Delete(snapshotUUID); err != nil {
+			return deleted, err
+		}
+		if err := s.UUIDIndex.Delete(snapshotUUID); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, snapshotUUID)
+	}
+	if err := s.saveVolume(volume); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
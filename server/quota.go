@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/rancher/rancher-volume/api"
+	"github.com/rancher/rancher-volume/util"
+)
+
+// quotasConfigName is the file under Config.Root a QuotaManager's rules
+// round-trip through, analogous to getCfgName()'s server config.
+const quotasConfigName = "quotas.json"
+
+// quotaKey is how a QuotaManager keys its rules by selector: there's no
+// other identity for a rule, and a selector's two fields are cheap to
+// join into one comparable string.
+func quotaKey(selector api.QuotaSelector) string {
+	return selector.Label + "|" + selector.Driver
+}
+
+// QuotaManager enforces config.Root/quotas.json's rules against
+// processVolumeCreate. Usage is always computed fresh from the volumes
+// on disk rather than tracked incrementally, so it can never drift from
+// what processVolumeDelete, or an operator hand-editing quotas.json,
+// actually leaves on disk.
+type QuotaManager struct {
+	mu    sync.RWMutex
+	rules map[string]api.QuotaRule
+
+	// createMu serializes Check's count against every volume currently on
+	// disk with the create that follows it - across every volume create,
+	// not just those a rule's selector matches. Server.VolumeLocks now
+	// lets creates of different names run in parallel, but a MaxVolumes/
+	// MaxTotalBytes rule is a fleet-wide count, so two concurrent creates
+	// of different names could otherwise both pass the same "count < N"
+	// check before either is reflected on disk. processVolumeCreate holds
+	// createMu (via LockForCreate) for its whole duration, so volume
+	// creation is still serialized end to end like the old GlobalLock -
+	// only the other operations gained per-volume parallelism.
+	createMu sync.Mutex
+}
+
+// LockForCreate serializes processVolumeCreate end to end across every
+// volume create, regardless of name or driver - see createMu's doc
+// comment for why a fleet-wide quota rule needs this even though
+// VolumeLocks now lets every other volume operation (mount, umount,
+// delete, list, backup) run fully in parallel per volume.
+func (qm *QuotaManager) LockForCreate() func() {
+	qm.createMu.Lock()
+	return qm.createMu.Unlock
+}
+
+// loadQuotaManager reads root/quotas.json, returning an empty
+// (unrestricted) QuotaManager if it doesn't exist yet.
+func loadQuotaManager(root string) (*QuotaManager, error) {
+	qm := &QuotaManager{rules: make(map[string]api.QuotaRule)}
+	if !util.ConfigExists(root, quotasConfigName) {
+		return qm, nil
+	}
+	var rules []api.QuotaRule
+	if err := util.LoadConfig(root, quotasConfigName, &rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		qm.rules[quotaKey(rule.Selector)] = rule
+	}
+	return qm, nil
+}
+
+func (qm *QuotaManager) save(root string) error {
+	qm.mu.RLock()
+	rules := make([]api.QuotaRule, 0, len(qm.rules))
+	for _, rule := range qm.rules {
+		rules = append(rules, rule)
+	}
+	qm.mu.RUnlock()
+	return util.SaveConfig(root, quotasConfigName, &rules)
+}
+
+// Set adds rule, or replaces the existing rule with the same selector.
+func (qm *QuotaManager) Set(root string, rule api.QuotaRule) error {
+	qm.mu.Lock()
+	qm.rules[quotaKey(rule.Selector)] = rule
+	qm.mu.Unlock()
+	return qm.save(root)
+}
+
+// Delete removes the rule with the given selector, if any.
+func (qm *QuotaManager) Delete(root string, selector api.QuotaSelector) error {
+	qm.mu.Lock()
+	delete(qm.rules, quotaKey(selector))
+	qm.mu.Unlock()
+	return qm.save(root)
+}
+
+// List returns every rule currently loaded, keyed the same way the
+// QuotaManager stores them internally.
+func (qm *QuotaManager) List() map[string]api.QuotaRule {
+	qm.mu.RLock()
+	defer qm.mu.RUnlock()
+	rules := make(map[string]api.QuotaRule, len(qm.rules))
+	for key, rule := range qm.rules {
+		rules[key] = rule
+	}
+	return rules
+}
+
+func ruleMatches(rule api.QuotaRule, driverName string, labels map[string]string) bool {
+	if rule.Selector.Driver != "" && rule.Selector.Driver != driverName {
+		return false
+	}
+	if rule.Selector.Label != "" && !matchLabels(Filters{"label": {rule.Selector.Label}}, labels) {
+		return false
+	}
+	return true
+}
+
+// Check enforces every rule whose selector matches driverName/labels
+// against a new volume of sizeBytes, returning an *api.Error{Code:
+// "QUOTA_EXCEEDED"} for the first rule it would violate.
+func (qm *QuotaManager) Check(ctx context.Context, s *Server, driverName string, labels map[string]string, sizeBytes int64) error {
+	qm.mu.RLock()
+	rules := make([]api.QuotaRule, 0, len(qm.rules))
+	for _, rule := range qm.rules {
+		rules = append(rules, rule)
+	}
+	qm.mu.RUnlock()
+
+	for _, rule := range rules {
+		if !ruleMatches(rule, driverName, labels) {
+			continue
+		}
+		if rule.MaxVolumeBytes > 0 && sizeBytes > rule.MaxVolumeBytes {
+			return &api.Error{Code: "QUOTA_EXCEEDED", Usage: sizeBytes, Limit: rule.MaxVolumeBytes}
+		}
+		if rule.MaxTotalBytes == 0 && rule.MaxVolumes == 0 {
+			continue
+		}
+
+		filters := Filters{}
+		if rule.Selector.Label != "" {
+			filters["label"] = []string{rule.Selector.Label}
+		}
+		if rule.Selector.Driver != "" {
+			filters["driver"] = []string{rule.Selector.Driver}
+		}
+		volumes, err := s.Volumes().List(ctx, filters)
+		if err != nil {
+			return err
+		}
+
+		if rule.MaxVolumes > 0 && len(volumes)+1 > rule.MaxVolumes {
+			return &api.Error{Code: "QUOTA_EXCEEDED", Usage: int64(len(volumes) + 1), Limit: int64(rule.MaxVolumes)}
+		}
+		if rule.MaxTotalBytes > 0 {
+			total := sizeBytes
+			for _, volume := range volumes {
+				total += volume.Size
+			}
+			if total > rule.MaxTotalBytes {
+				return &api.Error{Code: "QUOTA_EXCEEDED", Usage: total, Limit: rule.MaxTotalBytes}
+			}
+		}
+	}
+	return nil
+}
+
+// doQuotaSet/doQuotaDelete don't need a Server-level lock: QuotaManager
+// already serializes its own rules map with its own mutex (see
+// QuotaManager.mu above).
+func (s *Server) doQuotaSet(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.QuotaSetConfig{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if err := s.Quotas.Set(s.Root, request.QuotaRule); err != nil {
+		return err
+	}
+	return writeResponseOutput(w, request.QuotaRule)
+}
+
+func (s *Server) doQuotaList(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	return writeResponseOutput(w, api.QuotaListResponse{Rules: s.Quotas.List()})
+}
+
+func (s *Server) doQuotaDelete(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.QuotaDeleteConfig{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	return s.Quotas.Delete(s.Root, request.Selector)
+}
@@ -1,6 +1,9 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -8,15 +11,17 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rancher/rancher-volume/api"
 	"github.com/rancher/rancher-volume/driver"
+	"github.com/rancher/rancher-volume/server/events"
 	"github.com/rancher/rancher-volume/util"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	. "github.com/rancher/rancher-volume/logging"
 )
@@ -24,11 +29,28 @@ import (
 type Volume struct {
 	UUID        string
 	Name        string
+	DriverName  string
 	Size        int64
 	MountPoint  string
 	FileSystem  string
 	CreatedTime string
+	Labels      map[string]string
+	Status      map[string]interface{}
 	Snapshots   map[string]Snapshot
+
+	// SourceBackupURL is the backup this volume was created from, if any
+	// (see processVolumeCreate's backupURL option). doBackupCreate passes
+	// it to objectstore.CreateBackup so a backup of a freshly cloned,
+	// still-unmodified volume can warm its destination from the source
+	// backup's chunks instead of re-uploading identical content.
+	SourceBackupURL string
+
+	// MountCount and DockerIDs track how many Docker Volume Plugin
+	// Mount calls are outstanding for this volume, keyed by the
+	// caller-supplied container ID, so that multiple containers sharing
+	// the volume only trigger one real mount/unmount.
+	MountCount int
+	DockerIDs  []string
 }
 
 type Snapshot struct {
@@ -41,10 +63,58 @@ type Snapshot struct {
 type Server struct {
 	Router              *mux.Router
 	StorageDriver       driver.Driver
-	GlobalLock          *sync.RWMutex
+	StorageDrivers      map[string]driver.Driver
+	DefaultDriver       string
+	VolumeLocks         *volumeLockRegistry
 	NameUUIDIndex       *util.Index
 	SnapshotVolumeIndex *util.Index
 	UUIDIndex           *truncindex.TruncIndex
+	AuthToken           string
+	Events              *events.Broker
+	Quotas              *QuotaManager
+	ShutdownTimeout     time.Duration
+
+	// APIVersion and MinAPIVersion bound the range of client API versions
+	// makeHandlerFunc will accept (see checkAPIVersionCompatible), set
+	// from api.API_VERSION/api.MIN_API_VERSION in Start.
+	APIVersion    string
+	MinAPIVersion string
+
+	// AllowUnversioned is set from --allow-unversioned. It governs only
+	// the unversioned route registered alongside every /v{version} route
+	// (see createRouter): when false, a request that doesn't go through
+	// the versioned route is rejected instead of silently treated as
+	// compatible, since there's no way to tell what API a client hitting
+	// it actually expects.
+	AllowUnversioned bool
+
+	// inFlight counts requests currently running in a RequestHandler, so
+	// Start's graceful shutdown can wait for whatever's in progress (a
+	// backup upload, a restore) to finish - or time out - instead of
+	// cutting it off the moment the listeners stop accepting. It's a
+	// plain counter, not a sync.WaitGroup: a keep-alive connection can
+	// still dispatch one more request while shutdown is draining, and
+	// WaitGroup's Add-after-Wait-observes-zero case is a documented race
+	// (can panic with "Add called concurrently with Wait"); an atomic
+	// counter polled from the drain loop has no such restriction.
+	inFlight int32
+
+	// shuttingDown is set once Start has begun its shutdown sequence, so
+	// a Docker plugin Mount request that's still racing in can be
+	// refused with 503 instead of starting a new mount the shutdown
+	// isn't going to wait for (see refuseDuringShutdown).
+	shuttingDown int32
+
+	// shutdownSignal is closed once the ShutdownTimeout grace period
+	// given to in-flight requests has elapsed, so a handler checking
+	// ctx.Err() (CreateBackup/RestoreBackup/ReplicateBackup/GC's chunk
+	// loops) actually observes the deadline instead of running to
+	// completion unobserved - http.Server.Shutdown's own context only
+	// bounds how long it waits, it never cancels requests already being
+	// served. Every RequestHandler's ctx is derived from it in
+	// makeHandlerFunc. Never closed if Start never begins shutting down.
+	shutdownSignal chan struct{}
+
 	Config
 }
 
@@ -83,44 +153,60 @@ func createRouter(s *Server) *mux.Router {
 			"/snapshots/":                         s.doSnapshotInspect,
 			"/backups/list":                       s.doBackupList,
 			"/backups/inspect":                    s.doBackupInspect,
+			"/events":                             s.doEventsSubscribe,
+			"/quotas/list":                       s.doQuotaList,
 		},
 		"POST": {
 			"/volumes/create":                           s.doVolumeCreate,
 			"/volumes/{" + KEY_VOLUME_UUID + "}/mount":  s.doVolumeMount,
 			"/volumes/{" + KEY_VOLUME_UUID + "}/umount": s.doVolumeUmount,
+			"/volumes/prune":                            s.doVolumePrune,
 			"/snapshots/create":                         s.doSnapshotCreate,
+			"/snapshots/prune":                          s.doSnapshotPrune,
 			"/backups/create":                           s.doBackupCreate,
+			"/backups/gc":                               s.doBackupGC,
+			"/backups/replicate":                        s.doBackupReplicate,
+			"/quotas/set":                               s.doQuotaSet,
 		},
 		"DELETE": {
 			"/volumes/{" + KEY_VOLUME_UUID + "}/": s.doVolumeDelete,
 			"/snapshots/":                         s.doSnapshotDelete,
 			"/backups":                            s.doBackupDelete,
+			"/quotas":                             s.doQuotaDelete,
 		},
 	}
 	for method, routes := range m {
 		for route, f := range routes {
 			log.Debugf("Registering %s, %s", method, route)
-			handler := makeHandlerFunc(method, route, api.API_VERSION, f)
+			handler := makeHandlerFunc(s, method, route, f)
 			router.Path("/v{version:[0-9.]+}" + route).Methods(method).HandlerFunc(handler)
 			router.Path(route).Methods(method).HandlerFunc(handler)
 		}
 	}
 	router.NotFoundHandler = s
 
+	// /_ping is reachable unversioned and ungated, same as Docker's own
+	// /_ping: a client needs to learn API-Version/Min-API-Version before
+	// it can know what /v{version} prefix to use for everything else.
+	router.Path("/_ping").Methods("GET").HandlerFunc(trackInFlight(s, s.doPing))
+
 	pluginMap := map[string]map[string]http.HandlerFunc{
 		"POST": {
-			"/Plugin.Activate":      s.dockerActivate,
-			"/VolumeDriver.Create":  s.dockerCreateVolume,
-			"/VolumeDriver.Remove":  s.dockerRemoveVolume,
-			"/VolumeDriver.Mount":   s.dockerMountVolume,
-			"/VolumeDriver.Unmount": s.dockerUnmountVolume,
-			"/VolumeDriver.Path":    s.dockerVolumePath,
+			"/Plugin.Activate":           s.dockerActivate,
+			"/VolumeDriver.Create":       s.dockerCreateVolume,
+			"/VolumeDriver.Remove":       s.dockerRemoveVolume,
+			"/VolumeDriver.Mount":        refuseDuringShutdown(s, s.dockerMountVolume),
+			"/VolumeDriver.Unmount":      s.dockerUnmountVolume,
+			"/VolumeDriver.Path":         s.dockerVolumePath,
+			"/VolumeDriver.Get":          s.dockerGetVolume,
+			"/VolumeDriver.List":         s.dockerListVolumes,
+			"/VolumeDriver.Capabilities": s.dockerCapabilities,
 		},
 	}
 	for method, routes := range pluginMap {
 		for route, f := range routes {
 			log.Debugf("Registering plugin handler %s, %s", method, route)
-			router.Path(route).Methods(method).HandlerFunc(f)
+			router.Path(route).Methods(method).HandlerFunc(trackInFlight(s, f))
 		}
 	}
 	return router
@@ -132,20 +218,123 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(info))
 }
 
-type RequestHandler func(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error
+// authMiddleware rejects every request that doesn't carry the server's
+// bearer token in its Authorization header. It's a no-op wrapper when the
+// server has no AuthToken configured, which keeps the existing
+// unix-socket-only, no-auth setup working unchanged.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	if s.AuthToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+s.AuthToken {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-func makeHandlerFunc(method string, route string, version string, f RequestHandler) http.HandlerFunc {
+// trackInFlight wraps every Docker plugin route in inFlight accounting,
+// the same bookkeeping makeHandlerFunc gives every RequestHandler route,
+// so a long-running dockerCreateVolume (which can run RestoreBackup, same
+// as doVolumeCreate) is actually waited on by Start's graceful shutdown
+// instead of being invisible to it. It also replaces the request's
+// context the same way makeHandlerFunc does, so r.Context() inside these
+// handlers - which, unlike RequestHandlers, read it directly rather than
+// taking ctx as a parameter - is cancelled on the shutdown deadline too,
+// not just on client disconnect.
+func trackInFlight(s *Server, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.inFlight, 1)
+		defer atomic.AddInt32(&s.inFlight, -1)
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-s.shutdownSignal:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// refuseDuringShutdown wraps the Docker plugin Mount route so a request
+// that arrives once Start has begun shutting down gets a clean 503
+// instead of starting a brand new mount the shutdown path isn't waiting
+// on. Remove/Unmount are left unwrapped: they only shrink what's already
+// in flight, which is exactly what shutdown wants to let finish.
+func refuseDuringShutdown(s *Server, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.shuttingDown) != 0 {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequestHandler takes ctx, derived from the request itself, so a handler
+// wrapping a long-running operation (doBackupCreate's upload, a restore
+// during doVolumeCreate) can pass it all the way down to the objectstore
+// call doing the actual transfer, and have that transfer abandoned once
+// the client disconnects or Start's shutdown deadline passes, instead of
+// running to completion unobserved.
+type RequestHandler func(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error
+
+// makeHandlerFunc wraps every call to f in API version negotiation and
+// inFlight accounting. route is registered twice, once under
+// /v{version:[0-9.]+} and once bare (see createRouter); mux.Vars(r)
+// only has a "version" entry in the former case, which is how this tells
+// the two apart. A versioned request is rejected if it falls outside
+// [s.MinAPIVersion, s.APIVersion]; an unversioned one is rejected outright
+// unless --allow-unversioned was given, in which case it's let through with
+// a deprecation warning, since there's no version in the request to check
+// it against.
+//
+// The ctx it passes to f is cancelled either by the request's own
+// connection closing or by shutdownSignal closing, whichever comes first,
+// so a handler watching ctx.Err() actually observes the shutdown deadline
+// instead of only a client disconnect.
+func makeHandlerFunc(s *Server, method string, route string, f RequestHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Debugf("Calling: %v, %v, request: %v, %v", method, route, r.Method, r.RequestURI)
 
-		if strings.Contains(r.Header.Get("User-Agent"), "Rancher-Volume-Client/") {
-			userAgent := strings.Split(r.Header.Get("User-Agent"), "/")
-			if len(userAgent) == 2 && userAgent[1] != version {
-				http.Error(w, fmt.Errorf("client version %v doesn't match with server %v", userAgent[1], version).Error(), http.StatusNotFound)
+		if mux.Vars(r)["version"] == "" {
+			if !s.AllowUnversioned {
+				http.Error(w, fmt.Sprintf("unversioned API access is disabled; use /v%s%s or pass --allow-unversioned", s.APIVersion, route), http.StatusBadRequest)
 				return
 			}
+			log.Warnf("Deprecated unversioned request to %s %s; client should use /v%s%s", method, route, s.APIVersion, route)
 		}
-		if err := f(version, w, r, mux.Vars(r)); err != nil {
+		// requestedAPIVersion falls back to the User-Agent header when the
+		// route didn't carry a /v{version} prefix, so an --allow-unversioned
+		// request with an incompatible Rancher-Volume-Client/<version>
+		// User-Agent still gets rejected here instead of being let through
+		// just because its route happened to be unversioned.
+		if err := checkAPIVersionCompatible(s.MinAPIVersion, s.APIVersion, requestedAPIVersion(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		atomic.AddInt32(&s.inFlight, 1)
+		defer atomic.AddInt32(&s.inFlight, -1)
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-s.shutdownSignal:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		if err := f(ctx, s.APIVersion, w, r, mux.Vars(r)); err != nil {
 			log.Errorf("Handler for %s %s returned error: %s", method, route, err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 		}
@@ -164,14 +353,16 @@ func loadServerConfig(c *cli.Context) (*Server, error) {
 		return nil, fmt.Errorf("Failed to load config:", err.Error())
 	}
 
-	driver, err := driver.GetDriver(config.Driver, config.Root, nil)
+	d, err := driver.GetDriver(config.Driver, config.Root, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load driver:", err.Error())
 	}
 
 	server := &Server{
-		Config:        config,
-		StorageDriver: driver,
+		Config:         config,
+		StorageDriver:  d,
+		StorageDrivers: map[string]driver.Driver{config.Driver: d},
+		DefaultDriver:  config.Driver,
 	}
 	return server, nil
 }
@@ -289,72 +480,255 @@ func (s *Server) finishInitialization() error {
 	s.NameUUIDIndex = util.NewIndex()
 	s.SnapshotVolumeIndex = util.NewIndex()
 	s.UUIDIndex = truncindex.NewTruncIndex([]string{})
-	s.GlobalLock = &sync.RWMutex{}
+	s.VolumeLocks = newVolumeLockRegistry()
+	s.Events = events.NewBroker()
+	quotas, err := loadQuotaManager(s.Root)
+	if err != nil {
+		return err
+	}
+	s.Quotas = quotas
 
 	s.updateIndex()
 	return nil
 }
 
-func Start(sockFile string, c *cli.Context) error {
-	var err error
-
-	if err = serverEnvironmentSetup(c); err != nil {
-		return err
+// LoadOrInitServer runs the same bootstrap Start does before it opens any
+// listener: process-level environment setup (lockfile, logging), loading
+// or initializing the Server's config and StorageDriver, and finishing
+// initialization (indexes, quotas, VolumeLocks, auto-mount). It's exported
+// so a second frontend - cmd/convoy-csi's gRPC listener - can serve from
+// the identical Server and StorageDriver as the HTTP API without
+// re-implementing this sequence. The returned cleanup func must be
+// deferred by the caller.
+func LoadOrInitServer(c *cli.Context) (*Server, func(), error) {
+	if err := serverEnvironmentSetup(c); err != nil {
+		return nil, nil, err
 	}
-	defer environmentCleanup()
 
 	root := c.String("root")
 	var server *Server
+	var err error
 	if !util.ConfigExists(root, getCfgName()) {
 		server, err = initServer(c)
-		if err != nil {
-			return err
-		}
 	} else {
 		server, err = loadServerConfig(c)
-		if err != nil {
-			return err
-		}
+	}
+	if err != nil {
+		environmentCleanup()
+		return nil, nil, err
 	}
 	if err := server.CheckEnvironment(); err != nil {
+		environmentCleanup()
+		return nil, nil, err
+	}
+	server.finishInitialization()
+
+	return server, environmentCleanup, nil
+}
+
+// defaultShutdownTimeout bounds how long Start waits, on SIGTERM/SIGINT,
+// for in-flight requests to drain before giving up on them and shutting
+// down anyway. --shutdown-timeout overrides it.
+const defaultShutdownTimeout = 30 * time.Second
+
+// drainPollInterval is how often Start checks whether inFlight has
+// reached zero while waiting for it to drain.
+const drainPollInterval = 50 * time.Millisecond
+
+func Start(sockFile string, c *cli.Context) error {
+	server, cleanup, err := LoadOrInitServer(c)
+	if err != nil {
 		return err
 	}
+	defer cleanup()
 
-	server.finishInitialization()
+	server.shutdownSignal = make(chan struct{})
+	server.APIVersion = api.API_VERSION
+	server.MinAPIVersion = api.MIN_API_VERSION
+	server.AllowUnversioned = c.Bool("allow-unversioned")
 	server.Router = createRouter(server)
+	server.AuthToken = c.String("auth-token")
 
-	if err := util.MkdirIfNotExists(filepath.Dir(sockFile)); err != nil {
-		return err
+	server.ShutdownTimeout = defaultShutdownTimeout
+	if raw := c.String("shutdown-timeout"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("Invalid shutdown-timeout %q: %v", raw, err)
+		}
+		server.ShutdownTimeout = d
 	}
 
-	l, err := net.Listen("unix", sockFile)
+	l, err := listen(sockFile, c)
 	if err != nil {
-		fmt.Println("listen err", err)
 		return err
 	}
 	defer l.Close()
 
+	pluginListener, err := listenDockerPlugin()
+	if err != nil {
+		return err
+	}
+	defer pluginListener.Close()
+
+	pluginTCPListener, err := listenDockerPluginTCP(c)
+	if err != nil {
+		return err
+	}
+	if pluginTCPListener != nil {
+		defer pluginTCPListener.Close()
+		pluginTLS := c.String("plugin-tls-cert") != "" && c.String("plugin-tls-key") != ""
+		if err := writePluginSpec(c.String("plugin-host"), pluginTLS, c.String("plugin-tls-ca")); err != nil {
+			return err
+		}
+	}
+
+	httpSrv := &http.Server{Handler: server.authMiddleware(server.Router)}
+	pluginSrv := &http.Server{Handler: server.Router}
+	var pluginTCPSrv *http.Server
+	if pluginTCPListener != nil {
+		// Unlike the local unix-socket pluginListener, this one is
+		// network-reachable, so it's gated by the same --auth-token
+		// check as the main --host listener instead of serving the
+		// full API unauthenticated.
+		pluginTCPSrv = &http.Server{Handler: server.authMiddleware(server.Router)}
+	}
+
 	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
 	signal.Notify(sigs, os.Interrupt, os.Kill, syscall.SIGTERM)
-	go func() {
-		sig := <-sigs
+
+	serveErrs := make(chan error, 3)
+	go func() { serveErrs <- httpSrv.Serve(l) }()
+	go func() { serveErrs <- pluginSrv.Serve(pluginListener) }()
+	if pluginTCPSrv != nil {
+		go func() { serveErrs <- pluginTCPSrv.Serve(pluginTCPListener) }()
+	}
+
+	select {
+	case sig := <-sigs:
 		fmt.Printf("Caught signal %s: shutting down.\n", sig)
-		done <- true
-	}()
+	case err := <-serveErrs:
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("http server error", err.Error())
+			return err
+		}
+		return nil
+	}
+
+	// Refuse new Docker plugin Mount calls right away (see
+	// refuseDuringShutdown), before asking the http.Servers to stop
+	// accepting connections: otherwise a Mount that's already past the
+	// refusal check but hasn't reached Serve's connection accounting yet
+	// could still slip in between here and Shutdown.
+	atomic.StoreInt32(&server.shuttingDown, 1)
+
+	// Shutdown and the inFlight drain both race against the same
+	// deadline rather than running one after the other, so a handler
+	// that's slow to notice its connection closing doesn't eat into the
+	// drain's own budget - they're two views of the same in-progress
+	// work (a backup upload, a restore), not two sequential steps.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), server.ShutdownTimeout)
+	defer cancel()
+
+	httpShutdownDone := make(chan error, 3)
+	go func() { httpShutdownDone <- httpSrv.Shutdown(shutdownCtx) }()
+	go func() { httpShutdownDone <- pluginSrv.Shutdown(shutdownCtx) }()
+	if pluginTCPSrv != nil {
+		go func() { httpShutdownDone <- pluginTCPSrv.Shutdown(shutdownCtx) }()
+	} else {
+		httpShutdownDone <- nil
+	}
 
+	drained := make(chan struct{})
 	go func() {
-		err = http.Serve(l, server.Router)
-		if err != nil {
-			log.Error("http server error", err.Error())
+		// Polled rather than blocked on, since inFlight is a plain counter:
+		// see its doc comment for why a sync.WaitGroup can't safely be
+		// Wait()ed on here while new requests may still be dispatched.
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if atomic.LoadInt32(&server.inFlight) == 0 {
+				close(drained)
+				return
+			}
 		}
-		done <- true
 	}()
 
-	<-done
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		log.Warnf("Timed out after %v waiting for in-flight requests to finish", server.ShutdownTimeout)
+		// Past the grace period: cancel every in-flight request's ctx (see
+		// makeHandlerFunc/trackInFlight) so a handler that does check
+		// ctx.Err() - CreateBackup/RestoreBackup/ReplicateBackup/GC's
+		// chunk loops - actually abandons its transfer instead of running
+		// to completion unobserved, same as an ordinary client disconnect.
+		// Start doesn't wait for drained after this: most handlers (e.g.
+		// MountVolume) never check ctx at all, so waiting here again could
+		// block indefinitely instead of bounding shutdown as promised.
+		close(server.shutdownSignal)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := <-httpShutdownDone; err != nil {
+			log.Errorf("Error shutting down HTTP server cleanly: %v", err)
+		}
+	}
+
 	return nil
 }
 
+// listen opens the server's listening socket: the unix socket at sockFile
+// by default, or a TCP listener on --host when one is given, wrapped in
+// mutual TLS if --tls-cert/--tls-key/--tls-ca are present.
+func listen(sockFile string, c *cli.Context) (net.Listener, error) {
+	host := c.String("host")
+	if host == "" {
+		if err := util.MkdirIfNotExists(filepath.Dir(sockFile)); err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("unix", sockFile)
+		if err != nil {
+			fmt.Println("listen err", err)
+			return nil, err
+		}
+		return l, nil
+	}
+
+	return listenTLS(host, c.String("tls-cert"), c.String("tls-key"), c.String("tls-ca"))
+}
+
+// listenTLS opens a plain TCP listener on host, or one wrapped in mutual
+// TLS when tlsCert/tlsKey are given, optionally requiring and verifying
+// client certificates against tlsCA. It's shared by listen (the main API
+// socket) and listenDockerPluginTCP (the optional remote plugin socket)
+// so both --host and --plugin-host get the same TLS handling.
+func listenTLS(host, tlsCert, tlsKey, tlsCA string) (net.Listener, error) {
+	if tlsCert == "" || tlsKey == "" {
+		return net.Listen("tcp", host)
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if tlsCA != "" {
+		ca, err := ioutil.ReadFile(tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Unable to parse CA certificate %v", tlsCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tls.Listen("tcp", host, tlsConfig)
+}
+
 func initServer(c *cli.Context) (*Server, error) {
 	root := c.String("root")
 	driverName := c.String("driver")
@@ -388,7 +762,7 @@ func initServer(c *cli.Context) (*Server, error) {
 		"root":           root,
 		"driverOpts":     driverOpts,
 	}).Debug()
-	driver, err := driver.GetDriver(driverName, root, driverOpts)
+	d, err := driver.GetDriver(driverName, root, driverOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -406,8 +780,10 @@ func initServer(c *cli.Context) (*Server, error) {
 		DefaultVolumeSize: size,
 	}
 	server := &Server{
-		Config:        config,
-		StorageDriver: driver,
+		Config:         config,
+		StorageDriver:  d,
+		StorageDrivers: map[string]driver.Driver{driverName: d},
+		DefaultDriver:  driverName,
 	}
 	if err := util.SaveConfig(root, getCfgName(), &config); err != nil {
 		return nil, err
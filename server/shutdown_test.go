@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	. "gopkg.in/check.v1"
+)
+
+type ShutdownTestSuite struct {
+}
+
+var _ = Suite(&ShutdownTestSuite{})
+
+// TestGracefulShutdownDrainsThenCancelsSlowRequest exercises the same
+// mechanism Start's graceful shutdown relies on when a SIGTERM arrives
+// mid-backup: inFlight should reflect the request for as long as it's
+// running, and the request's ctx should only be cancelled once
+// shutdownSignal closes - not the moment shutdown begins - so a handler
+// gets the full grace period before being asked to abort.
+func (s *ShutdownTestSuite) TestGracefulShutdownDrainsThenCancelsSlowRequest(c *C) {
+	srv := &Server{shutdownSignal: make(chan struct{}), AllowUnversioned: true}
+
+	cancelled := make(chan struct{})
+	release := make(chan struct{})
+	slowHandler := func(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+		go func() {
+			<-ctx.Done()
+			close(cancelled)
+		}()
+		<-release
+		return nil
+	}
+
+	router := mux.NewRouter()
+	router.Path("/slow").Methods("GET").HandlerFunc(makeHandlerFunc(srv, "GET", "/slow", slowHandler))
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	requestDone := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		requestDone <- err
+	}()
+
+	// Wait for the request to actually be in flight before simulating
+	// shutdown, the same way Start's drain loop would observe it.
+	for atomic.LoadInt32(&srv.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-cancelled:
+		c.Fatal("request ctx was cancelled before shutdownSignal closed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(srv.shutdownSignal)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		c.Fatal("request ctx was never cancelled after shutdownSignal closed")
+	}
+
+	close(release)
+	select {
+	case err := <-requestDone:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("request never completed after being released")
+	}
+
+	c.Assert(atomic.LoadInt32(&srv.inFlight), Equals, int32(0))
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// parseAPIVersion splits a dotted version string ("1.0", "1.10.2") into its
+// numeric components, so two versions can be compared numerically instead
+// of lexically (where "1.10" would otherwise sort before "1.9").
+func parseAPIVersion(version string) ([]int, error) {
+	parts := strings.Split(version, ".")
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API version %q", version)
+		}
+		nums[i] = n
+	}
+	return nums, nil
+}
+
+// compareAPIVersions returns -1, 0 or 1 as a is less than, equal to or
+// greater than b. Missing trailing components compare as 0, so "1" == "1.0".
+func compareAPIVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// requestedAPIVersion returns the client's declared API version: the URL's
+// /v{version} prefix if the request matched that route, otherwise whatever
+// version a Rancher-Volume-Client/<version> User-Agent declares. It returns
+// "" when neither is present, which checkAPIVersionCompatible treats as
+// unversioned rather than incompatible.
+func requestedAPIVersion(r *http.Request) string {
+	if version := mux.Vars(r)["version"]; version != "" {
+		return version
+	}
+	if strings.Contains(r.Header.Get("User-Agent"), "Rancher-Volume-Client/") {
+		userAgent := strings.Split(r.Header.Get("User-Agent"), "/")
+		if len(userAgent) == 2 {
+			return userAgent[1]
+		}
+	}
+	return ""
+}
+
+// checkAPIVersionCompatible reports an error unless requested falls in
+// [minVersion, maxVersion]. An empty requested version is always compatible:
+// it means the client gave no version information at all, which this
+// server tolerates rather than rejecting outright.
+func checkAPIVersionCompatible(minVersion, maxVersion, requested string) error {
+	if requested == "" {
+		return nil
+	}
+	req, err := parseAPIVersion(requested)
+	if err != nil {
+		return err
+	}
+	min, err := parseAPIVersion(minVersion)
+	if err != nil {
+		return err
+	}
+	max, err := parseAPIVersion(maxVersion)
+	if err != nil {
+		return err
+	}
+	if compareAPIVersions(req, min) < 0 || compareAPIVersions(req, max) > 0 {
+		return fmt.Errorf("client API version %v is incompatible with server (supports %v-%v)", requested, minVersion, maxVersion)
+	}
+	return nil
+}
+
+// doPing answers GET /_ping with the server's API version range in headers,
+// the same way Docker's own /_ping does, so a client can learn what a
+// server supports before picking a /v{version} prefix to talk to it with -
+// this route is intentionally reachable without going through
+// makeHandlerFunc's version check, since that's the whole point of it.
+func (s *Server) doPing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("API-Version", s.APIVersion)
+	w.Header().Set("Min-API-Version", s.MinAPIVersion)
+	w.WriteHeader(http.StatusOK)
+}
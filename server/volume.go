@@ -2,6 +2,7 @@ package server
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"context"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/rancher-volume/api"
@@ -77,13 +78,28 @@ func (s *Server) deleteVolume(volume *Volume) error {
 	return nil
 }
 
-func (s *Server) processVolumeCreate(volumeName, driverName string, size int64, backupURL string) (*Volume, error) {
+func (s *Server) processVolumeCreate(ctx context.Context, volumeName, driverName string, size int64, opts ...CreateOption) (*Volume, error) {
+	o := &createOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// See QuotaManager.createMu: a fleet-wide MaxVolumes/MaxTotalBytes
+	// rule needs every create serialized against Quotas.Check below, not
+	// just creates of this one name.
+	unlockQuota := s.Quotas.LockForCreate()
+	defer unlockQuota()
+
 	existedVolume := s.loadVolumeByName(volumeName)
 	if existedVolume != nil {
 		return nil, fmt.Errorf("Volume name %v already associate locally with volume %v ", volumeName, existedVolume.UUID)
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	uuid := uuid.New()
+	backupURL := o.backupURL
 
 	if backupURL != "" {
 		objVolume, err := objectstore.LoadVolume(backupURL)
@@ -96,6 +112,10 @@ func (s *Server) processVolumeCreate(volumeName, driverName string, size int64,
 	if driverName == "" {
 		driverName = s.DefaultDriver
 	}
+	if err := s.Quotas.Check(ctx, s, driverName, o.labels, size); err != nil {
+		return nil, err
+	}
+
 	driver, err := s.getDriver(driverName)
 	if err != nil {
 		return nil, err
@@ -122,6 +142,9 @@ func (s *Server) processVolumeCreate(volumeName, driverName string, size int64,
 		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
 		LOG_FIELD_VOLUME: uuid,
 	}).Debug("Created volume")
+	if o.progress != nil {
+		o.progress(api.Event{ID: uuid, Status: "created volume"})
+	}
 
 	if backupURL != "" {
 		log.WithFields(logrus.Fields{
@@ -131,10 +154,16 @@ func (s *Server) processVolumeCreate(volumeName, driverName string, size int64,
 			LOG_FIELD_VOLUME:     uuid,
 			LOG_FIELD_BACKUP_URL: backupURL,
 		}).Debug()
+		if o.progress != nil {
+			o.progress(api.Event{ID: uuid, Status: "restoring backup " + backupURL})
+		}
 		//TODO rollback
-		if err := objectstore.RestoreBackup(backupURL, uuid, driver); err != nil {
+		if err := objectstore.RestoreBackup(ctx, backupURL, uuid, driver); err != nil {
 			return nil, err
 		}
+		if o.progress != nil {
+			o.progress(api.Event{ID: uuid, Status: "restored backup " + backupURL})
+		}
 		log.WithFields(logrus.Fields{
 			LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
 			LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
@@ -142,16 +171,19 @@ func (s *Server) processVolumeCreate(volumeName, driverName string, size int64,
 			LOG_FIELD_VOLUME:     uuid,
 			LOG_FIELD_BACKUP_URL: backupURL,
 		}).Debug()
+		s.publishVolumeEvent(LOG_EVENT_BACKUP, &Volume{UUID: uuid, Name: volumeName, DriverName: driverName})
 	}
 
 	volume := &Volume{
-		UUID:        uuid,
-		Name:        volumeName,
-		DriverName:  driverName,
-		Size:        size,
-		FileSystem:  "ext4",
-		CreatedTime: util.Now(),
-		Snapshots:   make(map[string]Snapshot),
+		UUID:            uuid,
+		Name:            volumeName,
+		DriverName:      driverName,
+		Size:            size,
+		FileSystem:      "ext4",
+		CreatedTime:     util.Now(),
+		Labels:          o.labels,
+		Snapshots:       make(map[string]Snapshot),
+		SourceBackupURL: backupURL,
 	}
 	if err := s.saveVolume(volume); err != nil {
 		return nil, err
@@ -159,43 +191,69 @@ func (s *Server) processVolumeCreate(volumeName, driverName string, size int64,
 	if err := s.UUIDIndex.Add(volume.UUID); err != nil {
 		return nil, err
 	}
+	s.publishVolumeEvent(LOG_EVENT_CREATE, volume)
 
 	return volume, nil
 }
 
-func (s *Server) doVolumeCreate(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
-	s.GlobalLock.Lock()
-	defer s.GlobalLock.Unlock()
-
+func (s *Server) doVolumeCreate(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	request := &api.VolumeCreateRequest{}
 	if err := decodeRequest(r, request); err != nil {
 		return err
 	}
 
-	size := request.Size
+	// Keyed by the requested name, not a UUID: none is minted yet, and
+	// this is the race processVolumeCreate's loadVolumeByName check
+	// needs serialized against a second create of the same name.
+	unlock := s.VolumeLocks.Lock(request.Name)
+	defer unlock()
 
-	if size == 0 {
-		size = s.DefaultVolumeSize
+	size := s.DefaultVolumeSize
+	if request.Size != "" {
+		var err error
+		size, err = util.ParseSize(request.Size)
+		if err != nil {
+			return err
+		}
 	}
 
-	volume, err := s.processVolumeCreate(request.Name, request.DriverName, size, request.BackupURL)
-	if err != nil {
-		return err
+	opts := []CreateOption{}
+	if request.BackupURL != "" {
+		opts = append(opts, WithBackupURL(request.BackupURL))
+	}
+	if len(request.Labels) != 0 {
+		opts = append(opts, WithLabels(request.Labels))
 	}
 
-	return writeResponseOutput(w, api.VolumeResponse{
-		UUID:        volume.UUID,
-		Driver:      volume.DriverName,
-		Name:        volume.Name,
-		Size:        volume.Size,
-		CreatedTime: volume.CreatedTime,
-	})
+	if !wantsEventStream(r) {
+		volume, err := s.processVolumeCreate(ctx, request.Name, request.DriverName, size, opts...)
+		if err != nil {
+			if quotaErr, ok := err.(*api.Error); ok {
+				return writeResponseOutput(w, quotaErr)
+			}
+			return err
+		}
+		return writeResponseOutput(w, api.VolumeResponse{
+			UUID:        volume.UUID,
+			Driver:      volume.DriverName,
+			Name:        volume.Name,
+			Size:        volume.Size,
+			CreatedTime: volume.CreatedTime,
+		})
+	}
+
+	events := newEventWriter(w)
+	opts = append(opts, WithProgress(func(e api.Event) {
+		events.Send(e)
+	}))
+	volume, err := s.processVolumeCreate(ctx, request.Name, request.DriverName, size, opts...)
+	if err != nil {
+		return events.Send(api.Event{Status: "error: " + err.Error()})
+	}
+	return events.Send(api.Event{ID: volume.UUID, Status: "done"})
 }
 
-func (s *Server) doVolumeDelete(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
-	s.GlobalLock.Lock()
-	defer s.GlobalLock.Unlock()
-
+func (s *Server) doVolumeDelete(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	request := &api.VolumeDeleteRequest{}
 	if err := decodeRequest(r, request); err != nil {
 		return err
@@ -206,19 +264,51 @@ func (s *Server) doVolumeDelete(version string, w http.ResponseWriter, r *http.R
 		return err
 	}
 
-	return s.processVolumeDelete(volumeUUID)
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+
+	opts := []RemoveOption{}
+	if request.Force {
+		opts = append(opts, WithForce(true))
+	}
+	return s.processVolumeDelete(ctx, volumeUUID, opts...)
 }
 
-func (s *Server) processVolumeDelete(uuid string) error {
+func (s *Server) processVolumeDelete(ctx context.Context, uuid string, opts ...RemoveOption) error {
+	o := &removeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	volume := s.loadVolume(uuid)
 	if volume == nil {
 		return fmt.Errorf("Cannot find volume %s", uuid)
 	}
 
+	// Deletion is locked by UUID (see callers), but name registration -
+	// NameUUIDIndex.Add/Delete - is keyed by name, same as
+	// doVolumeCreate's own lock. Without also holding volume's name lock
+	// here, a create racing this delete for the same name could observe
+	// the config file gone (so loadVolumeByName says "free") but run its
+	// own NameUUIDIndex.Add before this delete's NameUUIDIndex.Delete,
+	// which would then wipe out the new volume's freshly added mapping.
+	if volume.Name != "" {
+		unlockName := s.VolumeLocks.Lock(volume.Name)
+		defer unlockName()
+	}
+
 	volOps, err := s.getVolumeOpsForVolume(volume)
 	if err != nil {
 		return err
 	}
+	if !o.force {
+		if mountPoint, err := volOps.MountPoint(uuid); err == nil && mountPoint != "" {
+			return fmt.Errorf("Volume %s is still mounted at %s, use force to remove anyway", uuid, mountPoint)
+		}
+	}
 
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON: LOG_REASON_PREPARE,
@@ -238,10 +328,23 @@ func (s *Server) processVolumeDelete(uuid string) error {
 	if err := s.UUIDIndex.Delete(volume.UUID); err != nil {
 		return err
 	}
-	return s.deleteVolume(volume)
+	if err := s.deleteVolume(volume); err != nil {
+		return err
+	}
+	s.publishVolumeEvent(LOG_EVENT_DELETE, volume)
+	return nil
 }
 
+// getVolumeInfo takes volume's own per-volume lock for the duration of
+// the read, so it can't observe a half-written mount point from a
+// concurrent processVolumeMount/processVolumeUmount on the same volume.
+// Callers iterating many volumes (listVolume) take and release this lock
+// once per volume rather than once for the whole list, so an unrelated
+// volume's mount/unmount isn't blocked by a slow list.
 func (s *Server) getVolumeInfo(volume *Volume) (*api.VolumeResponse, error) {
+	unlock := s.VolumeLocks.Lock(volume.UUID)
+	defer unlock()
+
 	volOps, err := s.getVolumeOpsForVolume(volume)
 	if err != nil {
 		return nil, err
@@ -269,35 +372,58 @@ func (s *Server) getVolumeInfo(volume *Volume) (*api.VolumeResponse, error) {
 	return resp, nil
 }
 
-func (s *Server) listVolume() ([]byte, error) {
-	resp := api.VolumesResponse{
-		Volumes: make(map[string]api.VolumeResponse),
+// volumeMatchesFilters reports whether volume satisfies every filter in
+// filters: driver=, name= and label= are matched against the volume's own
+// fields, dangling=true matches volumes with no mount point.
+func (s *Server) volumeMatchesFilters(volume *Volume, filters Filters) bool {
+	if !filters.Match("driver", volume.DriverName) {
+		return false
+	}
+	if !filters.Match("name", volume.Name) {
+		return false
+	}
+	if !matchLabels(filters, volume.Labels) {
+		return false
+	}
+	if filters.Has("dangling") && filters.Match("dangling", "true") {
+		volOps, err := s.getVolumeOpsForVolume(volume)
+		if err != nil {
+			return false
+		}
+		mountPoint, err := volOps.MountPoint(volume.UUID)
+		if err != nil || mountPoint != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) listVolume(ctx context.Context, opts ...GetOption) ([]byte, error) {
+	o := &getOptions{}
+	for _, opt := range opts {
+		opt(o)
 	}
 
-	volumeUUIDs, err := util.ListConfigIDs(s.Root, VOLUME_CFG_PREFIX, CFG_POSTFIX)
+	volumes, err := s.Volumes().List(ctx, o.filters)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, uuid := range volumeUUIDs {
-		volume := s.loadVolume(uuid)
-		if volume == nil {
-			return nil, fmt.Errorf("Volume list changed for volume %v", uuid)
-		}
+	resp := api.VolumesResponse{
+		Volumes: make(map[string]api.VolumeResponse),
+	}
+	for _, volume := range volumes {
 		r, err := s.getVolumeInfo(volume)
 		if err != nil {
 			return nil, err
 		}
-		resp.Volumes[uuid] = *r
+		resp.Volumes[volume.UUID] = *r
 	}
 
 	return api.ResponseOutput(resp)
 }
 
-func (s *Server) doVolumeList(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
-	s.GlobalLock.RLock()
-	defer s.GlobalLock.RUnlock()
-
+func (s *Server) doVolumeList(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	driverSpecific, err := util.GetLowerCaseFlag(r, "driver", false, nil)
 	if err != nil {
 		return err
@@ -317,10 +443,14 @@ func (s *Server) doVolumeList(version string, w http.ResponseWriter, r *http.Req
 			data = append(data, driverData...)
 		}
 	} else {
-		data, err = s.listVolume()
-	}
-	if err != nil {
-		return err
+		filters, err := parseListFilters(r)
+		if err != nil {
+			return err
+		}
+		data, err = s.listVolume(ctx, WithFilters(filters))
+		if err != nil {
+			return err
+		}
 	}
 	_, err = w.Write(data)
 	return err
@@ -338,10 +468,7 @@ func (s *Server) inspectVolume(volumeUUID string) ([]byte, error) {
 	return api.ResponseOutput(*resp)
 }
 
-func (s *Server) doVolumeInspect(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
-	s.GlobalLock.RLock()
-	defer s.GlobalLock.RUnlock()
-
+func (s *Server) doVolumeInspect(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	request := &api.VolumeInspectRequest{}
 	if err := decodeRequest(r, request); err != nil {
 		return err
@@ -360,10 +487,7 @@ func (s *Server) doVolumeInspect(version string, w http.ResponseWriter, r *http.
 	return err
 }
 
-func (s *Server) doVolumeMount(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
-	s.GlobalLock.Lock()
-	defer s.GlobalLock.Unlock()
-
+func (s *Server) doVolumeMount(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	var err error
 
 	request := &api.VolumeMountRequest{}
@@ -375,6 +499,10 @@ func (s *Server) doVolumeMount(version string, w http.ResponseWriter, r *http.Re
 	if err := util.CheckUUID(volumeUUID); err != nil {
 		return err
 	}
+
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+
 	volume := s.loadVolume(volumeUUID)
 	if volume == nil {
 		return fmt.Errorf("volume %v doesn't exist", volumeUUID)
@@ -417,13 +545,16 @@ func (s *Server) processVolumeMount(volume *Volume, request *api.VolumeMountRequ
 		LOG_FIELD_VOLUME:     volume.UUID,
 		LOG_FIELD_MOUNTPOINT: mountPoint,
 	}).Debug()
+
+	volume.MountPoint = mountPoint
+	if err := s.saveVolume(volume); err != nil {
+		return "", err
+	}
+	s.publishVolumeEvent(LOG_EVENT_MOUNT, volume)
 	return mountPoint, nil
 }
 
-func (s *Server) doVolumeUmount(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
-	s.GlobalLock.Lock()
-	defer s.GlobalLock.Unlock()
-
+func (s *Server) doVolumeUmount(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	request := &api.VolumeUmountRequest{}
 	if err := decodeRequest(r, request); err != nil {
 		return err
@@ -433,6 +564,10 @@ func (s *Server) doVolumeUmount(version string, w http.ResponseWriter, r *http.R
 	if err := util.CheckUUID(volumeUUID); err != nil {
 		return err
 	}
+
+	unlock := s.VolumeLocks.Lock(volumeUUID)
+	defer unlock()
+
 	volume := s.loadVolume(volumeUUID)
 	if volume == nil {
 		return fmt.Errorf("volume %v doesn't exist", volumeUUID)
@@ -463,6 +598,11 @@ func (s *Server) processVolumeUmount(volume *Volume) error {
 		LOG_FIELD_VOLUME: volume.UUID,
 	}).Debug()
 
+	volume.MountPoint = ""
+	if err := s.saveVolume(volume); err != nil {
+		return err
+	}
+	s.publishVolumeEvent(LOG_EVENT_UMOUNT, volume)
 	return nil
 }
 
@@ -493,7 +633,7 @@ func (s *Server) getVolumeMountPoint(volume *Volume) (string, error) {
 	return mountPoint, nil
 }
 
-func (s *Server) doRequestUUID(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+func (s *Server) doRequestUUID(ctx context.Context, version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	var err error
 	key, err := util.GetName(r, api.KEY_NAME, true, err)
 	if err != nil {
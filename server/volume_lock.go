@@ -0,0 +1,83 @@
+package server
+
+import "sync"
+
+// volumeEntry is the per-volume critical section that used to be part of
+// Server.GlobalLock: one entry guards one volume's mount/umount/delete/
+// snapshot state, so a slow operation on one volume (a hung NFS unmount,
+// a stuck backup upload) no longer blocks doVolumeList or a Docker
+// plugin Mount request against an unrelated volume.
+//
+// refs counts how many callers currently hold a reference to this entry
+// (from entry() through to their matching unlock), guarded by the owning
+// registry's mu rather than its own Mutex, since it has to be inspected
+// independently of whether the entry's Mutex itself is locked.
+type volumeEntry struct {
+	sync.Mutex
+	refs int
+}
+
+// volumeLockRegistry is a concurrent map from a volume's UUID to its
+// volumeEntry. Only the map lookup/insert/refcounting is serialized (via
+// mu); the actual operation a caller wants to serialize runs under the
+// returned entry's own Mutex, so two callers working on different
+// volumes never wait on each other.
+//
+// An entry is removed the moment its last referent unlocks, so the map
+// never grows past the number of volumes/names currently being operated
+// on - there's no separate cleanup step for callers to remember to call.
+//
+// doVolumeCreate has no UUID yet when it needs to serialize against a
+// second create racing it for the same name, so it also uses this
+// registry, keyed by the requested volume name instead of a UUID.
+// Volume names and UUIDs share no format in practice, so this doesn't
+// create real collisions; it just reuses the same keyed-lock mechanism
+// for a second, smaller keyspace.
+type volumeLockRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*volumeEntry
+}
+
+func newVolumeLockRegistry() *volumeLockRegistry {
+	return &volumeLockRegistry{entries: make(map[string]*volumeEntry)}
+}
+
+// entry returns key's entry, creating it on first use, and bumps its
+// refcount so it can't be removed by a concurrent unlock until this
+// caller's own unlock (see release) drops that reference again.
+func (r *volumeLockRegistry) entry(key string) *volumeEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[key]
+	if !ok {
+		e = &volumeEntry{}
+		r.entries[key] = e
+	}
+	e.refs++
+	return e
+}
+
+// release drops this caller's reference to key's entry, removing it from
+// the map once nobody else is still holding or waiting on it.
+func (r *volumeLockRegistry) release(key string, e *volumeEntry) {
+	r.mu.Lock()
+	e.refs--
+	if e.refs == 0 {
+		delete(r.entries, key)
+	}
+	r.mu.Unlock()
+}
+
+// Lock acquires key's entry, creating it on first use, and returns a
+// func that releases it - call it with defer the same way the old
+// GlobalLock.Lock()/Unlock() pair was used. Unlike that single lock,
+// the returned func also retires key's entry once every other caller
+// referencing it has likewise unlocked, so there's nothing to clean up.
+func (r *volumeLockRegistry) Lock(key string) func() {
+	e := r.entry(key)
+	e.Lock()
+	return func() {
+		e.Unlock()
+		r.release(key, e)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/rancher-volume/util"
+)
+
+// VolumeService is the shared backend for every volume-listing consumer:
+// the JSON API's /volumes/list and /volumes/prune handlers, and anything
+// else that needs a filtered volume set without caring whether it's
+// serving HTTP or driving a CLI-side prune loop directly.
+type VolumeService struct {
+	s *Server
+}
+
+// Volumes returns the VolumeService for s.
+func (s *Server) Volumes() *VolumeService {
+	return &VolumeService{s: s}
+}
+
+// List returns every volume matching filters.
+func (vs *VolumeService) List(ctx context.Context, filters Filters) ([]*Volume, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	volumeUUIDs, err := util.ListConfigIDs(vs.s.Root, VOLUME_CFG_PREFIX, CFG_POSTFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := []*Volume{}
+	for _, uuid := range volumeUUIDs {
+		volume := vs.s.loadVolume(uuid)
+		if volume == nil {
+			return nil, fmt.Errorf("Volume list changed for volume %v", uuid)
+		}
+		if !vs.s.volumeMatchesFilters(volume, filters) {
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
+
+// Get looks up a single volume by name or UUID.
+func (vs *VolumeService) Get(ctx context.Context, name string) (*Volume, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	volume := vs.s.loadVolumeByName(name)
+	if volume == nil && util.CheckUUID(name) == nil {
+		volume = vs.s.loadVolume(name)
+	}
+	if volume == nil {
+		return nil, fmt.Errorf("Cannot find volume %v", name)
+	}
+	return volume, nil
+}
+
+// Create creates a new volume, delegating to processVolumeCreate.
+func (vs *VolumeService) Create(ctx context.Context, name, driverName string, size int64, opts ...CreateOption) (*Volume, error) {
+	return vs.s.processVolumeCreate(ctx, name, driverName, size, opts...)
+}
+
+// Remove deletes the volume identified by name, delegating to
+// processVolumeDelete.
+func (vs *VolumeService) Remove(ctx context.Context, name string, opts ...RemoveOption) error {
+	volume, err := vs.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	return vs.s.processVolumeDelete(ctx, volume.UUID, opts...)
+}
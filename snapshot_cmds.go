@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/rancher/rancher-volume/api"
 	"github.com/rancher/rancher-volume/util"
 	"net/url"
+	"strconv"
+	"time"
 )
 
 var (
@@ -16,13 +19,24 @@ var (
 				Name:  "name",
 				Usage: "name of snapshot",
 			},
+			cli.StringSliceFlag{
+				Name:  "label",
+				Value: &cli.StringSlice{},
+				Usage: "label to attach to the snapshot, in key=value form, can be repeated",
+			},
 		},
 		Action: cmdSnapshotCreate,
 	}
 
 	snapshotDeleteCmd = cli.Command{
-		Name:   "delete",
-		Usage:  "delete a snapshot: snapshot delete <snapshot>",
+		Name:  "delete",
+		Usage: "delete a snapshot: snapshot delete <snapshot>, or snapshot delete --selector key=value,...",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "selector",
+				Usage: "delete every snapshot matching this comma-separated set of key=value labels, instead of a single uuid",
+			},
+		},
 		Action: cmdSnapshotDelete,
 	}
 
@@ -32,6 +46,91 @@ var (
 		Action: cmdSnapshotInspect,
 	}
 
+	snapshotListCmd = cli.Command{
+		Name:  "list",
+		Usage: "list snapshots: snapshot list [--volume <uuid>]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "only list snapshots of this volume",
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Value: "table",
+				Usage: "output format: json|table",
+			},
+			cli.StringSliceFlag{
+				Name:  "filter",
+				Value: &cli.StringSlice{},
+				Usage: "filter by label, in label=key=value form, can be repeated",
+			},
+		},
+		Action: cmdSnapshotList,
+	}
+
+	snapshotRollbackCmd = cli.Command{
+		Name:  "restore",
+		Usage: "restore a snapshot: snapshot restore <snapshot> [--volume <uuid>]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "uuid of volume to restore into; defaults to the snapshot's origin volume, rolling it back in place",
+			},
+		},
+		Action: cmdSnapshotRollback,
+	}
+
+	snapshotScheduleSetCmd = cli.Command{
+		Name:  "set",
+		Usage: "set a snapshot retention policy for a volume: snapshot schedule set <volume> --hourly N --daily N --weekly N --monthly N --interval 1h",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "hourly",
+				Usage: "number of most recent snapshots to keep",
+			},
+			cli.IntFlag{
+				Name:  "daily",
+				Usage: "number of days to keep one daily snapshot for",
+			},
+			cli.IntFlag{
+				Name:  "weekly",
+				Usage: "number of weeks to keep one weekly snapshot for",
+			},
+			cli.IntFlag{
+				Name:  "monthly",
+				Usage: "number of months to keep one monthly snapshot for",
+			},
+			cli.StringFlag{
+				Name:  "interval",
+				Value: "1h",
+				Usage: "how often to take a snapshot, e.g. 1h, 30m",
+			},
+		},
+		Action: cmdSnapshotScheduleSet,
+	}
+
+	snapshotScheduleGetCmd = cli.Command{
+		Name:   "get",
+		Usage:  "show the retention policy for a volume: snapshot schedule get <volume>",
+		Action: cmdSnapshotScheduleGet,
+	}
+
+	snapshotScheduleClearCmd = cli.Command{
+		Name:   "clear",
+		Usage:  "remove the retention policy for a volume: snapshot schedule clear <volume>",
+		Action: cmdSnapshotScheduleClear,
+	}
+
+	snapshotScheduleCmd = cli.Command{
+		Name:  "schedule",
+		Usage: "scheduled snapshot retention policies",
+		Subcommands: []cli.Command{
+			snapshotScheduleSetCmd,
+			snapshotScheduleGetCmd,
+			snapshotScheduleClearCmd,
+		},
+	}
+
 	snapshotCmd = cli.Command{
 		Name:  "snapshot",
 		Usage: "snapshot related operations",
@@ -39,6 +138,9 @@ var (
 			snapshotCreateCmd,
 			snapshotDeleteCmd,
 			snapshotInspectCmd,
+			snapshotListCmd,
+			snapshotRollbackCmd,
+			snapshotScheduleCmd,
 		},
 	}
 )
@@ -62,6 +164,10 @@ func doSnapshotCreate(c *cli.Context) error {
 	if snapshotName != "" {
 		v.Set(api.KEY_NAME, snapshotName)
 	}
+	labels := util.SliceToMap(c.StringSlice("label"))
+	for key, value := range labels {
+		v.Add(api.KEY_LABELS, key+"="+value)
+	}
 
 	request := "/volumes/" + volumeUUID + "/snapshots/create?" + v.Encode()
 
@@ -75,6 +181,13 @@ func cmdSnapshotDelete(c *cli.Context) {
 }
 
 func doSnapshotDelete(c *cli.Context) error {
+	if selector := c.String("selector"); selector != "" {
+		v := url.Values{}
+		v.Set("selector", selector)
+		request := "/snapshots/?" + v.Encode()
+		return sendRequestAndPrint("DELETE", request, nil)
+	}
+
 	var err error
 	uuid, err := getOrRequestUUID(c, "", true)
 	if err != nil {
@@ -102,3 +215,111 @@ func doSnapshotInspect(c *cli.Context) error {
 	request := "/snapshots/" + uuid + "/"
 	return sendRequestAndPrint("GET", request, nil)
 }
+
+func cmdSnapshotList(c *cli.Context) {
+	if err := doSnapshotList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doSnapshotList(c *cli.Context) error {
+	v := url.Values{}
+	volumeUUID, err := getLowerCaseFlag(c, "volume", false, nil)
+	if err != nil {
+		return err
+	}
+	if volumeUUID != "" {
+		v.Set("volume", volumeUUID)
+	}
+	v.Set("format", c.String("format"))
+	for _, filter := range c.StringSlice("filter") {
+		v.Add("filter", filter)
+	}
+
+	request := "/snapshots/?" + v.Encode()
+	return sendRequestAndPrint("GET", request, nil)
+}
+
+func cmdSnapshotRollback(c *cli.Context) {
+	if err := doSnapshotRollback(c); err != nil {
+		panic(err)
+	}
+}
+
+func doSnapshotRollback(c *cli.Context) error {
+	var err error
+	uuid, err := getOrRequestUUID(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	volumeUUID, err := getLowerCaseFlag(c, "volume", false, nil)
+	if err != nil {
+		return err
+	}
+	if volumeUUID != "" {
+		v.Set("volume", volumeUUID)
+	}
+
+	request := "/snapshots/" + uuid + "/restore?" + v.Encode()
+	return sendRequestAndPrint("POST", request, nil)
+}
+
+func cmdSnapshotScheduleSet(c *cli.Context) {
+	if err := doSnapshotScheduleSet(c); err != nil {
+		panic(err)
+	}
+}
+
+func doSnapshotScheduleSet(c *cli.Context) error {
+	volumeUUID, err := getOrRequestUUID(c, "", true)
+	if err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(c.String("interval")); err != nil {
+		return fmt.Errorf("invalid --interval %v: %v", c.String("interval"), err)
+	}
+
+	v := url.Values{}
+	v.Set("hourly", strconv.Itoa(c.Int("hourly")))
+	v.Set("daily", strconv.Itoa(c.Int("daily")))
+	v.Set("weekly", strconv.Itoa(c.Int("weekly")))
+	v.Set("monthly", strconv.Itoa(c.Int("monthly")))
+	v.Set("interval", c.String("interval"))
+
+	request := "/volumes/" + volumeUUID + "/schedule?" + v.Encode()
+	return sendRequestAndPrint("PUT", request, nil)
+}
+
+func cmdSnapshotScheduleGet(c *cli.Context) {
+	if err := doSnapshotScheduleGet(c); err != nil {
+		panic(err)
+	}
+}
+
+func doSnapshotScheduleGet(c *cli.Context) error {
+	volumeUUID, err := getOrRequestUUID(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := "/volumes/" + volumeUUID + "/schedule"
+	return sendRequestAndPrint("GET", request, nil)
+}
+
+func cmdSnapshotScheduleClear(c *cli.Context) {
+	if err := doSnapshotScheduleClear(c); err != nil {
+		panic(err)
+	}
+}
+
+func doSnapshotScheduleClear(c *cli.Context) error {
+	volumeUUID, err := getOrRequestUUID(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := "/volumes/" + volumeUUID + "/schedule"
+	return sendRequestAndPrint("DELETE", request, nil)
+}
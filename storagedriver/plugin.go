@@ -0,0 +1,223 @@
+package storagedriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pluginSockDir = "/run/docker/plugins"
+	pluginSpecDir = "/etc/docker/plugins"
+
+	pluginContentType = "application/vnd.docker.plugins.v1.1+json"
+
+	pluginHealthCheckRetries = 3
+	pluginHealthCheckDelay   = time.Second
+	pluginRequestTimeout     = 30 * time.Second
+)
+
+// pluginDriver lets Convoy be configured with a driver name of the form
+// "plugin:<name>" and have every VolumeOperations call forwarded to the
+// out-of-process Docker Volume Plugin discovered under
+// /run/docker/plugins, instead of one of Convoy's built-in drivers. This
+// is how external backends like REX-Ray are consumed without Convoy
+// having to vendor anything plugin-specific.
+type pluginDriver struct {
+	name    string
+	network string
+	address string
+	client  *http.Client
+}
+
+// NewPluginDriver discovers the Docker plugin named name and health
+// checks it before returning, so a misconfigured or not-yet-started
+// plugin fails at getDriver time rather than on the first real volume
+// operation.
+func NewPluginDriver(name string) (*pluginDriver, error) {
+	network, address, err := discoverPlugin(name)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &pluginDriver{
+		name:    name,
+		network: network,
+		address: address,
+		client: &http.Client{
+			Timeout: pluginRequestTimeout,
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.DialTimeout(network, address, pluginRequestTimeout)
+				},
+			},
+		},
+	}
+	if err := d.healthCheck(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// discoverPlugin follows the same lookup order as the Docker daemon
+// itself: a unix socket under /run/docker/plugins/<name>.sock first,
+// falling back to a .spec (bare address) or .json (address + TLS config)
+// file under /etc/docker/plugins.
+func discoverPlugin(name string) (network, address string, err error) {
+	sockPath := filepath.Join(pluginSockDir, name+".sock")
+	if _, err := os.Stat(sockPath); err == nil {
+		return "unix", sockPath, nil
+	}
+
+	specPath := filepath.Join(pluginSpecDir, name+".spec")
+	if data, err := ioutil.ReadFile(specPath); err == nil {
+		return splitPluginAddr(strings.TrimSpace(string(data)))
+	}
+
+	jsonPath := filepath.Join(pluginSpecDir, name+".json")
+	if data, err := ioutil.ReadFile(jsonPath); err == nil {
+		spec := &struct {
+			Addr string `json:"Addr"`
+		}{}
+		if err := json.Unmarshal(data, spec); err != nil {
+			return "", "", err
+		}
+		return splitPluginAddr(spec.Addr)
+	}
+
+	return "", "", fmt.Errorf("Cannot find plugin %v under %v or %v", name, pluginSockDir, pluginSpecDir)
+}
+
+func splitPluginAddr(addr string) (network, address string, err error) {
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Invalid plugin address %v", addr)
+	}
+	return parts[0], parts[1], nil
+}
+
+// healthCheck confirms the plugin is reachable and implements
+// VolumeDriver, retrying a few times in case it's still starting up.
+func (d *pluginDriver) healthCheck() error {
+	var lastErr error
+	for i := 0; i < pluginHealthCheckRetries; i++ {
+		resp := &pluginResponse{}
+		if err := d.call("/Plugin.Activate", nil, resp); err != nil {
+			lastErr = err
+		} else {
+			for _, implements := range resp.Implements {
+				if implements == "VolumeDriver" {
+					return nil
+				}
+			}
+			lastErr = fmt.Errorf("plugin %v does not implement VolumeDriver", d.name)
+		}
+		time.Sleep(pluginHealthCheckDelay)
+	}
+	return fmt.Errorf("plugin %v failed health check: %v", d.name, lastErr)
+}
+
+type pluginRequest struct {
+	Name string            `json:"Name"`
+	Opts map[string]string `json:"Opts,omitempty"`
+}
+
+type pluginResponse struct {
+	Mountpoint string              `json:"Mountpoint"`
+	Err        string              `json:"Err"`
+	Volumes    []map[string]string `json:"Volumes"`
+	Implements []string            `json:"Implements"`
+}
+
+func (d *pluginDriver) call(path string, req *pluginRequest, out *pluginResponse) error {
+	var reader *bytes.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader([]byte("{}"))
+	}
+
+	httpReq, err := http.NewRequest("POST", "http://plugin"+path, reader)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", pluginContentType)
+
+	resp, err := d.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return err
+	}
+	if out.Err != "" {
+		return fmt.Errorf("plugin %v: %v", d.name, out.Err)
+	}
+	return nil
+}
+
+func (d *pluginDriver) Name() string {
+	return "plugin:" + d.name
+}
+
+func (d *pluginDriver) VolumeOps() (VolumeOperations, error) {
+	return d, nil
+}
+
+func (d *pluginDriver) CreateVolume(id string, size int64) error {
+	opts := map[string]string{}
+	if size > 0 {
+		opts["size"] = strconv.FormatInt(size, 10)
+	}
+	return d.call("/VolumeDriver.Create", &pluginRequest{Name: id, Opts: opts}, &pluginResponse{})
+}
+
+func (d *pluginDriver) DeleteVolume(id string) error {
+	return d.call("/VolumeDriver.Remove", &pluginRequest{Name: id}, &pluginResponse{})
+}
+
+func (d *pluginDriver) MountVolume(id string, opts map[string]string) (string, error) {
+	resp := &pluginResponse{}
+	if err := d.call("/VolumeDriver.Mount", &pluginRequest{Name: id, Opts: opts}, resp); err != nil {
+		return "", err
+	}
+	return resp.Mountpoint, nil
+}
+
+func (d *pluginDriver) UmountVolume(id string) error {
+	return d.call("/VolumeDriver.Unmount", &pluginRequest{Name: id}, &pluginResponse{})
+}
+
+func (d *pluginDriver) MountPoint(id string) (string, error) {
+	resp := &pluginResponse{}
+	if err := d.call("/VolumeDriver.Path", &pluginRequest{Name: id}, resp); err != nil {
+		return "", err
+	}
+	return resp.Mountpoint, nil
+}
+
+func (d *pluginDriver) ListVolume(opts string) ([]byte, error) {
+	resp := &pluginResponse{}
+	if err := d.call("/VolumeDriver.List", &pluginRequest{}, resp); err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp.Volumes)
+}
@@ -0,0 +1,18 @@
+package storagedriver
+
+// OPTS_MOUNT_POINT is the MountVolume option key a caller uses to request
+// a specific mount path instead of letting the driver choose one.
+const OPTS_MOUNT_POINT = "mount-point"
+
+// VolumeOperations is the subset of a driver's behavior needed to create,
+// attach, and list plain volumes. It's split out from snapshot/backup
+// support so a driver that can't do either (e.g. the Docker plugin shim)
+// isn't forced to stub out methods it has no sane implementation for.
+type VolumeOperations interface {
+	CreateVolume(id string, size int64) error
+	DeleteVolume(id string) error
+	MountVolume(id string, opts map[string]string) (string, error)
+	UmountVolume(id string) error
+	MountPoint(id string) (string, error)
+	ListVolume(opts string) ([]byte, error)
+}